@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+
+	"github.com/marcov/giffer/pkg/giffer"
+)
+
+// The fcTL frame control values of the animated frames: each one replaces
+// the previous one, which is cleared to transparent once displayed.
+const (
+	APNG_DISPOSE_OP_BACKGROUND = 1
+	APNG_BLEND_OP_SOURCE       = 0
+)
+
+// PNG color types.
+const (
+	PNG_COLOR_RGB  = 2
+	PNG_COLOR_RGBA = 6
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+func writePngChunk(w io.Writer, chunkType string, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], chunkType)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+
+	for _, b := range [][]byte{header, data, footer} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns whether the image has no transparent pixels.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func abs8(v uint8) int {
+	if v < 0x80 {
+		return int(v)
+	}
+	return 0x100 - int(v)
+}
+
+func paeth(a, b, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Writes the filtered rows of img, each with the filter giving the smallest
+// sum of absolute differences, as the image/png encoder does, compressed.
+func compressPngFrame(img image.Image, bpp int) ([]byte, error) {
+	b := img.Bounds()
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(b)
+		draw.Draw(nrgba, b, img, b.Min, draw.Src)
+	}
+
+	buf := &bytes.Buffer{}
+	zw, err := zlib.NewWriterLevel(buf, zlib.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	n := bpp * b.Dx()
+	prev := make([]uint8, n)
+	row := make([]uint8, n)
+	var filtered [5][]uint8
+	for f := range filtered {
+		filtered[f] = make([]uint8, n+1)
+		filtered[f][0] = uint8(f)
+	}
+	for y := 0; y < b.Dy(); y++ {
+		pix := nrgba.Pix[y*nrgba.Stride:]
+		for x := 0; x < b.Dx(); x++ {
+			copy(row[bpp*x:bpp*x+bpp], pix[4*x:4*x+bpp])
+		}
+
+		best, bestSum := 0, -1
+		for f := range filtered {
+			out := filtered[f][1:]
+			sum := 0
+			for i := range row {
+				var left, upLeft uint8
+				if i >= bpp {
+					left, upLeft = row[i-bpp], prev[i-bpp]
+				}
+				switch f {
+				case 0:
+					out[i] = row[i]
+				case 1:
+					out[i] = row[i] - left
+				case 2:
+					out[i] = row[i] - prev[i]
+				case 3:
+					out[i] = row[i] - uint8((int(left)+int(prev[i]))/2)
+				case 4:
+					out[i] = row[i] - paeth(left, prev[i], upLeft)
+				}
+				sum += abs8(out[i])
+			}
+			if bestSum < 0 || sum < bestSum {
+				best, bestSum = f, sum
+			}
+		}
+		if _, err := zw.Write(filtered[best]); err != nil {
+			return nil, err
+		}
+		prev, row = row, prev
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encodes the frames of the animation, before quantization, as an animated
+// PNG, in 8 bits per channel RGB, or RGBA if some frames have transparent
+// pixels. The frames are compressed in parallel.
+func encodeApng(w io.Writer, anim *animation) error {
+	frames := anim.fullColor
+	if len(frames) == 0 {
+		return giffer.ErrNoFrames
+	}
+
+	var screen image.Rectangle
+	for _, frame := range frames {
+		screen = screen.Union(frame.Bounds())
+	}
+	screen.Min = image.ZP
+
+	// The first frame is the default image, of the size of the screen.
+	if frames[0].Bounds() != screen {
+		first := image.NewNRGBA(screen)
+		draw.Draw(first, frames[0].Bounds(), frames[0], frames[0].Bounds().Min, draw.Src)
+		frames = append([]image.Image{first}, frames[1:]...)
+	}
+
+	colorType, bpp := PNG_COLOR_RGB, 3
+	for _, frame := range frames {
+		if !isOpaque(frame) {
+			colorType, bpp = PNG_COLOR_RGBA, 4
+			break
+		}
+	}
+
+	data := make([][]byte, len(frames))
+	errs := make([]error, len(frames))
+	runFrameJobs(len(frames), "compressing frames", func(i int) {
+		data[i], errs[i] = compressPngFrame(frames[i], bpp)
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.Write(pngSignature); err != nil {
+		return err
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(screen.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(screen.Dy()))
+	ihdr[8], ihdr[9] = 8, byte(colorType)
+	if err := writePngChunk(w, "IHDR", ihdr); err != nil {
+		return err
+	}
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(frames)))
+	binary.BigEndian.PutUint32(actl[4:], uint32(playCount(anim.LoopCount)))
+	if err := writePngChunk(w, "acTL", actl); err != nil {
+		return err
+	}
+
+	// The fcTL and fdAT chunks share the sequence numbers.
+	seq := uint32(0)
+	for i, frame := range frames {
+		b := frame.Bounds()
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(b.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(b.Dy()))
+		binary.BigEndian.PutUint32(fctl[12:], uint32(b.Min.X))
+		binary.BigEndian.PutUint32(fctl[16:], uint32(b.Min.Y))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(minInt(anim.Delay[i], 0xffff)))
+		binary.BigEndian.PutUint16(fctl[22:], 100) // centiseconds
+		fctl[24], fctl[25] = APNG_DISPOSE_OP_BACKGROUND, APNG_BLEND_OP_SOURCE
+		if err := writePngChunk(w, "fcTL", fctl); err != nil {
+			return err
+		}
+		seq++
+
+		if i == 0 {
+			if err := writePngChunk(w, "IDAT", data[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		fdat := make([]byte, 4, 4+len(data[i]))
+		binary.BigEndian.PutUint32(fdat, seq)
+		if err := writePngChunk(w, "fdAT", append(fdat, data[i]...)); err != nil {
+			return err
+		}
+		seq++
+	}
+	return writePngChunk(w, "IEND", nil)
+}
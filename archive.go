@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// An image file of an archive.
+type archiveEntry struct {
+	name    string
+	modTime time.Time
+	size    int64
+	open    func() (io.ReadCloser, error)
+}
+
+// Lists the image files of a zip or tar (optionally gzipped) archive, sorted
+// by name. Zip entries are read from the archive when opened, tar entries,
+// that can only be read in sequence, are loaded to memory. Nothing is
+// extracted to disk. Returns a function closing the archive.
+func readArchive(path string) (error, []archiveEntry, func()) {
+	var err error
+	var entries []archiveEntry
+	cleanup := func() {}
+
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		err, entries, cleanup = readZip(path)
+	} else {
+		err, entries = readTar(path)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while reading archive")
+		return err, nil, nil
+	}
+
+	if len(entries) == 0 {
+		cleanup()
+		logrus.WithField("file", path).Errorf("could not find any image files in archive")
+		return errNoImages, nil, nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return nil, entries, cleanup
+}
+
+// Sorts the archive entries, in name order already, in the given order.
+func sortEntries(entries []archiveEntry, order string, desc bool) {
+	items := make([]sortItem, len(entries))
+	for i, entry := range entries {
+		items[i] = sortItem{name: entry.name, modTime: entry.modTime, size: entry.size}
+		if order == SORT_EXIF {
+			items[i].captureTime, items[i].hasCapture = entryCaptureTime(entry)
+		}
+	}
+
+	sorted := make([]archiveEntry, len(entries))
+	for i, k := range orderIndexes(items, order, desc) {
+		sorted[i] = entries[k]
+	}
+	copy(entries, sorted)
+}
+
+func entryCaptureTime(entry archiveEntry) (time.Time, bool) {
+	rc, err := entry.open()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "entry": entry.name}).Debug("cannot read the capture time")
+		return time.Time{}, false
+	}
+	defer rc.Close()
+
+	err, t := exifCaptureTime(rc)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "entry": entry.name}).Debug("no capture time, sorting by name")
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func readZip(path string) (error, []archiveEntry, func()) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err, nil, nil
+	}
+
+	var entries []archiveEntry
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !isImageFile(f.Name) {
+			continue
+		}
+		entries = append(entries, archiveEntry{name: f.Name, modTime: f.Modified, size: int64(f.UncompressedSize64), open: f.Open})
+	}
+
+	return nil, entries, func() { r.Close() }
+}
+
+func readTar(path string) (error, []archiveEntry) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err, nil
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if lower := strings.ToLower(path); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err, nil
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var entries []archiveEntry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err, nil
+		}
+		if hdr.Typeflag != tar.TypeReg || !isImageFile(hdr.Name) {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err, nil
+		}
+		entries = append(entries, archiveEntry{
+			name:    hdr.Name,
+			modTime: hdr.ModTime,
+			size:    hdr.Size,
+			open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(data)), nil
+			},
+		})
+	}
+
+	return nil, entries
+}
+
+// Returns the n most recently modified entries, oldest first.
+func newestEntries(entries []archiveEntry, n int) []archiveEntry {
+	sorted := append([]archiveEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].modTime.Before(sorted[j].modTime)
+	})
+
+	if len(sorted) > n {
+		sorted = sorted[len(sorted)-n:]
+	}
+	return sorted
+}
+
+func archiveSource(archive string, entries []archiveEntry) frameSource {
+	return func(i int) (error, image.Image) {
+		entry := entries[i]
+		logrus.WithFields(logrus.Fields{"archive": archive, "file": entry.name}).Debug("processing")
+
+		rc, err := entry.open()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "archive": archive, "file": entry.name}).Error("While opening file")
+			return err, nil
+		}
+		defer rc.Close()
+
+		err, img, _ := decodeOriented(rc)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "archive": archive, "file": entry.name}).Error("while decoding file")
+			return err, nil
+		}
+		return nil, img
+	}
+}
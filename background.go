@@ -0,0 +1,52 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+
+	"github.com/marcov/giffer/pkg/giffer"
+)
+
+// Parses the -background color, or nil for "transparent": the transparency
+// is then kept.
+func parseBackground(background string) (error, color.Color) {
+	if strings.EqualFold(background, "transparent") {
+		return nil, nil
+	}
+	return parseColor(background)
+}
+
+// Composites the frame over the background color, so that it has no
+// transparency left. Without a background, the pixels opaque enough to be
+// opaque in the gif get their unpremultiplied color: quantized as is, the
+// premultiplied edges of PNG or WebP images with alpha would darken to black
+// fringes.
+func flattenFrame(img image.Image, background color.Color) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+
+	if background != nil {
+		src := toRGBA(img)
+		flat := image.NewRGBA(src.Rect)
+		draw.Draw(flat, flat.Rect, image.NewUniform(background), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Rect, src, image.Point{}, draw.Over)
+		return flat
+	}
+
+	dst := copyRGBA(img)
+
+	for i := 0; i < len(dst.Pix); i += 4 {
+		a := uint32(dst.Pix[i+3])
+		if a < giffer.TRANSPARENT_ALPHA || a == 0xff {
+			continue
+		}
+		for ch := 0; ch < 3; ch++ {
+			dst.Pix[i+ch] = uint8((uint32(dst.Pix[i+ch])*0xff + a/2) / a)
+		}
+		dst.Pix[i+3] = 0xff
+	}
+	return dst
+}
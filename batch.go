@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Builds an animation for each immediate subdirectory of parent, named after
+// the output template. A failure in one subdirectory does not prevent building
+// the others. Returns whether all the animations were built.
+func buildPerSubdir(parent string, tmpl *outputTemplate, base string, format *outputFormat,
+	build func(string) (error, *animation), checksum bool) bool {
+	entries, err := ioutil.ReadDir(parent)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "dir": parent}).Error("while reading directory")
+		return false
+	}
+
+	var subdirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			subdirs = append(subdirs, entry.Name())
+		}
+	}
+
+	if len(subdirs) == 0 {
+		logrus.WithField("dir", parent).Error("could not find any subdirectory at provided path")
+		return false
+	}
+
+	outfiles := make([]string, len(subdirs))
+	for i, subdir := range subdirs {
+		outfiles[i] = tmpl.render(&outputNameVars{
+			base:   base,
+			index:  i + 1,
+			subdir: subdir,
+			ext:    format.ext(),
+		})
+	}
+
+	if err := checkOutputConflicts(outfiles); err != nil {
+		logrus.WithField("error", err).Error("conflicting output file names")
+		return false
+	}
+
+	results := make(map[string]error, len(subdirs))
+	for i, subdir := range subdirs {
+		outfile := outfiles[i]
+		logrus.WithFields(logrus.Fields{"dir": subdir, "file": outfile}).Info("Building subdirectory animation")
+
+		results[subdir] = func() error {
+			if _, err := os.Stat(outfile); !os.IsNotExist(err) {
+				logrus.WithFields(logrus.Fields{"file": outfile}).Error("output file already exists")
+				return errors.New("output file already exists")
+			}
+
+			err, anim := build(filepath.Join(parent, subdir))
+			if err != nil {
+				return err
+			}
+
+			err, sum := writeOutput(outfile, anim, format)
+			if err != nil {
+				return err
+			}
+
+			if checksum {
+				fmt.Printf("%s  %s\n", sum, outfile)
+			}
+			return nil
+		}()
+	}
+
+	failed := 0
+	for _, subdir := range subdirs {
+		if err := results[subdir]; err != nil {
+			failed++
+			logrus.WithFields(logrus.Fields{"dir": subdir, "error": err}).Error("subdirectory failed")
+		} else {
+			logrus.WithField("dir", subdir).Info("subdirectory done")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"done":   len(subdirs) - failed,
+		"failed": failed,
+	}).Info("Per subdirectory results")
+
+	return failed == 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// Options of the border stage.
+type borderOptions struct {
+	width  int // 0 for no border
+	color  color.Color
+	radius int // of the rounded corners, 0 for square ones
+}
+
+// Parses a WIDTH[:COLOR] border, black by default, and the corner radius.
+func parseBorderOptions(border string, radius int) (error, *borderOptions) {
+	opts := &borderOptions{color: color.Black, radius: radius}
+	if radius < 0 {
+		return fmt.Errorf("negative corner radius %d", radius), nil
+	}
+
+	if border != "" {
+		width, c := border, ""
+		if i := strings.IndexByte(border, ':'); i >= 0 {
+			width, c = border[:i], border[i+1:]
+		}
+
+		var err error
+		if opts.width, err = strconv.Atoi(width); err != nil || opts.width < 0 {
+			return fmt.Errorf("invalid border %q, expected WIDTH[:#rrggbb]", border), nil
+		}
+		if c != "" {
+			if err, opts.color = parseColor(c); err != nil {
+				return err, nil
+			}
+		}
+	}
+
+	return nil, opts
+}
+
+// Surrounds the frame with the border, then makes the pixels outside of the
+// rounded corners transparent.
+func borderFrame(img image.Image, opts *borderOptions) image.Image {
+	var dst *image.RGBA
+	if opts.width > 0 {
+		b := img.Bounds()
+		dst = image.NewRGBA(image.Rectangle{Max: b.Size().Add(image.Pt(2*opts.width, 2*opts.width))})
+		draw.Draw(dst, dst.Rect, image.NewUniform(opts.color), image.Point{}, draw.Src)
+		draw.Draw(dst, image.Rectangle{Max: b.Size()}.Add(image.Pt(opts.width, opts.width)), img, b.Min, draw.Src)
+	} else {
+		dst = copyRGBA(img)
+	}
+
+	r := minInt(opts.radius, minInt(dst.Rect.Dx(), dst.Rect.Dy())/2)
+	if r == 0 {
+		return dst
+	}
+	w, h := dst.Rect.Dx(), dst.Rect.Dy()
+	for y := 0; y < r; y++ {
+		for x := 0; x < r; x++ {
+			// Distance from the pixel center to the center of the corner arc.
+			dx, dy := float64(r)-float64(x)-0.5, float64(r)-float64(y)-0.5
+			if dx*dx+dy*dy <= float64(r*r) {
+				continue
+			}
+			for _, p := range []image.Point{{x, y}, {w - 1 - x, y}, {x, h - 1 - y}, {w - 1 - x, h - 1 - y}} {
+				i := dst.PixOffset(p.X, p.Y)
+				copy(dst.Pix[i:i+4], []uint8{0, 0, 0, 0})
+			}
+		}
+	}
+	return dst
+}
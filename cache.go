@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/marcov/giffer/pkg/giffer"
+	"github.com/sirupsen/logrus"
+)
+
+// Version of the cached frames format.
+const CACHE_FORMAT = 1
+
+// The options that do not change the processed frames, and keep the cached
+// ones valid.
+var uncachedFlags = map[string]bool{
+	"o": true, "d": true, "j": true, "jobs": true, "max-memory": true,
+	"cache-dir": true, "resume": true, "spill-dir": true, "progress-interval": true,
+	"interval": true, "download-jobs": true, "download-retries": true,
+	"checksum": true, "expect-checksum": true, "manifest": true,
+	"loop": true, "interlace": true, "disposal": true, "delta": true,
+	"fold-duplicates": true, "duplicate-threshold": true, "target-size": true,
+}
+
+// The options naming files that change the processed frames: the files may
+// change between runs, their contents are hashed with the options.
+var cachedFileFlags = map[string]bool{"watermark": true, "palette": true, "subtitles": true}
+
+// Set by -cache-dir: the frames processed by the previous runs, nil if
+// disabled.
+var cache *frameCache
+
+// Processed frames kept in a directory between runs, by the hash of their
+// source pixels and of all that changes their processing: the options, the
+// giffer binary, and the values computed for each frame by the build, like
+// the global palette or the stabilization crops.
+type frameCache struct {
+	dir        string
+	options    []byte // hash of the giffer binary and of the options
+	transforms *transformOptions
+	hits       int64
+	misses     int64
+	errOnce    sync.Once
+}
+
+func newFrameCache(dir string, transforms *transformOptions) (error, *frameCache) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err, nil
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s %d\n", MYNAME, VERSION, CACHE_FORMAT)
+	if exe, err := os.Executable(); err == nil {
+		hashFile(h, exe)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if !uncachedFlags[f.Name] {
+			fmt.Fprintf(h, "-%s=%q\n", f.Name, f.Value.String())
+		}
+		if cachedFileFlags[f.Name] {
+			hashFile(h, f.Value.String())
+		}
+	})
+	return nil, &frameCache{dir: dir, options: h.Sum(nil), transforms: transforms}
+}
+
+// Writes the size and contents of the file at path to h, nothing if it cannot
+// be read, e.g. the named palettes of -palette.
+func hashFile(h hash.Hash, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	content := sha256.New()
+	n, _ := io.Copy(content, f)
+	fmt.Fprintf(h, "%d %x\n", n, content.Sum(nil))
+}
+
+// Writes the pixels of img to h.
+func hashImage(h hash.Hash, img image.Image) {
+	b := img.Bounds()
+	fmt.Fprintf(h, "%T %v\n", img, b)
+	// The whole buffers, that of sub-images included.
+	switch src := img.(type) {
+	case *image.RGBA:
+		fmt.Fprintln(h, src.Stride)
+		h.Write(src.Pix)
+	case *image.NRGBA:
+		fmt.Fprintln(h, src.Stride)
+		h.Write(src.Pix)
+	case *image.RGBA64:
+		fmt.Fprintln(h, src.Stride)
+		h.Write(src.Pix)
+	case *image.NRGBA64:
+		fmt.Fprintln(h, src.Stride)
+		h.Write(src.Pix)
+	case *image.Gray:
+		fmt.Fprintln(h, src.Stride)
+		h.Write(src.Pix)
+	case *image.Gray16:
+		fmt.Fprintln(h, src.Stride)
+		h.Write(src.Pix)
+	case *image.CMYK:
+		fmt.Fprintln(h, src.Stride)
+		h.Write(src.Pix)
+	case *image.Paletted:
+		fmt.Fprintln(h, src.Stride, src.Palette)
+		h.Write(src.Pix)
+	case *image.YCbCr:
+		fmt.Fprintln(h, src.YStride, src.CStride, src.SubsampleRatio)
+		h.Write(src.Y)
+		h.Write(src.Cb)
+		h.Write(src.Cr)
+	default:
+		var px [8]byte
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, a := img.At(x, y).RGBA()
+				binary.BigEndian.PutUint16(px[0:], uint16(r))
+				binary.BigEndian.PutUint16(px[2:], uint16(g))
+				binary.BigEndian.PutUint16(px[4:], uint16(bl))
+				binary.BigEndian.PutUint16(px[6:], uint16(a))
+				h.Write(px[:])
+			}
+		}
+	}
+}
+
+// Writes to h the values the build computed for the frame, which the stages
+// depending on the frame or on the whole animation use.
+func hashFrameState(h hash.Hash, opts *transformOptions, frame *frameInfo) {
+	i := frame.index
+	if opts.crop != nil {
+		fmt.Fprintln(h, "crop", *opts.crop)
+	}
+	if opts.fit != nil {
+		fmt.Fprintln(h, "fit", opts.fit.size)
+	}
+	if opts.stabilize != nil && i < len(opts.stabilize.crops) {
+		fmt.Fprintln(h, "stabilize", opts.stabilize.crops[i])
+	}
+	if opts.deflicker != nil && i < len(opts.deflicker.gains) {
+		fmt.Fprintln(h, "deflicker", opts.deflicker.gains[i])
+	}
+	if opts.text != nil {
+		fmt.Fprintln(h, "text", i, frame.total)
+		if i < len(opts.text.names) {
+			fmt.Fprintf(h, "%q\n", opts.text.names[i])
+		}
+	}
+	if opts.timestamp != nil && i < len(opts.timestamp.found) {
+		fmt.Fprintln(h, "timestamp", opts.timestamp.found[i], opts.timestamp.times[i].String())
+	}
+	if opts.subtitles != nil && i < len(opts.subtitles.lines) {
+		fmt.Fprintf(h, "subtitles %q\n", opts.subtitles.lines[i])
+	}
+	if opts.counter != nil {
+		fmt.Fprintln(h, "counter", i, frame.total)
+	}
+	if opts.progressBar != nil && i < len(opts.progressBar.fractions) {
+		fmt.Fprintln(h, "progressbar", opts.progressBar.fractions[i])
+	}
+	if opts.palette.palette != nil {
+		fmt.Fprintln(h, "palette", opts.palette.palette)
+	}
+}
+
+// Returns the cache key of the frame, from its source image.
+func (c *frameCache) key(img image.Image, frame *frameInfo) string {
+	h := sha256.New()
+	h.Write(c.options)
+	hashFrameState(h, c.transforms, frame)
+	hashImage(h, img)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *frameCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".frame")
+}
+
+// Returns the cached frame of key, or nil.
+func (c *frameCache) get(key string) *image.Paletted {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	err, pm := readCachedFrame(f)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": f.Name()}).Warn("invalid cached frame, processing it again")
+		return nil
+	}
+	// The palettes equal to the global one are the same, which tells the
+	// frames without a local color table.
+	if global := c.transforms.palette.palette; global != nil && sameColors(pm.Palette, global) {
+		pm.Palette = global
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return pm
+}
+
+// Stores the frame of key, once processed. The cache is only an
+// optimization: errors are logged, once, and the build goes on.
+func (c *frameCache) put(key string, pm *image.Paletted) {
+	defer atomic.AddInt64(&c.misses, 1)
+	err := func() error {
+		dir := filepath.Dir(c.path(key))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		// Renamed once complete, as other runs may read it.
+		f, err := ioutil.TempFile(dir, "giffer-frame-")
+		if err != nil {
+			return err
+		}
+		if err := writeCachedFrame(f, pm); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		return os.Rename(f.Name(), c.path(key))
+	}()
+	if err != nil {
+		c.errOnce.Do(func() {
+			logrus.WithFields(logrus.Fields{"error": err, "dir": c.dir}).Warn("cannot write to the frame cache")
+		})
+	}
+}
+
+// Clears the counts of a previous build.
+func (c *frameCache) reset() {
+	atomic.StoreInt64(&c.hits, 0)
+	atomic.StoreInt64(&c.misses, 0)
+}
+
+// Returns the number of frames of the build reused or processed so far.
+func (c *frameCache) frames() int64 {
+	return atomic.LoadInt64(&c.hits) + atomic.LoadInt64(&c.misses)
+}
+
+func (c *frameCache) report() {
+	logrus.WithFields(logrus.Fields{
+		"cached":    atomic.LoadInt64(&c.hits),
+		"processed": atomic.LoadInt64(&c.misses),
+	}).Info("frames reused from the cache")
+}
+
+// Returns whether the palettes have the same colors.
+func sameColors(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The types of the cached palette colors, kept as they are, as the frames
+// are quantized again from them by -target-size: the gogif palettes are in
+// 16 bits per channel.
+const (
+	CACHED_RGBA = iota
+	CACHED_NRGBA
+	CACHED_RGBA64
+	CACHED_NRGBA64
+)
+
+// Returns the type and the channels of the color, in 16 bits, those of
+// other types converted to RGBA64.
+func cachedColor(c color.Color) [5]uint16 {
+	switch c := c.(type) {
+	case color.RGBA:
+		return [5]uint16{CACHED_RGBA, uint16(c.R), uint16(c.G), uint16(c.B), uint16(c.A)}
+	case color.NRGBA:
+		return [5]uint16{CACHED_NRGBA, uint16(c.R), uint16(c.G), uint16(c.B), uint16(c.A)}
+	case color.NRGBA64:
+		return [5]uint16{CACHED_NRGBA64, c.R, c.G, c.B, c.A}
+	}
+	r, g, b, a := c.RGBA()
+	return [5]uint16{CACHED_RGBA64, uint16(r), uint16(g), uint16(b), uint16(a)}
+}
+
+func cachedColorValue(c [5]uint16) color.Color {
+	switch c[0] {
+	case CACHED_RGBA:
+		return color.RGBA{uint8(c[1]), uint8(c[2]), uint8(c[3]), uint8(c[4])}
+	case CACHED_NRGBA:
+		return color.NRGBA{uint8(c[1]), uint8(c[2]), uint8(c[3]), uint8(c[4])}
+	case CACHED_NRGBA64:
+		return color.NRGBA64{c[1], c[2], c[3], c[4]}
+	}
+	return color.RGBA64{c[1], c[2], c[3], c[4]}
+}
+
+// Writes the frame, gzipped, as its bounds, the number of colors of its
+// palette, the colors, and the pixels.
+func writeCachedFrame(w io.Writer, pm *image.Paletted) error {
+	zw, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(zw)
+	header := []int32{int32(CACHE_FORMAT), int32(pm.Rect.Min.X), int32(pm.Rect.Min.Y),
+		int32(pm.Rect.Max.X), int32(pm.Rect.Max.Y), int32(len(pm.Palette))}
+	if err := binary.Write(bw, binary.BigEndian, header); err != nil {
+		return err
+	}
+	for _, c := range pm.Palette {
+		if err := binary.Write(bw, binary.BigEndian, cachedColor(c)); err != nil {
+			return err
+		}
+	}
+	w0 := pm.Rect.Dx()
+	for y := 0; y < pm.Rect.Dy(); y++ {
+		bw.Write(pm.Pix[y*pm.Stride : y*pm.Stride+w0])
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func readCachedFrame(r io.Reader) (error, *image.Paletted) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err, nil
+	}
+	header := make([]int32, 6)
+	if err := binary.Read(zr, binary.BigEndian, header); err != nil {
+		return err, nil
+	}
+	if header[0] != CACHE_FORMAT || header[5] < 0 || header[5] > giffer.MAX_COLORS {
+		return fmt.Errorf("unknown cached frame format"), nil
+	}
+
+	colors := make([][5]uint16, header[5])
+	if err := binary.Read(zr, binary.BigEndian, colors); err != nil {
+		return err, nil
+	}
+	palette := make(color.Palette, len(colors))
+	for i, c := range colors {
+		palette[i] = cachedColorValue(c)
+	}
+
+	rect := image.Rect(int(header[1]), int(header[2]), int(header[3]), int(header[4]))
+	pm := image.NewPaletted(rect, palette)
+	if _, err := io.ReadFull(zr, pm.Pix); err != nil {
+		return err, nil
+	}
+	return nil, pm
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// How the frames are fitted to the canvas.
+const (
+	FIT_PAD     = "pad"     // scaled to fit inside, letterboxed with the background
+	FIT_CROP    = "crop"    // scaled to cover, the excess cropped
+	FIT_STRETCH = "stretch" // scaled to the canvas, ignoring the aspect ratio
+)
+
+// Options of the fit stage, giving all the frames the same size.
+type fitOptions struct {
+	mode       string
+	size       image.Point // of the canvas, that of the first frame if zero
+	background color.Color // of FIT_PAD
+	filter     *resampleFilter
+}
+
+func parseFitOptions(mode, canvas, background string, filter *resampleFilter) (error, *fitOptions) {
+	opts := &fitOptions{mode: strings.ToLower(mode), filter: filter}
+	switch opts.mode {
+	case FIT_PAD, FIT_CROP, FIT_STRETCH:
+	default:
+		return fmt.Errorf("invalid fit mode %q, expected %s, %s or %s", mode, FIT_PAD, FIT_CROP, FIT_STRETCH), nil
+	}
+
+	if canvas != "" {
+		var err error
+		if err, opts.size = parseSize(canvas); err != nil {
+			return err, nil
+		}
+	}
+
+	if strings.EqualFold(background, "transparent") {
+		opts.background = color.Transparent
+	} else {
+		var err error
+		if err, opts.background = parseColor(background); err != nil {
+			return err, nil
+		}
+	}
+
+	return nil, opts
+}
+
+// Returns the frame fitted to the canvas.
+func fitFrame(img image.Image, opts *fitOptions) image.Image {
+	size := img.Bounds().Size()
+	canvas := opts.size
+	if size == canvas {
+		return img
+	}
+
+	if opts.mode == FIT_STRETCH {
+		return resampleImage(img, canvas.X, canvas.Y, opts.filter)
+	}
+
+	sx := float64(canvas.X) / float64(size.X)
+	sy := float64(canvas.Y) / float64(size.Y)
+	scale := math.Min(sx, sy)
+	if opts.mode == FIT_CROP {
+		scale = math.Max(sx, sy)
+	}
+	w := maxInt(1, int(math.Round(float64(size.X)*scale)))
+	h := maxInt(1, int(math.Round(float64(size.Y)*scale)))
+	scaled := img
+	if w != size.X || h != size.Y {
+		scaled = resampleImage(img, w, h, opts.filter)
+	}
+
+	// Centered on the canvas: the excess of a FIT_CROP frame falls outside.
+	dst := image.NewRGBA(image.Rect(0, 0, canvas.X, canvas.Y))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(opts.background), image.Point{}, draw.Src)
+	offset := image.Pt((canvas.X-w)/2, (canvas.Y-h)/2)
+	draw.Draw(dst, image.Rectangle{Min: offset, Max: offset.Add(image.Pt(w, h))}, scaled, scaled.Bounds().Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Options of the chromakey stage.
+type chromaKeyOptions struct {
+	color color.RGBA
+	fuzz  float64 // largest distance to the color, from 0 to 1
+}
+
+// Parses the keyed color and the fuzz, the percentage of the largest RGB
+// distance within which colors match, like "10" or "10%".
+func parseChromaKeyOptions(keyColor, fuzz string) (error, *chromaKeyOptions) {
+	err, c := parseColor(keyColor)
+	if err != nil {
+		return err, nil
+	}
+
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(fuzz, "%"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid fuzz %q, expected a percentage from 0 to 100", fuzz), nil
+	}
+
+	return nil, &chromaKeyOptions{color: c.(color.RGBA), fuzz: percent / 100}
+}
+
+// Makes the pixels of the keyed color, within the fuzz, transparent.
+func chromaKeyFrame(img image.Image, opts *chromaKeyOptions) *image.RGBA {
+	dst := copyRGBA(img)
+	// Squared distances, the largest being from black to white. Exact
+	// matches stay within the rounding of the premultiplied pixels.
+	limit := math.Max(opts.fuzz*opts.fuzz*3*255*255, 0.5)
+	kr, kg, kb := float64(opts.color.R), float64(opts.color.G), float64(opts.color.B)
+
+	for i := 0; i < len(dst.Pix); i += 4 {
+		a := float64(dst.Pix[i+3])
+		if a == 0 {
+			continue
+		}
+		// The pixels are alpha premultiplied.
+		dr := float64(dst.Pix[i])*255/a - kr
+		dg := float64(dst.Pix[i+1])*255/a - kg
+		db := float64(dst.Pix[i+2])*255/a - kb
+		if dr*dr+dg*dg+db*db <= limit {
+			copy(dst.Pix[i:i+4], []uint8{0, 0, 0, 0})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Parses a WxH+X+Y geometry, the offsets being optional, into a rectangle.
+func parseGeometry(s string) (error, image.Rectangle) {
+	size, offsets := s, ""
+	if i := strings.Index(s, "+"); i >= 0 {
+		size, offsets = s[:i], s[i+1:]
+	}
+
+	err, wh := parseSize(size)
+	if err != nil {
+		return err, image.Rectangle{}
+	}
+
+	var offset image.Point
+	if offsets != "" {
+		parts := strings.Split(offsets, "+")
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid geometry %q, expected WxH+X+Y", s), image.Rectangle{}
+		}
+		x, errx := strconv.Atoi(parts[0])
+		y, erry := strconv.Atoi(parts[1])
+		if errx != nil || erry != nil || x < 0 || y < 0 {
+			return fmt.Errorf("invalid offset in geometry %q", s), image.Rectangle{}
+		}
+		offset = image.Pt(x, y)
+	}
+
+	return nil, image.Rectangle{Min: offset, Max: offset.Add(wh)}
+}
+
+// Crops the frame to r, relative to its top left corner. The part of r
+// outside the frame is dropped, and a frame outside r is left as it is.
+func cropFrame(img image.Image, r image.Rectangle) image.Image {
+	b := img.Bounds()
+	crop := r.Add(b.Min).Intersect(b)
+	if crop.Empty() {
+		logrus.WithFields(logrus.Fields{
+			"crop":  r,
+			"frame": fmt.Sprintf("%dx%d", b.Dx(), b.Dy()),
+		}).Warn("crop area outside of the frame, not cropping")
+		return img
+	}
+	if crop != r.Add(b.Min) {
+		logrus.WithFields(logrus.Fields{
+			"crop":  r,
+			"frame": fmt.Sprintf("%dx%d", b.Dx(), b.Dy()),
+		}).Debug("crop area exceeds the frame")
+	}
+	return cropImage(img, crop)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Rebuilds the gif and atomically replaces outfile with it, every interval,
+// until the process is signaled.
+func runDaemon(outfile string, interval time.Duration, format *outputFormat, build func() (error, *animation)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	logrus.WithFields(logrus.Fields{
+		"file":     outfile,
+		"interval": interval,
+	}).Info("Starting daemon mode")
+
+	for {
+		if err, anim := build(); err == nil {
+			_ = replaceOutput(outfile, anim, format)
+		}
+
+		select {
+		case sig := <-signals:
+			logrus.WithField("signal", sig).Info("Stopping daemon mode")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Writes the animation to a temporary file next to outfile, then renames it
+// to outfile, so that readers never see a partially written file.
+func replaceOutput(outfile string, anim *animation, format *outputFormat) error {
+	tmpfile := filepath.Join(filepath.Dir(outfile), "."+filepath.Base(outfile)+".tmp")
+	_ = os.Remove(tmpfile)
+
+	if err, _ := writeOutput(tmpfile, anim, format); err != nil {
+		_ = os.Remove(tmpfile)
+		return err
+	}
+
+	if err := os.Rename(tmpfile, outfile); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": outfile}).Error("While replacing output file")
+		_ = os.Remove(tmpfile)
+		return err
+	}
+
+	logrus.WithField("file", outfile).Info("output file updated")
+	return nil
+}
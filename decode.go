@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Extensions of the image files picked up in directories, without dot.
+var imageExtensions = map[string]bool{
+	"jpg":  true,
+	"jpeg": true,
+	"png":  true,
+	"webp": true,
+	"heic": true,
+	"heif": true,
+	"tif":  true,
+	"tiff": true,
+	"bmp":  true,
+	"gif":  true, // expanded to all their frames
+}
+
+// Bytes read ahead of the decoding to find the EXIF orientation: enough for
+// a JFIF segment and a full EXIF one.
+const EXIF_PEEK_SIZE = 1 << 17
+
+// Set by -no-autorotate.
+var autoRotate = true
+
+func isImageFile(path string) bool {
+	return imageExtensions[strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))]
+}
+
+// Opens and decodes an image file. The format is detected from the content,
+// not from the extension.
+func decodeImage(path string) (error, image.Image) {
+	f, err := os.Open(path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("While opening file")
+		return err, nil
+	}
+	defer f.Close()
+
+	err, img, format := decodeOriented(f)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while decoding file")
+		return err, nil
+	}
+	logrus.WithFields(logrus.Fields{"file": path, "format": format}).Debug("decoded")
+
+	return nil, img
+}
+
+// Decodes an image, turned upright as its EXIF orientation tells, for
+// jpeg images and unless disabled by -no-autorotate.
+func decodeOriented(r io.Reader) (error, image.Image, string) {
+	br := bufio.NewReaderSize(r, EXIF_PEEK_SIZE)
+	// Metadata comes before the image data: peek at it before decoding.
+	head, _ := br.Peek(EXIF_PEEK_SIZE)
+
+	// The images without a config within the peeked header are checked
+	// once decoded.
+	if config, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+		if err := checkFrameConfig(config); err != nil {
+			return err, nil, ""
+		}
+	}
+
+	img, format, err := image.Decode(br)
+	if err != nil {
+		return err, nil, ""
+	}
+
+	if autoRotate && format == "jpeg" {
+		if orientation := exifOrientation(bytes.NewReader(head)); orientation != 1 {
+			logrus.WithField("orientation", orientation).Debug("applying the EXIF orientation")
+			img = applyExifOrientation(img, orientation)
+		}
+	}
+	return nil, img, format
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Frames averaged, centered on each frame, for its target brightness.
+	DEFAULT_DEFLICKER_WINDOW = 15
+	// Side of the pixel sample measuring the brightness of a frame.
+	DEFLICKER_SAMPLE_SIDE = 64
+	// Largest correction, as a gain or its inverse: darker or brighter frames
+	// are night shots or scene changes, not flicker.
+	DEFLICKER_MAX_GAIN = 4
+)
+
+// Options of the deflicker stage.
+type deflickerOptions struct {
+	window int
+	gains  []float64 // of each frame, in playback order, set for each build
+}
+
+func parseDeflickerOptions(window int) (error, *deflickerOptions) {
+	if window < 2 {
+		return fmt.Errorf("deflicker window %d too small, expected at least 2 frames", window), nil
+	}
+	return nil, &deflickerOptions{window: window}
+}
+
+// Returns the mean luma of the frame, ignoring transparent pixels, and false
+// if it is fully transparent.
+func meanLuma(img image.Image) (float64, bool) {
+	sample := samplePixels(img, DEFLICKER_SAMPLE_SIDE)
+	sum, count := 0.0, 0
+	for i := 0; i < len(sample.Pix); i += 4 {
+		if sample.Pix[i+3] == 0 {
+			continue
+		}
+		y, _, _ := color.RGBToYCbCr(sample.Pix[i], sample.Pix[i+1], sample.Pix[i+2])
+		sum += float64(y)
+		count++
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return sum / float64(count), true
+}
+
+// Sets the gains evening out the brightness of the numFrames frames of
+// source, after they went through the stages before the deflicker one: each
+// frame is brought to the mean brightness of the frames around it, so that
+// slow changes, like a sunset, are kept while the flicker of auto exposure is
+// removed.
+func (opts *deflickerOptions) compute(numFrames int, source frameSource, stages pipeline) {
+	lumas := make([]float64, numFrames)
+	measured := make([]bool, numFrames)
+
+	runFrameJobs(numFrames, "measuring frames brightness for the deflicker", func(i int) {
+		err, img := source(i)
+		if err != nil {
+			return
+		}
+
+		frame := &frameInfo{index: i, total: numFrames}
+		for _, t := range stages {
+			img = t(img, frame)
+		}
+		lumas[i], measured[i] = meanLuma(img)
+	})
+
+	opts.gains = make([]float64, numFrames)
+	for i := range opts.gains {
+		opts.gains[i] = 1
+		if !measured[i] || lumas[i] < 1 {
+			continue
+		}
+
+		sum, count := 0.0, 0
+		for j := maxInt(0, i-opts.window/2); j <= minInt(numFrames-1, i+opts.window/2); j++ {
+			if measured[j] {
+				sum += lumas[j]
+				count++
+			}
+		}
+		gain := sum / float64(count) / lumas[i]
+		if gain > DEFLICKER_MAX_GAIN || gain < 1.0/DEFLICKER_MAX_GAIN {
+			logrus.WithFields(logrus.Fields{"frame": i + 1, "gain": gain}).Debug("brightness change too large for flicker, frame left as is")
+			continue
+		}
+		opts.gains[i] = gain
+	}
+}
+
+// Returns the effect scaling the colors by gain.
+func gainEffect(gain float64) effect {
+	var lut [256]uint8
+	for v := range lut {
+		lut[v] = clampUint8(float64(v) * gain)
+	}
+	return func(r, g, b uint8) (uint8, uint8, uint8) {
+		return lut[r], lut[g], lut[b]
+	}
+}
+
+// Brings the frame to its target brightness.
+func deflickerFrame(img image.Image, frame *frameInfo, opts *deflickerOptions) image.Image {
+	if frame.index >= len(opts.gains) || opts.gains[frame.index] == 1 {
+		return img
+	}
+	return applyEffects(img, []effect{gainEffect(opts.gains[frame.index])})
+}
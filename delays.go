@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Delays of some frames, in milliseconds, by file name or 1-based frame
+// index. The other frames keep the usual delay.
+type delayOverrides map[string]int
+
+// Loads a delays sidecar: a JSON object, or a CSV file with one "frame,delay"
+// record per line, like:
+//
+//	{"title.jpg": 2000, "12": 500}
+//
+// A CSV header and # comments are skipped.
+func loadDelayOverrides(path string) (error, delayOverrides) {
+	f, err := os.Open(path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while opening delays file")
+		return err, nil
+	}
+	defer f.Close()
+
+	overrides := delayOverrides{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.NewDecoder(f).Decode(&overrides)
+	} else {
+		err = readDelaysCsv(f, overrides)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while reading delays file")
+		return err, nil
+	}
+
+	for frame, delay := range overrides {
+		if delay < 0 {
+			err := fmt.Errorf("frame %q has a negative delay", frame)
+			logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("invalid delays file")
+			return err, nil
+		}
+	}
+	return nil, overrides
+}
+
+func readDelaysCsv(r io.Reader, overrides delayOverrides) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+
+	for line := 0; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		delay, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			if line == 0 {
+				continue // header
+			}
+			return fmt.Errorf("invalid delay of frame %q: %v", record[0], err)
+		}
+		overrides[strings.TrimSpace(record[0])] = delay
+	}
+}
+
+// Overrides the delays of the listed frames. Frame i of delays is the source
+// frame perm[i], or i without perm, whose file is names[perm[i]], if names
+// is not nil.
+func (d delayOverrides) apply(delays []int, perm []int, names []string) {
+	used := map[string]bool{}
+	for i := range delays {
+		src := i
+		if perm != nil {
+			src = perm[i]
+		}
+
+		keys := []string{strconv.Itoa(src + 1)}
+		if names != nil {
+			keys = append(keys, names[src], filepath.Base(names[src]))
+		}
+		for _, key := range keys {
+			if delay, ok := d[key]; ok {
+				delays[i] = delay / 10
+				used[key] = true
+				break
+			}
+		}
+	}
+
+	for frame := range d {
+		if !used[frame] {
+			logrus.WithField("frame", frame).Warn("no frame matches this entry of the delays file")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Regular expression patterns are prefixed with "re:", others are globs.
+const REGEXP_PATTERN_PREFIX = "re:"
+
+// A pattern of files or directories skipped during the walk.
+type excludePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// The -exclude patterns. The flag can be repeated.
+type excludePatterns []excludePattern
+
+func (e *excludePatterns) String() string {
+	var s []string
+	for _, p := range *e {
+		if p.re != nil {
+			s = append(s, REGEXP_PATTERN_PREFIX+p.re.String())
+		} else {
+			s = append(s, p.glob)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (e *excludePatterns) Set(s string) error {
+	if strings.HasPrefix(s, REGEXP_PATTERN_PREFIX) {
+		re, err := regexp.Compile(strings.TrimPrefix(s, REGEXP_PATTERN_PREFIX))
+		if err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", s, err)
+		}
+		*e = append(*e, excludePattern{re: re})
+		return nil
+	}
+
+	if _, err := filepath.Match(s, ""); err != nil {
+		return fmt.Errorf("invalid exclude pattern %q: %v", s, err)
+	}
+	*e = append(*e, excludePattern{glob: s})
+	return nil
+}
+
+// Returns whether the path, found inside root, is excluded. Globs match the
+// base name or the slash separated path relative to root, regular expressions
+// match anywhere in the relative path.
+func (e excludePatterns) match(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
+	rel = filepath.ToSlash(rel)
+	base := filepath.Base(path)
+
+	for _, p := range e {
+		if p.re != nil {
+			if p.re.MatchString(rel) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := filepath.Match(p.glob, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p.glob, rel); ok {
+			return true
+		}
+	}
+	return false
+}
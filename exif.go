@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The EXIF tags of the capture time and orientation.
+const (
+	EXIF_ORIENTATION          = 0x0112
+	EXIF_IFD_POINTER          = 0x8769
+	EXIF_DATETIME_ORIGINAL    = 0x9003
+	EXIF_SUBSEC_TIME_ORIGINAL = 0x9291
+	EXIF_TYPE_ASCII           = 2
+	EXIF_TYPE_SHORT           = 3
+	EXIF_DATETIME_LAYOUT      = "2006:01:02 15:04:05"
+)
+
+var errNoCaptureTime = errors.New("no EXIF capture time")
+
+// Reads the capture time of a jpeg image, from its EXIF DateTimeOriginal tag,
+// refined by SubSecTimeOriginal. The time has no time zone: it is the camera
+// clock time, as UTC.
+func exifCaptureTime(r io.Reader) (error, time.Time) {
+	err, tiff, order := readExifTiff(r)
+	if err != nil {
+		return err, time.Time{}
+	}
+
+	ifd0 := readIfd(tiff, order, order.Uint32(tiff[4:]))
+	pointer, ok := ifd0[EXIF_IFD_POINTER]
+	if !ok {
+		return errNoCaptureTime, time.Time{}
+	}
+	exif := readIfd(tiff, order, order.Uint32(pointer[6:]))
+
+	original, ok := ifdString(tiff, order, exif[EXIF_DATETIME_ORIGINAL])
+	if !ok {
+		return errNoCaptureTime, time.Time{}
+	}
+	t, err := time.Parse(EXIF_DATETIME_LAYOUT, original)
+	if err != nil {
+		return err, time.Time{}
+	}
+
+	// Fractions of seconds, as digits: "5" is 500ms.
+	if subsec, ok := ifdString(tiff, order, exif[EXIF_SUBSEC_TIME_ORIGINAL]); ok && len(subsec) > 0 {
+		digits := (subsec + "000000000")[:9]
+		if ns, err := strconv.Atoi(digits); err == nil {
+			t = t.Add(time.Duration(ns))
+		}
+	}
+
+	return nil, t
+}
+
+// Reads the orientation of a jpeg image, from its EXIF Orientation tag: 1 to
+// 8, 1 being upright, and 1 if it has none.
+func exifOrientation(r io.Reader) int {
+	err, tiff, order := readExifTiff(r)
+	if err != nil {
+		return 1
+	}
+
+	entry, ok := readIfd(tiff, order, order.Uint32(tiff[4:]))[EXIF_ORIENTATION]
+	if !ok || order.Uint16(entry) != EXIF_TYPE_SHORT {
+		return 1
+	}
+	orientation := int(order.Uint16(entry[6:]))
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// Returns the TIFF data of the EXIF segment of a jpeg, and its byte order.
+func readExifTiff(r io.Reader) (error, []byte, binary.ByteOrder) {
+	err, tiff := readExifSegment(bufio.NewReader(r))
+	if err != nil {
+		return err, nil, nil
+	}
+
+	switch {
+	case bytes.HasPrefix(tiff, []byte("II*\x00")):
+		return nil, tiff, binary.LittleEndian
+	case bytes.HasPrefix(tiff, []byte("MM\x00*")):
+		return nil, tiff, binary.BigEndian
+	}
+	return errNoCaptureTime, nil, nil
+}
+
+// Returns the TIFF data of the EXIF APP1 segment of a jpeg, stopping at the
+// image data.
+func readExifSegment(r *bufio.Reader) (error, []byte) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return errNoCaptureTime, nil
+	}
+
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return errNoCaptureTime, nil
+		}
+		// Start of scan or end of image: no more metadata.
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return errNoCaptureTime, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return errNoCaptureTime, nil
+		}
+		if marker[1] != 0xe1 {
+			if _, err := r.Discard(length); err != nil {
+				return errNoCaptureTime, nil
+			}
+			continue
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return errNoCaptureTime, nil
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) && len(segment) >= 14 {
+			return nil, segment[6:]
+		}
+	}
+}
+
+// Returns the entries of the IFD at offset, by tag: their type, count and
+// value (or offset of the value) bytes.
+func readIfd(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16][]byte {
+	entries := map[uint16][]byte{}
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return entries
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(tiff)) {
+			break
+		}
+		entry := tiff[start : start+12]
+		entries[order.Uint16(entry)] = entry[2:]
+	}
+	return entries
+}
+
+// Returns the value of an ASCII IFD entry.
+func ifdString(tiff []byte, order binary.ByteOrder, entry []byte) (string, bool) {
+	if entry == nil || order.Uint16(entry) != EXIF_TYPE_ASCII {
+		return "", false
+	}
+
+	count := uint64(order.Uint32(entry[2:]))
+	value := entry[6:]
+	if count > 4 {
+		offset := uint64(order.Uint32(value))
+		if offset+count > uint64(len(tiff)) {
+			return "", false
+		}
+		value = tiff[offset : offset+count]
+	} else {
+		value = value[:count]
+	}
+	return strings.TrimRight(string(value), "\x00 "), true
+}
+
+// Returns the capture time of the jpeg file at path, and whether it has
+// one.
+func fileCaptureTime(path string) (time.Time, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Debug("cannot read the capture time")
+		return time.Time{}, false
+	}
+	defer f.Close()
+
+	err, t := exifCaptureTime(f)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Debug("no capture time, sorting by name")
+		return time.Time{}, false
+	}
+	return t, true
+}
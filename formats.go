@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/marcov/giffer/pkg/giffer"
+)
+
+// Set by -interlace.
+var interlaceGif = false
+
+// An animation to encode: the gif built from the frames, or for the full color
+// formats, the frames before quantization, with the delays, loop count and
+// screen of the gif.
+type animation struct {
+	*gif.GIF
+	fullColor []image.Image // nil for the gif frames
+}
+
+// An output file format.
+type outputFormat struct {
+	name        string
+	description string
+	extension   string // of the output files, default: the name
+	// Encodes the frames before quantization, with all their colors: the
+	// palette options do not apply.
+	fullColor bool
+	encode    func(io.Writer, *animation) error
+	// Writes the files describing the output at the given path, next to
+	// it. Nil if none.
+	describe func(string, *animation) error
+}
+
+func (f *outputFormat) ext() string {
+	if f.extension != "" {
+		return f.extension
+	}
+	return f.name
+}
+
+// Returns the total number of plays of the gif loop count, 0 for forever, as
+// the other formats store it.
+func playCount(loopCount int) int {
+	switch {
+	case loopCount < 0:
+		return 1
+	case loopCount > 0:
+		return loopCount + 1
+	}
+	return 0
+}
+
+// The WebP ANIM chunk stores the number of plays on 16 bits.
+const WEBP_MAX_PLAYS = 0xffff
+
+// Returns the number of plays of the WebP animations, as playCount: the most
+// plays of the gif loop count, 65536, play 65535 times instead of forever.
+func webpPlayCount(loopCount int) int {
+	return minInt(playCount(loopCount), WEBP_MAX_PLAYS)
+}
+
+var outputFormats = []*outputFormat{
+	{
+		name:        "gif",
+		description: "animated GIF",
+		encode: func(w io.Writer, anim *animation) error {
+			if interlaceGif {
+				return giffer.EncodeInterlaced(w, anim.GIF)
+			}
+			return giffer.EncodeAll(w, anim.GIF)
+		},
+	},
+	{
+		name:        "webp",
+		description: "animated WebP (" + WEBP_ENCODER + ")",
+		encode: func(w io.Writer, anim *animation) error {
+			return encodeWebp(w, anim.GIF)
+		},
+	},
+	{
+		name:        "apng",
+		description: "animated PNG, in full color",
+		fullColor:   true,
+		encode:      encodeApng,
+	},
+	{
+		name:        "mp4",
+		description: "H.264 video, in full color (requires ffmpeg)",
+		fullColor:   true,
+		encode:      videoEncoder("mp4"),
+	},
+	{
+		name:        "webm",
+		description: "VP9 video, in full color, with transparency (requires ffmpeg)",
+		fullColor:   true,
+		encode:      videoEncoder("webm"),
+	},
+	{
+		name:        "avif",
+		description: "animated AVIF, in full color (requires ffmpeg 6 or later, with libaom)",
+		fullColor:   true,
+		encode:      videoEncoder("avif"),
+	},
+	{
+		name:        "spritesheet",
+		description: "PNG grid of the frames, in full color, with JSON and CSS descriptors",
+		extension:   "png",
+		fullColor:   true,
+		encode:      encodeSpriteSheet,
+		describe:    writeSpriteSheetDescriptors,
+	},
+}
+
+func findOutputFormat(name string) (error, *outputFormat) {
+	for _, format := range outputFormats {
+		if strings.EqualFold(format.name, name) {
+			return nil, format
+		}
+	}
+	return fmt.Errorf("unknown output format %q", name), nil
+}
+
+// Parses a comma separated list of output formats, the first one being that
+// of the -o output.
+func parseOutputFormats(spec string) (error, []*outputFormat) {
+	var formats []*outputFormat
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		err, format := findOutputFormat(strings.TrimSpace(name))
+		if err != nil {
+			return err, nil
+		}
+		if seen[format.name] {
+			return fmt.Errorf("duplicate output format %q", format.name), nil
+		}
+		seen[format.name] = true
+		formats = append(formats, format)
+	}
+	return nil, formats
+}
+
+// Returns the path of the output in format, next to outfile, the output of the
+// first format: the same one with the format extension.
+func extraOutputPath(outfile string, format *outputFormat) string {
+	return strings.TrimSuffix(outfile, filepath.Ext(outfile)) + "." + format.ext()
+}
+
+// Prints the supported output formats, and the capabilities of their encoders
+// in this build.
+func listOutputFormats(w io.Writer) {
+	for _, format := range outputFormats {
+		fmt.Fprintf(w, "%-11s %s\n", format.name, format.description)
+	}
+}
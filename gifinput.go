@@ -0,0 +1,148 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+func isGifFile(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".gif")
+}
+
+// Decodes the frames of an animated gif as they are displayed: each frame is
+// drawn on the logical screen over the previous ones, following their
+// disposal methods. Pixels not covered by any frame are left transparent.
+// Returns the frames and their delays.
+func decodeGif(path string) (error, []image.Image, []int) {
+	f, err := os.Open(path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("While opening file")
+		return err, nil, nil
+	}
+	defer f.Close()
+
+	config, err := gif.DecodeConfig(f)
+	if err == nil {
+		err = checkFrameConfig(config)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while decoding gif")
+		return err, nil, nil
+	}
+
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while decoding gif")
+		return err, nil, nil
+	}
+
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewRGBA(screen)
+	frames := make([]image.Image, len(g.Image))
+
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous []byte
+		if disposal == gif.DisposalPrevious {
+			previous = append([]byte{}, canvas.Pix...)
+		}
+
+		draw.Draw(canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+		displayed := image.NewRGBA(screen)
+		copy(displayed.Pix, canvas.Pix)
+		frames[i] = displayed
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+
+	return nil, frames, g.Delay
+}
+
+// Returns a source of copies of the images, as the stages may draw on them.
+func imagesSource(images []image.Image) frameSource {
+	return func(i int) (error, image.Image) {
+		return nil, cropImage(images[i], images[i].Bounds())
+	}
+}
+
+// A frame found in a directory: an image file, decoded when processed, or a
+// frame of an animated gif file, decoded upfront.
+type dirFrame struct {
+	path  string
+	image image.Image // nil for image files
+	delay int         // centiseconds, -1 for the default delay
+}
+
+// Expands the gif files among paths into all their frames, with their delays.
+func expandGifs(paths []string) (error, []dirFrame) {
+	var frames []dirFrame
+	for _, path := range paths {
+		if !isGifFile(path) {
+			frames = append(frames, dirFrame{path: path, delay: -1})
+			continue
+		}
+
+		err, images, delays := decodeGif(path)
+		if err != nil {
+			return err, nil
+		}
+		logrus.WithFields(logrus.Fields{"file": path, "frames": len(images)}).Debug("found gif")
+		for i, img := range images {
+			frames = append(frames, dirFrame{path: path, image: img, delay: delays[i]})
+		}
+	}
+	return nil, frames
+}
+
+func dirFramesSource(frames []dirFrame) frameSource {
+	files := make([]string, len(frames))
+	for i, frame := range frames {
+		files[i] = frame.path
+	}
+	decode := fileSource(files)
+
+	return func(i int) (error, image.Image) {
+		if img := frames[i].image; img != nil {
+			return nil, cropImage(img, img.Bounds())
+		}
+		return decode(i)
+	}
+}
+
+// Returns the delays of the frames, defaultCs for the image files, or nil
+// when no frame comes from a gif.
+func dirFramesDelays(frames []dirFrame, defaultCs int) []int {
+	delays := make([]int, len(frames))
+	fromGif := false
+	for i, frame := range frames {
+		delays[i] = frame.delay
+		if delays[i] < 0 {
+			delays[i] = defaultCs
+		} else {
+			fromGif = true
+		}
+	}
+	if !fromGif {
+		return nil
+	}
+	return delays
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Returns whether path is a glob pattern rather than an existing file.
+func isGlobPattern(path string) bool {
+	if !strings.ContainsAny(path, "*?[") {
+		return false
+	}
+	_, err := os.Stat(path)
+	return os.IsNotExist(err)
+}
+
+// Expands the glob pattern, as filepath.Match, into the image files it matches,
+// in name order. Matching directories are searched like the path argument.
+func expandGlob(pattern string, opts *findOptions) (error, []string) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "pattern": pattern}).Error("invalid glob pattern")
+		return err, nil
+	}
+
+	var imgPaths []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			err, paths := findImages(match, opts)
+			if err != nil && err != errNoImages {
+				return err, nil
+			}
+			imgPaths = append(imgPaths, paths...)
+		} else if isImageFile(match) && !opts.exclude.match(filepath.Dir(match), match) {
+			imgPaths = append(imgPaths, match)
+		}
+	}
+
+	if len(imgPaths) == 0 {
+		err := fmt.Errorf("no image files match %q", pattern)
+		logrus.WithField("error", err).Error("could not find any image files")
+		return err, nil
+	}
+
+	return nil, imgPaths
+}
@@ -0,0 +1,243 @@
+package main
+
+// The end-to-end tests of giffer: TestGolden runs the giffer binary, built by
+// TestMain, on the fixture frames for each test case, and compares the output
+// byte for byte with the committed golden file.
+//
+// Test cases are listed in testdata/golden/cases.json, as the giffer options
+// to use, plus optional checks on the decoded gif. After an intended change of
+// the output, regenerate the golden files with:
+//
+//	go test -run TestGolden -update-golden
+//
+// and review them before committing. A single case runs with
+// -run TestGolden/NAME.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "regenerate the golden files instead of comparing with them")
+
+// The directory of the test cases, fixtures and golden files.
+var goldenDir = filepath.Join("testdata", "golden")
+
+// The giffer binary under test, built by TestMain.
+var gifferBinary string
+
+// The checks run on a decoded gif output, on top of the byte comparison, to
+// make failures easier to understand.
+type expectation struct {
+	Frames *int   `json:"frames"`
+	Delays []int  `json:"delays"`
+	Size   string `json:"size"` // WxH of the logical screen
+	Loop   *int   `json:"loop"` // decoded LoopCount, -1 without loop extension
+
+	// Every frame has transparent pixels.
+	Transparent bool `json:"transparent"`
+}
+
+type testCase struct {
+	Name   string       `json:"name"`
+	Args   []string     `json:"args"`   // {outdir} is the directory of the outputs
+	Input  string       `json:"input"`  // relative to the testdata dir, default: "frames"
+	Output string       `json:"output"` // compared file, in {outdir}, default: the -o one
+	Expect *expectation `json:"expect"`
+}
+
+// Returns the output extension, that is the -format value.
+// The extensions of the output formats not named after theirs.
+var formatExtensions = map[string]string{
+	"spritesheet": "png",
+}
+
+func (tc *testCase) ext() string {
+	for i, arg := range tc.Args {
+		if strings.TrimLeft(arg, "-") == "format" && i+1 < len(tc.Args) {
+			// That of the first format, written to -o.
+			format := strings.Split(tc.Args[i+1], ",")[0]
+			if ext, ok := formatExtensions[format]; ok {
+				return ext
+			}
+			return format
+		}
+	}
+	return "gif"
+}
+
+func checkExpectation(path string, expect *expectation) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		return fmt.Errorf("cannot decode output: %v", err)
+	}
+
+	if expect.Frames != nil && len(g.Image) != *expect.Frames {
+		return fmt.Errorf("got %d frames, expected %d", len(g.Image), *expect.Frames)
+	}
+
+	if expect.Delays != nil && !reflect.DeepEqual(g.Delay, expect.Delays) {
+		return fmt.Errorf("got delays %v, expected %v", g.Delay, expect.Delays)
+	}
+
+	if size := fmt.Sprintf("%dx%d", g.Config.Width, g.Config.Height); expect.Size != "" && size != expect.Size {
+		return fmt.Errorf("got size %s, expected %s", size, expect.Size)
+	}
+
+	if expect.Loop != nil && g.LoopCount != *expect.Loop {
+		return fmt.Errorf("got loop count %d, expected %d", g.LoopCount, *expect.Loop)
+	}
+
+	if expect.Transparent {
+		for i, frame := range g.Image {
+			if !hasTransparentPixels(frame) {
+				return fmt.Errorf("frame %d has no transparent pixels", i+1)
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasTransparentPixels(pm *image.Paletted) bool {
+	for _, index := range pm.Pix {
+		if _, _, _, a := pm.Palette[index].RGBA(); a == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the offset of the first different byte.
+func firstDifference(a, b []byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	return len(a)
+}
+
+func runCase(giffer, testdata, outdir string, tc *testCase, update bool) error {
+	input := tc.Input
+	if input == "" {
+		input = "frames"
+	}
+
+	name := tc.Name + "." + tc.ext()
+	outfile := filepath.Join(outdir, name)
+	var args []string
+	for _, arg := range tc.Args {
+		args = append(args, strings.Replace(arg, "{outdir}", outdir, -1))
+	}
+	args = append(args, "-o", outfile, filepath.Join(testdata, input))
+
+	cmd := exec.Command(giffer, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("giffer %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	compared := outfile
+	if tc.Output != "" {
+		compared = filepath.Join(outdir, tc.Output)
+	}
+	output, err := ioutil.ReadFile(compared)
+	if err != nil {
+		return fmt.Errorf("no output: %v\n%s", err, stderr.String())
+	}
+
+	if tc.Expect != nil && tc.ext() == "gif" {
+		if err := checkExpectation(compared, tc.Expect); err != nil {
+			return err
+		}
+	}
+
+	goldenfile := filepath.Join(testdata, name)
+	if tc.Output != "" {
+		goldenfile = filepath.Join(testdata, tc.Name+filepath.Ext(tc.Output))
+	}
+	if update {
+		return ioutil.WriteFile(goldenfile, output, 0644)
+	}
+
+	golden, err := ioutil.ReadFile(goldenfile)
+	if err != nil {
+		return fmt.Errorf("no golden file, run with -update-golden: %v", err)
+	}
+
+	if !bytes.Equal(output, golden) {
+		return fmt.Errorf("output differs from %s at byte %d (%d vs %d bytes)",
+			goldenfile, firstDifference(output, golden), len(output), len(golden))
+	}
+
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	dir, err := ioutil.TempDir("", "giffer-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	gifferBinary = filepath.Join(dir, "giffer")
+	build := exec.Command("go", "build", "-o", gifferBinary, ".")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "cannot build giffer:", err)
+		os.RemoveAll(dir)
+		os.Exit(2)
+	}
+
+	status := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(status)
+}
+
+func TestGolden(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(goldenDir, "cases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases []*testCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatal("invalid cases.json: ", err)
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			outdir, err := ioutil.TempDir("", "giffer-golden")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(outdir)
+
+			if err := runCase(gifferBinary, goldenDir, outdir, tc, *updateGolden); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
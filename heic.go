@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// There is no HEIC decoder in Go: HEIC/HEIF files are converted to jpeg by an
+// external command, {in} and {out} being replaced by the paths of the source
+// and converted files.
+const DEFAULT_HEIC_CONVERTER = "heif-convert -q 95 {in} {out}"
+
+// Set by -heic-converter.
+var heicConverter = DEFAULT_HEIC_CONVERTER
+
+// Brands of the ISO BMFF ftyp box of HEIC/HEIF still images and sequences.
+var heicBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"}
+
+func init() {
+	for _, brand := range heicBrands {
+		image.RegisterFormat("heic", "????ftyp"+brand, decodeHeic, decodeHeicConfig)
+	}
+}
+
+// Converts the HEIC content of r to a jpeg file, and returns its path.
+func convertHeic(r io.Reader) (error, string, func()) {
+	fields := strings.Fields(heicConverter)
+	if len(fields) == 0 {
+		return fmt.Errorf("no HEIC converter, set -heic-converter"), "", nil
+	}
+	converter, err := exec.LookPath(fields[0])
+	if err != nil {
+		return fmt.Errorf("HEIC input requires %s (from libheif), or a -heic-converter command", fields[0]), "", nil
+	}
+
+	tmpdir, err := ioutil.TempDir("", MYNAME+"-heic")
+	if err != nil {
+		return err, "", nil
+	}
+	cleanup := func() { os.RemoveAll(tmpdir) }
+
+	in, out := filepath.Join(tmpdir, "in.heic"), filepath.Join(tmpdir, "out.jpg")
+	f, err := os.Create(in)
+	if err == nil {
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		cleanup()
+		return err, "", nil
+	}
+
+	args := make([]string, len(fields)-1)
+	for i, field := range fields[1:] {
+		args[i] = strings.NewReplacer("{in}", in, "{out}", out).Replace(field)
+	}
+	if output, err := exec.Command(converter, args...).CombinedOutput(); err != nil {
+		cleanup()
+		return fmt.Errorf("%s: %v: %s", fields[0], err, strings.TrimSpace(string(output))), "", nil
+	}
+
+	return nil, out, cleanup
+}
+
+func decodeHeic(r io.Reader) (image.Image, error) {
+	err, path, cleanup := convertHeic(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jpeg.Decode(f)
+}
+
+func decodeHeicConfig(r io.Reader) (image.Config, error) {
+	img, err := decodeHeic(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	b := img.Bounds()
+	return image.Config{ColorModel: img.ColorModel(), Width: b.Dx(), Height: b.Dy()}, nil
+}
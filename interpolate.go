@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration of each -crossfade transition, unless set.
+const DEFAULT_CROSSFADE_DURATION = 500 * time.Millisecond
+
+// Converts an image to an image.RGBA with origin at (0, 0).
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	return cropImage(img, img.Bounds()).(*image.RGBA)
+}
+
+// Returns a copy of an image as an image.RGBA with origin at (0, 0), for the
+// stages drawing on the frame: the frame they are given may be used again.
+func copyRGBA(img image.Image) *image.RGBA {
+	return cropImage(img, img.Bounds()).(*image.RGBA)
+}
+
+// How -interpolate synthesizes the frames in between.
+const (
+	INTERPOLATE_BLEND  = "blend"  // cross-blend
+	INTERPOLATE_MOTION = "motion" // moved along the estimated motion, then blended
+)
+
+// Synthesizes the frame at t between a and b.
+type interpolator func(a, b image.Image, t float64) *image.RGBA
+
+func parseInterpolateMode(mode string) (error, interpolator) {
+	switch strings.ToLower(mode) {
+	case INTERPOLATE_BLEND:
+		return nil, blendImages
+	case INTERPOLATE_MOTION:
+		return nil, motionBlendImages
+	}
+	return fmt.Errorf("unknown interpolation mode %q, expected %s or %s", mode, INTERPOLATE_BLEND, INTERPOLATE_MOTION), nil
+}
+
+// The -interpolate value: the number of frames generated between each pair of
+// frames, or Nx, the factor multiplying the number of frames, 2x generating
+// one frame in between.
+type interpolateFlag struct {
+	steps *uint
+}
+
+func (f interpolateFlag) String() string {
+	if f.steps == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*f.steps), 10)
+}
+
+func (f interpolateFlag) Set(s string) error {
+	if factor := strings.TrimSuffix(strings.ToLower(s), "x"); factor != strings.ToLower(s) {
+		n, err := strconv.ParseUint(factor, 10, 32)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid factor %q, expected Nx with N at least 1", s)
+		}
+		*f.steps = uint(n - 1)
+		return nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid number of frames %q, expected N or Nx", s)
+	}
+	*f.steps = uint(n)
+	return nil
+}
+
+// Linearly blends a into b: t = 0 returns a, t = 1 returns b. The result has
+// the size of a, b is aligned to the top left corner of a.
+//
+// This is a plain cross-blend: it does not estimate motion between the two
+// images, so fast moving subjects are rendered as two faded copies.
+func blendImages(a, b image.Image, t float64) *image.RGBA {
+	src, dst := toRGBA(a), toRGBA(b)
+	out := image.NewRGBA(src.Rect)
+	w := uint32(t * 256)
+
+	for y := 0; y < src.Rect.Dy(); y++ {
+		for x := 0; x < src.Rect.Dx(); x++ {
+			i := src.PixOffset(x, y)
+			if !(image.Point{x, y}.In(dst.Rect)) {
+				copy(out.Pix[i:i+4], src.Pix[i:i+4])
+				continue
+			}
+
+			j := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				out.Pix[i+c] = uint8((uint32(src.Pix[i+c])*(256-w) + uint32(dst.Pix[j+c])*w) >> 8)
+			}
+		}
+	}
+
+	return out
+}
+
+// Returns the number of frames generated from numSources source frames, with
+// steps interpolated frames in between each pair of sources.
+func interpolatedCount(numSources, steps int) int {
+	if numSources == 0 {
+		return 0
+	}
+	return (numSources-1)*(steps+1) + 1
+}
+
+// Returns the delays of the interpolated frames, splitting the delayCs of each
+// source frame across the source and its following interpolated frames, so
+// that the total duration is unchanged.
+func interpolatedDelays(numSources, steps, delayCs int) []int {
+	var delays []int
+	for i := 0; i < numSources-1; i++ {
+		delays = append(delays, spreadDelay(steps+1, delayCs)...)
+	}
+	if numSources > 0 {
+		delays = append(delays, delayCs)
+	}
+	return delays
+}
+
+// Returns the delays of the crossfaded frames: each source frame is shown for
+// its whole delayCs, followed by its steps blended frames, sharing fadeCs.
+func crossfadeDelays(numSources, steps, delayCs, fadeCs int) []int {
+	var delays []int
+	for i := 0; i < numSources-1; i++ {
+		delays = append(delays, delayCs)
+		delays = append(delays, spreadDelay(steps, fadeCs)...)
+	}
+	if numSources > 0 {
+		delays = append(delays, delayCs)
+	}
+	return delays
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Bytes taken by each pixel of a frame being processed: the decoded image,
+// the copies made by the processing stages, and the paletted frame.
+const FRAME_BYTES_PER_PIXEL = 16
+
+// Set by -jobs: the number of frames processed at a time.
+var maxJobs = runtime.NumCPU()
+
+// Set by -max-memory: the memory the frames being processed may take, in
+// bytes, 0 for no limit.
+var maxFrameMemory int64
+
+// The number of frames processed at a time, for the frames of the build.
+var frameJobs = maxJobs
+
+// Sets frameJobs for the frames of source, from the size of the first one:
+// maxJobs, or fewer if that many frames would take more than maxFrameMemory.
+// Large frames are then processed a few at a time, even on many cpus.
+func limitFrameJobs(source frameSource) {
+	frameJobs = maxJobs
+	if maxFrameMemory == 0 {
+		return
+	}
+	err, img := source(0)
+	if err != nil {
+		return
+	}
+
+	b := img.Bounds()
+	perFrame := int64(b.Dx()*b.Dy()) * FRAME_BYTES_PER_PIXEL
+	if fit := int(maxFrameMemory / maxInt64(1, perFrame)); fit < maxJobs {
+		frameJobs = maxInt(1, fit)
+		logrus.WithFields(logrus.Fields{
+			"jobs":       frameJobs,
+			"frame size": fmt.Sprintf("%dx%d", b.Dx(), b.Dy()),
+			"max memory": maxFrameMemory,
+		}).Info("processing fewer frames at a time, for the memory they take")
+	}
+}
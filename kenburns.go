@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Frames generated from each image, unless set.
+	DEFAULT_KENBURNS_FRAMES = 30
+	// Zoom reached at the end (or start) of the animation of each image.
+	DEFAULT_KENBURNS_ZOOM = 1.25
+)
+
+// The pans of the successive images, as the positions of the window in the
+// room left by the zoom, from 0 (left or top) to 1 (right or bottom), at the
+// start and at the end of the animation.
+var kenBurnsPans = [][2][2]float64{
+	{{0, 0.5}, {1, 0.5}}, // to the right
+	{{0.5, 0}, {0.5, 1}}, // down
+	{{1, 0.5}, {0, 0.5}}, // to the left
+	{{0.5, 1}, {0.5, 0}}, // up
+}
+
+// Options of -kenburns.
+type kenBurnsOptions struct {
+	frames int
+	zoom   float64
+}
+
+func parseKenBurnsOptions(frames int, zoom float64) (error, *kenBurnsOptions) {
+	if frames < 2 {
+		return fmt.Errorf("%d frames per image, expected at least 2", frames), nil
+	}
+	if zoom < 1 {
+		return fmt.Errorf("zoom %v below 1", zoom), nil
+	}
+	return nil, &kenBurnsOptions{frames: frames, zoom: zoom}
+}
+
+// Returns the window shown by the frame k of the image at index, of the given
+// size: the images alternately zoom in and out, while panning in turn in each
+// direction.
+func (opts *kenBurnsOptions) window(index, k int, size image.Point) (x, y, w, h float64) {
+	t := float64(k) / float64(opts.frames-1)
+	zoom := 1 + (opts.zoom-1)*t
+	if index%2 == 1 {
+		zoom = opts.zoom - (opts.zoom-1)*t
+	}
+
+	pan := kenBurnsPans[index%len(kenBurnsPans)]
+	w, h = float64(size.X)/zoom, float64(size.Y)/zoom
+	x = (float64(size.X) - w) * (pan[0][0] + (pan[1][0]-pan[0][0])*t)
+	y = (float64(size.Y) - h) * (pan[0][1] + (pan[1][1]-pan[0][1])*t)
+	return x, y, w, h
+}
+
+// Returns the w x h frame showing the window of src at x, y, of size ww x wh,
+// bilinearly sampled so that the window moves smoothly, by fractions of
+// pixels.
+func sampleWindow(src *image.RGBA, x, y, ww, wh float64, w, h int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for dy := 0; dy < h; dy++ {
+		fy := y + (float64(dy)+0.5)*wh/float64(h) - 0.5
+		y0 := int(math.Floor(fy))
+		ty := fy - float64(y0)
+		for dx := 0; dx < w; dx++ {
+			fx := x + (float64(dx)+0.5)*ww/float64(w) - 0.5
+			x0 := int(math.Floor(fx))
+			tx := fx - float64(x0)
+
+			var sum [4]float64
+			for _, c := range []struct {
+				x, y int
+				w    float64
+			}{{x0, y0, (1 - tx) * (1 - ty)}, {x0 + 1, y0, tx * (1 - ty)}, {x0, y0 + 1, (1 - tx) * ty}, {x0 + 1, y0 + 1, tx * ty}} {
+				i := src.PixOffset(clampIndex(c.x, sw), clampIndex(c.y, sh))
+				for ch := 0; ch < 4; ch++ {
+					sum[ch] += c.w * float64(src.Pix[i+ch])
+				}
+			}
+
+			j := dst.PixOffset(dx, dy)
+			for ch := 0; ch < 4; ch++ {
+				dst.Pix[j+ch] = uint8(math.Round(sum[ch]))
+			}
+		}
+	}
+	return dst
+}
+
+// Returns a source of opts.frames frames for each of the imgPaths image
+// files, slowly zooming and panning across it, of the size of the image.
+func kenBurnsSource(imgPaths []string, opts *kenBurnsOptions) frameSource {
+	return func(i int) (error, image.Image) {
+		src, k := i/opts.frames, i%opts.frames
+		err, img := fileSource(imgPaths)(src)
+		if err != nil {
+			return err, nil
+		}
+
+		size := img.Bounds().Size()
+		x, y, w, h := opts.window(src, k, size)
+		logrus.WithFields(logrus.Fields{
+			"file":   imgPaths[src],
+			"frame":  k,
+			"window": fmt.Sprintf("%.1fx%.1f+%.1f+%.1f", w, h, x, y),
+		}).Debug("ken burns")
+
+		return nil, sampleWindow(toRGBA(img), x, y, w, h, size.X, size.Y)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reads a list file, or the standard input for "-", one entry per line. Blank
+// lines and lines starting with # are ignored.
+func readLines(listPath string) (error, []string) {
+	var r io.Reader = os.Stdin
+	if listPath != "-" {
+		f, err := os.Open(listPath)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "file": listPath}).Error("While opening list")
+			return err, nil
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		lines = append(lines, s)
+	}
+	if err := scanner.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": listPath}).Error("while reading list")
+		return err, nil
+	}
+
+	return nil, lines
+}
+
+// Reads the ordered list of frame files. Relative paths are relative to the
+// directory of the list file, or to the current directory for the standard
+// input.
+func readFrameList(listPath string) (error, []string) {
+	err, paths := readLines(listPath)
+	if err != nil {
+		return err, nil
+	}
+
+	if len(paths) == 0 {
+		logrus.WithField("file", listPath).Errorf("no frames in list")
+		return errNoImages, nil
+	}
+
+	for i, path := range paths {
+		if listPath != "-" && !filepath.IsAbs(path) {
+			paths[i] = filepath.Join(filepath.Dir(listPath), path)
+		}
+		if _, err := os.Stat(paths[i]); err != nil {
+			err = fmt.Errorf("frame %d: %v", i+1, err)
+			logrus.WithFields(logrus.Fields{"error": err, "file": listPath}).Error("invalid frame list")
+			return err, nil
+		}
+	}
+
+	return nil, paths
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	pb "gopkg.in/cheggaaa/pb.v1"
 	"image"
 	"image/gif"
-	"image/jpeg"
+	"io"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/andybons/gogif"
+	"github.com/marcov/giffer/pkg/giffer"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/semaphore"
 )
@@ -25,43 +30,428 @@ const (
 	OUTFILE = "output.gif"
 )
 
-// Converts an image to an image.Paletted with 256 colors.
-func imageToPaletted(img image.Image) *image.Paletted {
-	pm, ok := img.(*image.Paletted)
-	if !ok {
-		b := img.Bounds()
-		pm = image.NewPaletted(b, nil)
-		q := &gogif.MedianCutQuantizer{NumColor: 256}
-		q.Quantize(pm, b, img, image.ZP)
+// Returns the i-th frame of the animation, before processing. The stages may
+// draw on it: it must not be returned again.
+type frameSource func(i int) (error, image.Image)
+
+// Returns a source of the imgPaths image files frames.
+func fileSource(imgPaths []string) frameSource {
+	return func(i int) (error, image.Image) {
+		path := imgPaths[i]
+		logrus.WithField("file", path).Debug("processing")
+
+		err, img := decodeImage(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"file":  path}).Error("while processing image file")
+		}
+		return err, img
+	}
+}
+
+// Returns a source of the imgPaths image files frames, with steps frames
+// interpolated between each pair of them.
+func interpolatedSource(imgPaths []string, steps int, interpolate interpolator) frameSource {
+	return func(i int) (error, image.Image) {
+		src, step := i/(steps+1), i%(steps+1)
+		if step == 0 {
+			return fileSource(imgPaths)(src)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from": imgPaths[src],
+			"to":   imgPaths[src+1],
+			"step": step,
+		}).Debug("interpolating")
+
+		err, from := decodeImage(imgPaths[src])
+		if err != nil {
+			return err, nil
+		}
+
+		err, to := decodeImage(imgPaths[src+1])
+		if err != nil {
+			return err, nil
+		}
+
+		return nil, interpolate(from, to, float64(step)/float64(steps+1))
+	}
+}
+
+var errNoImages = errors.New("no image files found")
+
+// Options of the search of image files.
+type findOptions struct {
+	strict   bool // fail on special and empty files
+	exclude  excludePatterns
+	maxDepth int // of the files, 1 for the ones directly inside, 0 for any
+
+	followSymlinks bool // walk the symlinks to directories
+}
+
+// Returns the depth of path inside root, 1 for its direct children.
+func pathDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
 	}
-	return pm
+	return len(strings.Split(filepath.ToSlash(rel), "/"))
 }
 
-func processJpeg(path string) (error, *image.Paletted) {
-	f, err := os.Open(path)
+// Returns whether the symlinked directory at path is one of its own parents,
+// that is whether walking it would never end.
+func symlinkLoop(path string) bool {
+	target, err := filepath.EvalSymlinks(path)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("While opening file")
-		return err, nil
+		return true
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return true
+	}
+	return parent == target || strings.HasPrefix(parent, target+string(filepath.Separator))
+}
+
+// Returns the paths of all the image files found inside dirname, up to the
+// maximum depth, but the excluded ones. Special files (e.g. FIFOs or devices) and empty files
+// are skipped, or are an error when strict. Symlinks to directories are only
+// walked when following symlinks.
+func findImages(dirname string, opts *findOptions) (error, []string) {
+	var imgPaths []string
+	var walk func(root string) error
+	walk = func(root string) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != root && opts.exclude.match(dirname, path) {
+				logrus.WithField("file", path).Debug("skipping excluded file")
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// Walk does not follow symlinks, check their target instead.
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, err := os.Stat(path)
+				if err != nil {
+					if !isImageFile(path) {
+						logrus.WithField("file", path).Debug("skipping non image file")
+						return nil
+					}
+					return err
+				}
+				if target.IsDir() && path == dirname {
+					// The trailing separator makes Walk descend into the target.
+					return walk(path + string(filepath.Separator))
+				}
+				if target.IsDir() {
+					if !opts.followSymlinks {
+						logrus.WithField("dir", path).Debug("skipping symlinked dir")
+						return nil
+					}
+					if opts.maxDepth > 0 && pathDepth(dirname, path) >= opts.maxDepth {
+						logrus.WithField("dir", path).Debug("skipping dir beyond the maximum depth")
+						return nil
+					}
+					if symlinkLoop(path) {
+						logrus.WithField("dir", path).Warn("skipping symlink loop")
+						return nil
+					}
+					return walk(path + string(filepath.Separator))
+				}
+				info = target
+			}
+
+			if info.IsDir() {
+				if opts.maxDepth > 0 && path != root && pathDepth(dirname, path) >= opts.maxDepth {
+					logrus.WithField("dir", path).Debug("skipping dir beyond the maximum depth")
+					return filepath.SkipDir
+				}
+				logrus.Debugf("skipping dir %s", path)
+				return nil
+			}
+			if !isImageFile(path) {
+				logrus.WithField("file", path).Debug("skipping non image file")
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				if opts.strict {
+					return fmt.Errorf("%s is not a regular file", path)
+				}
+				logrus.WithFields(logrus.Fields{"file": path, "mode": info.Mode()}).Debug("skipping special file")
+				return nil
+			}
+			if info.Size() == 0 {
+				if opts.strict {
+					return fmt.Errorf("%s is empty", path)
+				}
+				logrus.WithField("file", path).Warn("skipping empty file")
+				return nil
+			}
+
+			logrus.WithFields(logrus.Fields{"file": path}).Debug("found file")
+			imgPaths = append(imgPaths, path)
+			return nil
+		})
 	}
-	defer f.Close()
+	err := walk(dirname)
 
-	img, err := jpeg.Decode(f)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while decoding file")
+		logrus.WithField("err", err).Errorf("error while looking for image files")
 		return err, nil
 	}
 
-	return nil, imageToPaletted(img)
+	if len(imgPaths) == 0 {
+		logrus.Errorf("could not find any image files at provided path")
+		return errNoImages, nil
+	}
+
+	return nil, imgPaths
+}
+
+// Returns the image files of a path argument: a directory, an image file, a
+// glob pattern or a PDF file. Returns a function removing the temporary files,
+// if any.
+func findInputImages(path string, opts *findOptions, pdfDpi int) (error, []string, func()) {
+	if isGlobPattern(path) {
+		err, paths := expandGlob(path, opts)
+		return err, paths, nil
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".pdf") {
+		return rasterizePdf(path, pdfDpi)
+	}
+
+	err, paths := findImages(path, opts)
+	return err, paths, nil
+}
+
+// Returns paths without the ones of the given file.
+func excludeFile(paths []string, file string) []string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return paths
+	}
+
+	var kept []string
+	for _, path := range paths {
+		if other, err := os.Stat(path); err == nil && os.SameFile(info, other) {
+			logrus.WithField("file", path).Debug("skipping output file")
+			continue
+		}
+		kept = append(kept, path)
+	}
+	return kept
+}
+
+// Returns the n most recently modified files among paths, oldest first.
+func newestFiles(paths []string, n int) (error, []string) {
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while reading file info")
+			return err, nil
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	sorted := append([]string(nil), paths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return modTimes[sorted[i]].Before(modTimes[sorted[j]])
+	})
+
+	if len(sorted) > n {
+		sorted = sorted[len(sorted)-n:]
+	}
+	return nil, sorted
+}
+
+// Returns the frames of source in the order of perm, frame i being the
+// source frame perm[i].
+func permutedSource(source frameSource, perm []int) frameSource {
+	return func(i int) (error, image.Image) {
+		return source(perm[i])
+	}
+}
+
+// Returns the delays in the order of perm, like permutedSource.
+func permuteDelays(delays []int, perm []int) []int {
+	permuted := make([]int, len(perm))
+	for i, k := range perm {
+		permuted[i] = delays[k]
+	}
+	return permuted
+}
+
+// Returns the permutation of n frames, last first.
+func reversedOrder(n int) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = n - 1 - i
+	}
+	return perm
+}
+
+// Returns the frames of perm followed by the same frames backwards, without
+// repeating the first and last ones, as they join seamlessly when looping.
+func boomerangOrder(perm []int) []int {
+	boomerang := append([]int(nil), perm...)
+	for i := len(perm) - 2; i > 0; i-- {
+		boomerang = append(boomerang, perm[i])
+	}
+	return boomerang
+}
+
+// Runs job for each of the numFrames frames, in parallel with one job per
+// cpu, showing the progress.
+func runFrameJobs(numFrames int, what string, job func(i int)) {
+	var wg sync.WaitGroup
+	sem := semaphore.NewWeighted(int64(frameJobs))
+
+	logrus.WithFields(logrus.Fields{
+		"// jobs":       frameJobs,
+		"num of frames": numFrames,
+	}).Info("Parallel " + what)
+
+	progress := startProgress(numFrames, progressEvery)
+
+	for i := 0; i < numFrames; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			job(i)
+			progress.increment()
+		}(i)
+	}
+	wg.Wait()
+	progress.finish()
+}
+
+// Runs the numFrames frames of source through the pipeline, and returns the
+// resulting frames in order.
+func processFrames(numFrames int, source frameSource, p pipeline) []*image.Paletted {
+	frames := make([]*image.Paletted, numFrames)
+
+	runFrameJobs(numFrames, "processing frames", func(i int) {
+		err, img := source(i)
+		if err != nil {
+			return
+		}
+		frames[i] = p.apply(img, &frameInfo{index: i, total: numFrames})
+	})
+
+	return frames
+}
+
+// Runs the numFrames frames of source through the stages, the pipeline without
+// quantize, and returns the resulting full color frames in order.
+func processFullColorFrames(numFrames int, source frameSource, stages pipeline) []image.Image {
+	frames := make([]image.Image, numFrames)
+
+	runFrameJobs(numFrames, "processing frames", func(i int) {
+		err, img := source(i)
+		if err != nil {
+			return
+		}
+		frame := &frameInfo{index: i, total: numFrames}
+		for _, t := range stages {
+			img = t(img, frame)
+		}
+		frames[i] = img
+	})
+
+	return frames
+}
+
+// Quantizes the full color frames with the quantize stage, for the gif
+// formats written along with the full color ones.
+func quantizeFullColorFrames(fullColor []image.Image, quantize transform) []*image.Paletted {
+	frames := make([]*image.Paletted, len(fullColor))
+
+	runFrameJobs(len(fullColor), "quantizing frames", func(i int) {
+		frames[i] = quantize(fullColor[i], &frameInfo{index: i, total: len(fullColor)}).(*image.Paletted)
+	})
+
+	return frames
+}
+
+// Encodes the animation to the outfile path in the given format, and returns
+// the hex encoded SHA-256 of the written data.
+func writeOutput(outfile string, anim *animation, format *outputFormat) (error, string) {
+	outFile, err := os.OpenFile(outfile, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "format": format.name}).Error("While creating output file")
+		return err, ""
+	}
+
+	defer outFile.Close()
+	hash := sha256.New()
+	if err := format.encode(io.MultiWriter(outFile, hash), anim); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "format": format.name}).Error("While encoding output file")
+		return err, ""
+	}
+	if format.describe != nil {
+		if err := format.describe(outfile, anim); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "format": format.name}).Error("While writing output descriptors")
+			return err, ""
+		}
+	}
+
+	return nil, hex.EncodeToString(hash.Sum(nil))
+}
+
+// Returns how many of the numFrames frames to keep to play them within
+// duration, logging the number of dropped frames.
+func fitToDuration(numFrames int, duration time.Duration) int {
+	fit := framesFittingDuration(numFrames, durationToCs(duration))
+	if fit < numFrames {
+		logrus.WithFields(logrus.Fields{
+			"duration": duration,
+			"dropped":  numFrames - fit,
+			"kept":     fit,
+		}).Info("dropping frames to fit duration")
+	}
+	return fit
+}
+
+// Returns whether the flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
 }
 
 func usage() {
 	fmt.Fprintf(flag.CommandLine.Output(), `NAME:
-   %s - generate animated gifs from jpeg files
+   %s - generate animated gifs from image files
 
 USAGE:
-   %s [options] <path>
+   %s [options] <path>...
+
+By default, %s searches for image files (jpeg, png, webp, heic, tiff and bmp) at the specified path and writes the animated gif to %s
+With multiple paths, their frames are combined in the order of the arguments.
+
+With -scroll, <path> is a single image that is panned across to generate the frames.
 
-By default, %s searches for jpeg files at the specified path and writes the animated gif to %s
+When <path> is a gif file, its frames are re-encoded, keeping their delays.
+<path> may also be a glob pattern, like 'shots/2024-*/img_*.jpg' (quoted, to be expanded by giffer).
+With -i, the frames are the files listed in the given file (- for stdin), in order.
+<path> may also be one or more http(s) URLs of images, or use -urls to read them from a file.
+<path> may also be an s3://bucket/prefix or gs://bucket/prefix object store location.
+With -from-video, <path> is a video file, sampled at -video-fps frames per second.
+When <path> is a zip or tar(.gz) archive, its image files are used, without extracting them.
+When <path> is a PDF file, each page is a frame (requires a giffer build with -tags pdf).
+
+With -manifest, <path> is a JSON manifest describing the exact layout of each frame.
 
 Options:
 `, MYNAME, MYNAME, MYNAME, OUTFILE)
@@ -71,9 +461,144 @@ Options:
 
 func main() {
 	verbose := flag.Bool("d", false, "debug mode")
-	outfile := flag.String("o", OUTFILE, "write the animated git to this destination")
+	outfile := flag.String("o", OUTFILE, "write the animated git to this destination (default extension: the -format one)")
 	delayMs := flag.Uint("t", 100, "gif inter-frame delay (ms)")
+	fps := flag.Float64("fps", 0, "frames per second, instead of -t")
+	realTime := flag.Bool("real-time", false, "delay the frames by the gaps between their EXIF capture times")
+	realTimeScale := flag.Float64("real-time-scale", 1, "multiply the -real-time delays, e.g. 0.01 to play 100 times faster")
+	finalDelay := flag.Duration("final-delay", 0, "delay of the last frame, to hold it before looping (default: as the others)")
+	delaysFile := flag.String("delays", "", "JSON or CSV file of the delays (ms) of some frames, by file name or index")
 	version := flag.Bool("v", false, "print version and exit")
+	manifestMode := flag.Bool("manifest", false, "<path> is a JSON manifest listing the frames, with their position on the screen, delay and disposal")
+	scroll := flag.Bool("scroll", false, "generate the frames by scrolling a viewport across a single image")
+	scrollDir := flag.String("scroll-dir", "v", "scroll direction: v (top to bottom) or h (left to right)")
+	scrollSize := flag.String("scroll-size", "", "scroll viewport size as WxH (default: the image short side, squared)")
+	scrollFrames := flag.Uint("scroll-frames", 30, "number of frames to generate while scrolling")
+	duration := flag.Duration("duration", 0, "total animation duration, spread evenly across the frames (overrides -t)")
+	fitFrames := flag.Bool("fit-frames-to-duration", false, "with -duration, evenly drop frames that cannot be played within the duration")
+	reverse := flag.Bool("reverse", false, "play the frames in reverse order")
+	boomerang := flag.Bool("boomerang", false, "play the frames forward, then backward")
+	shuffle := flag.Bool("shuffle", false, "play the frames in random order")
+	shuffleSeed := flag.Int64("shuffle-seed", 0, "seed of -shuffle, to repeat the same order (default: random)")
+	kenBurns := flag.Bool("kenburns", false, "animate a slow zoom and pan across each image, over -kenburns-frames frames")
+	kenBurnsFrames := flag.Uint("kenburns-frames", DEFAULT_KENBURNS_FRAMES, "number of frames generated from each image by -kenburns")
+	kenBurnsZoom := flag.Float64("kenburns-zoom", DEFAULT_KENBURNS_ZOOM, "zoom factor reached by -kenburns")
+	crossfade := flag.Uint("crossfade", 0, "number of blended frames fading each frame into the next one, after showing it for its whole delay")
+	crossfadeDuration := flag.Duration("crossfade-duration", DEFAULT_CROSSFADE_DURATION, "duration of each -crossfade transition")
+	interpolate := new(uint)
+	flag.Var(interpolateFlag{interpolate}, "interpolate", "number of frames to generate between each pair of frames, or Nx to multiply the frame rate, keeping the same total duration")
+	interpolateMode := flag.String("interpolate-mode", INTERPOLATE_BLEND, "how -interpolate and -crossfade generate the frames: blend, or motion to follow the motion of the content")
+	pipelineSpec := flag.String("pipeline", DEFAULT_PIPELINE, "comma separated list of the processing stages applied to each frame, in order")
+	transparentColor := flag.String("transparent-color", "", "make the pixels of this color, as #rrggbb, transparent, e.g. a green screen background")
+	fuzz := flag.String("fuzz", "0", "match the -transparent-color within this percentage of the largest color distance")
+	crop := flag.String("crop", "", "crop the frames to this WxH+X+Y area")
+	fit := flag.String("fit", "", "give all the frames the same size: pad, crop or stretch them to the -canvas")
+	canvas := flag.String("canvas", "", "WxH size of the frames of -fit (default: the first frame size)")
+	fitColor := flag.String("fit-color", "#000000", "background of the frames padded by -fit: #rrggbb or transparent")
+	smartCrop := flag.String("smart-crop", "", "crop the frames to the most detailed WxH area across the sequence")
+	width := flag.Int("width", 0, "resize the frames to this width (px), with the height following the aspect ratio unless -height is given")
+	height := flag.Int("height", 0, "resize the frames to this height (px), with the width following the aspect ratio unless -width is given")
+	scale := flag.Float64("scale", 0, "resize the frames by this factor, e.g. 0.25")
+	filter := flag.String("filter", "lanczos", "resampling filter of the resized frames: nearest, bilinear or lanczos")
+	maxFrameDim := flag.Uint("max-frame-dimension", 0, "auto-downscale any frame whose larger side exceeds this size (px)")
+	stabilize := flag.Bool("stabilize", false, "align the frames of handheld sequences on the first one, cropping them to the area all of them see")
+	deflicker := flag.Bool("deflicker", false, "even out the brightness of the frames, against the flicker of auto exposure timelapses")
+	deflickerWindow := flag.Uint("deflicker-window", DEFAULT_DEFLICKER_WINDOW, "number of frames averaged for the -deflicker target brightness")
+	brightness := flag.Float64("brightness", 0, "brighten (up to 1) or darken (down to -1) all the frames")
+	contrast := flag.Float64("contrast", 1, "contrast of all the frames, above 1 to increase it, below to reduce it")
+	gamma := flag.Float64("gamma", 1, "gamma correction of all the frames, above 1 to brighten the midtones, below to darken them")
+	saturation := flag.Float64("saturation", 1, "color saturation of all the frames, 0 for grayscale, above 1 for more vivid colors")
+	effectSpec := flag.String("effect", "", "comma separated list of color effects applied to each frame, in order: "+strings.Join(effectNames, ", "))
+	equalize := flag.Bool("equalize", false, "equalize the histogram of each frame, to boost the contrast of low contrast frames (amplifies noise)")
+	watermark := flag.String("watermark", "", "composite this image, e.g. a transparent PNG logo, onto each frame")
+	watermarkPos := flag.String("watermark-pos", "br", "watermark position: tl, tr, bl or br (top/bottom, left/right)")
+	watermarkOpacity := flag.Float64("watermark-opacity", 1, "watermark opacity, from 0 (invisible) to 1")
+	text := flag.String("text", "", "burn this text into each frame, a Go template of {{.Filename}}, {{.Path}}, {{.Index}} and {{.Total}}")
+	textPos := flag.String("text-pos", "tl", "text position: tl, tr, bl or br (top/bottom, left/right)")
+	textColor := flag.String("text-color", "#ffffff", "text color, as #rrggbb")
+	textSize := flag.Uint("text-size", 0, "text height in pixels, rounded to a multiple of 13 (default: following the frame size)")
+	timestamp := flag.Bool("timestamp", false, "burn the EXIF capture time of jpeg frames into each of them")
+	timestampFormat := flag.String("timestamp-format", DEFAULT_TIMESTAMP_FORMAT, "format of -timestamp, as a Go time layout")
+	timestampPos := flag.String("timestamp-pos", "bl", "timestamp position: tl, tr, bl or br (top/bottom, left/right)")
+	timestampColor := flag.String("timestamp-color", "#ffffff", "timestamp text color, as #rrggbb")
+	subtitles := flag.String("subtitles", "", "SRT file of subtitles rendered onto the frames they play with")
+	subtitlesPos := flag.String("subtitles-pos", "bottom", "subtitles position: top or bottom")
+	subtitlesColor := flag.String("subtitles-color", "#ffffff", "subtitles text color, as #rrggbb")
+	progressOverlay := flag.Bool("progress-overlay", false, "draw a bar along the bottom edge of the frames, advancing with the animation")
+	progressOverlayColor := flag.String("progress-overlay-color", "#ffffff", "color of -progress-overlay, as #rrggbb")
+	progressOverlayHeight := flag.Uint("progress-overlay-height", 0, "height of -progress-overlay, in pixels (default: following the frame size)")
+	border := flag.String("border", "", "surround each frame with a border, as WIDTH[:#rrggbb], black by default")
+	rounded := flag.Uint("rounded", 0, "round the corners of each frame with this radius, making them transparent")
+	background := flag.String("background", "transparent", "flatten the transparent pixels of the frames over this color, as #rrggbb, or keep them transparent")
+	counter := flag.Bool("counter", false, "burn the frame number and total number of frames into each frame")
+	counterPos := flag.String("counter-pos", "br", "counter position: tl, tr, bl or br (top/bottom, left/right)")
+	counterColor := flag.String("counter-color", "#ffffff", "counter text color, as #rrggbb")
+	noLocalPalette := flag.Bool("no-local-palette", false, "quantize all the frames against a single global palette, computed from all the frames")
+	globalPalette := flag.Bool("global-palette", false, "same as -no-local-palette")
+	colors := flag.Uint("colors", giffer.MAX_COLORS, "number of colors of the palettes, from 2 to 256: fewer colors make smaller gifs")
+	quantizer := flag.String("quantizer", "mediancut", "palette algorithm: fast (for large frames), mediancut, octree, neuquant or kmeans (best quality, slowest)")
+	quantizeSample := flag.Uint("quantize-sample", 0, "build the palette of each frame from at most this many pixels spread over it, for faster quantization of large frames (0: all the pixels)")
+	dither := flag.String("dither", "none", "dithering of the quantized frames: none, floyd-steinberg (smoothest gradients) or ordered (steady between frames)")
+	lossy := flag.Uint("lossy", 0, "change pixels to the color of their neighbors within this color distance, for a smaller gif, e.g. 20 to 60 (0: lossless)")
+	disposal := flag.String("disposal", "", "disposal of the frames: none, background or previous (default: background if frames are transparent or smaller than the screen, else none)")
+	deltaFrames := flag.Bool("delta", false, "encode the frames after the first one as their changed area, with the unchanged pixels transparent: much smaller screen captures and timelapses")
+	foldDuplicates := flag.Bool("fold-duplicates", false, "drop the frames that are the same as the previous one, adding their delay to it")
+	duplicateThreshold := flag.Float64("duplicate-threshold", 0, "with -fold-duplicates, RMS difference per channel (0-255) under which frames are the same, 0 for identical pixels")
+	jobs := flag.Uint("jobs", 0, "number of frames processed at a time (default: one per cpu)")
+	flag.UintVar(jobs, "j", 0, "same as -jobs")
+	maxMemory := flag.String("max-memory", "2GiB", "process fewer frames at a time when they would take more memory than this, e.g. 512MB, 0 for no limit")
+	resume := flag.Bool("resume", false, "continue the interrupted run of the same command, with the frames it processed in -cache-dir, replacing its partial output")
+	cacheDir := flag.String("cache-dir", "", "keep the processed frames in this directory, and reuse them in the next runs instead of processing the same frames again")
+	spillDir := flag.String("spill-dir", "", "keep the processed frames in a temporary file in this directory instead of memory, for -delta on long sequences")
+	posterSpec := flag.String("poster", "", "also write a still frame to this .jpg or .png file, for web pages to show before the animation loads, as path[:INDEX], INDEX the 1-based frame (default: the first)")
+	sizesSpec := flag.String("sizes", "", "write a gif for each of these comma separated widths (px), e.g. 480,800,1200, processing the frames once, named after -output-template (default: "+DEFAULT_SIZES_TEMPLATE+", next to -o)")
+	splitSize := flag.String("split-size", "", "split the output in parts of at most this size, e.g. 10MB, named after -output-template (default: "+DEFAULT_SPLIT_TEMPLATE+", next to -o)")
+	splitFrames := flag.Uint("split-frames", 0, "split the output in parts of at most this number of frames, named as with -split-size")
+	targetSize := flag.String("target-size", "", "reduce the colors, size, frame rate and increase the lossiness until the output fits this size, e.g. 8MB or 500KiB")
+	fixedPalette := flag.String("palette", "", "quantize all the frames against this palette: web216, gray, a GIMP .gpl palette or an image of up to 256 colors")
+	paletteMaxError := flag.Float64("palette-max-error", 0, "with -no-local-palette, warn about frames whose RMS quantization error exceeds this value (0-255)")
+	paletteErrorFatal := flag.Bool("palette-error-fatal", false, "fail instead of warning when frames exceed -palette-max-error")
+	frameList := flag.String("i", "", "read the ordered list of frame files from this file, - for the standard input")
+	urlList := flag.String("urls", "", "read the URLs of the images to download from this file, one per line")
+	downloadJobs := flag.Uint("download-jobs", DEFAULT_DOWNLOAD_JOBS, "number of parallel downloads")
+	downloadRetries := flag.Uint("download-retries", DEFAULT_DOWNLOAD_RETRIES, "number of retries of a failed download")
+	fromVideo := flag.Bool("from-video", false, "extract the frames from the <path> video file, with ffmpeg")
+	videoFps := flag.Float64("video-fps", 10, "frames per second of video extracted by -from-video")
+	pdfDpi := flag.Uint("pdf-dpi", 72, "resolution of the rasterized PDF pages")
+	loop := flag.Int("loop", 0, "number of times the animation plays, 0 for forever (-1 for once, as 1)")
+	rotate := flag.Int("rotate", 0, "rotate all the frames clockwise by 90, 180 or 270 degrees")
+	flip := flag.String("flip", "", "flip all the frames, h horizontally (mirror) or v vertically, after -rotate")
+	rotateAutoSquare := flag.Bool("rotate-auto-square", false, "rotate the frames that do not have the -target-orientation")
+	targetOrientation := flag.String("target-orientation", "landscape", "orientation of -rotate-auto-square: landscape or portrait")
+	findOpts := &findOptions{}
+	flag.Var(&findOpts.exclude, "exclude", "skip the files and directories matching this glob, or re:regexp (repeatable)")
+	noRecursive := flag.Bool("no-recursive", false, "only use the files directly inside the directory, same as -max-depth 1")
+	followSymlinks := flag.Bool("follow-symlinks", false, "also walk the symlinks to directories")
+	maxDepth := flag.Uint("max-depth", 0, "only use the files up to this depth inside the directory, 1 for the direct children (default: any)")
+	noAutoRotate := flag.Bool("no-autorotate", false, "do not turn the jpeg frames upright as their EXIF orientation tells")
+	heicCommand := flag.String("heic-converter", DEFAULT_HEIC_CONVERTER,
+		"command converting a HEIC file {in} to the jpeg file {out}")
+	strict := flag.Bool("strict", false, "fail on special and empty files, instead of skipping them")
+	progressSpec := flag.String("progress-interval", DEFAULT_PROGRESS_INTERVAL.String(),
+		"update the progress bar every N frames, or every duration")
+	interval := flag.Duration("interval", 0, "daemon mode: rebuild and replace the output at this interval, until signaled")
+	sortSpec := flag.String("sort", SORT_NAME, "order of the frames found in directories: "+strings.Join(sortOrders, ", "))
+	sortDesc := flag.Bool("sort-desc", false, "reverse the -sort order")
+	start := flag.String("start", "", "first frame to use, as 1-based index or file name (default: the first)")
+	end := flag.String("end", "", "last frame to use, as 1-based index or file name (default: the last)")
+	every := flag.Uint("every", 0, "only use one every N discovered frames")
+	maxFrames := flag.Uint("max-frames", 0, "maximum number of discovered frames to use (default: all)")
+	maxFramesMode := flag.String("max-frames-mode", MAX_FRAMES_SAMPLE,
+		"how -max-frames drops the excess frames: sample (evenly) or truncate (at the end)")
+	newest := flag.Uint("n", 0, "only use the n most recently modified image files (default: all)")
+	perSubdir := flag.Bool("per-subdir", false, "build a separate gif for each subdirectory of <path>, named after it, next to the -o path")
+	outputTemplate := flag.String("output-template", "", "naming scheme of multiple outputs, with {base}, {index}, {subdir} and {ext} tokens, e.g. {base}_{index:03d}.{ext}")
+	formatName := flag.String("format", "gif", "output file format, see -list-formats, or a comma separated list of them, e.g. gif,mp4, the other ones written next to -o")
+	interlace := flag.Bool("interlace", false, "write interlaced gif frames, rendered progressively while they download")
+	spriteColumnsFlag := flag.Uint("sprite-columns", 0, "number of columns of the spritesheet format grid (default: as many as rows)")
+	listFormats := flag.Bool("list-formats", false, "list the supported output formats and exit")
+	checksum := flag.Bool("checksum", false, "print the SHA-256 checksum of the output")
+	expectChecksum := flag.String("expect-checksum", "", "fail if the SHA-256 checksum of the output does not match this one")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -88,102 +613,1567 @@ func main() {
 		return
 	}
 
-	_, err := os.Stat(*outfile)
-	if !os.IsNotExist(err) {
-		logrus.WithFields(logrus.Fields{"file": *outfile}).Error("output file already exists")
+	if *listFormats {
+		listOutputFormats(os.Stdout)
 		return
 	}
 
-	args := flag.Args()
-	if len(args) == 0 {
-		usage()
-		return
+	err, formats := parseOutputFormats(*formatName)
+	if err != nil {
+		logrus.WithField("error", err).Error("invalid output format")
+		os.Exit(1)
+	}
+	format := formats[0]
+	// Whether some formats encode the frames before quantization, and some
+	// the gif ones.
+	var fullColor, paletted *outputFormat
+	hasGif := false
+	for _, f := range formats {
+		if f.fullColor && fullColor == nil {
+			fullColor = f
+		}
+		if !f.fullColor && paletted == nil {
+			paletted = f
+		}
+		hasGif = hasGif || f.name == "gif"
+		if videoCodecs[f.name] != nil && !hasFfmpeg() {
+			logrus.Errorf("the %s format requires ffmpeg", f.name)
+			os.Exit(1)
+		}
+	}
+	if *interlace && !hasGif {
+		logrus.Error("-interlace is only supported with the gif format")
+		os.Exit(1)
+	}
+	interlaceGif = *interlace
+	hasSpriteSheet := false
+	for _, f := range formats {
+		hasSpriteSheet = hasSpriteSheet || f.name == "spritesheet"
+	}
+	if isFlagSet("sprite-columns") && !hasSpriteSheet {
+		logrus.Error("-sprite-columns is only supported with the spritesheet format")
+		os.Exit(1)
+	}
+	if hasSpriteSheet && *interval > 0 {
+		logrus.Error("-interval is not supported with the spritesheet format")
+		os.Exit(1)
+	}
+	spriteColumns = int(*spriteColumnsFlag)
+	if len(formats) > 1 && (*interval > 0 || *perSubdir || *expectChecksum != "") {
+		logrus.Error("several -format are not supported with -interval, -per-subdir or -expect-checksum")
+		os.Exit(1)
+	}
+	if fullColor != nil && paletted != nil {
+		// The frames of all the formats are the same ones, quantized for the
+		// gif ones.
+		for _, name := range []string{"fold-duplicates", "duplicate-threshold", "target-size", "manifest", "cache-dir"} {
+			if isFlagSet(name) {
+				logrus.Errorf("-%s is not supported with the %s format along with the %s one", name, paletted.name, fullColor.name)
+				os.Exit(1)
+			}
+		}
+	}
+	if fullColor != nil && paletted == nil {
+		// The options of the quantized frames, and of the cache of them.
+		for _, name := range []string{"colors", "quantizer", "quantize-sample", "dither", "lossy", "palette",
+			"palette-max-error", "palette-error-fatal", "no-local-palette", "global-palette", "delta",
+			"disposal", "fold-duplicates", "duplicate-threshold", "target-size", "manifest", "cache-dir"} {
+			if isFlagSet(name) {
+				logrus.Errorf("-%s is not supported with the %s format, which keeps all the colors of the frames", name, format.name)
+				os.Exit(1)
+			}
+		}
 	}
 
-	if len(args) > 1 {
-		logrus.Error("wrong number of arguments")
-		return
+	if *outfile == OUTFILE {
+		*outfile = strings.TrimSuffix(OUTFILE, filepath.Ext(OUTFILE)) + "." + format.ext()
 	}
 
-	dirname := args[0]
+	// The outputs of the other formats are written next to the -o one.
+	outfiles := []string{*outfile}
+	for _, f := range formats[1:] {
+		path := extraOutputPath(*outfile, f)
+		if path == *outfile {
+			logrus.WithField("file", path).Errorf("the %s output would overwrite the -o one", f.name)
+			os.Exit(1)
+		}
+		outfiles = append(outfiles, path)
+	}
 
-	var imgPaths []string
-	err = filepath.Walk(dirname, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			logrus.Debugf("skipping dir %s", path)
-			return nil
+	// In daemon mode the output is periodically replaced, and in per-subdir
+	// mode it is not used.
+	var existing []string
+	for _, path := range outfiles {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			existing = append(existing, path)
 		}
-		extension := strings.TrimPrefix(filepath.Ext(path), ".")
-		if !(strings.EqualFold(extension, "jpg") || strings.EqualFold(extension, "jpeg")) {
-			logrus.Debug("Skipping non jpeg file")
-			return nil
+	}
+	statePath := *outfile + STATE_SUFFIX
+	resuming := false
+	if *resume {
+		if *cacheDir == "" {
+			logrus.Error("-resume requires -cache-dir")
+			os.Exit(1)
 		}
-		logrus.WithFields(logrus.Fields{"file": path}).Debug("found file")
-		imgPaths = append(imgPaths, path)
-		return nil
-	})
+		if *interval > 0 || *perSubdir {
+			logrus.Error("-resume is not supported with -interval or -per-subdir")
+			os.Exit(1)
+		}
+		err, state := readRunState(statePath)
+		switch {
+		case err == nil && state.Options != runOptions():
+			logrus.WithField("file", statePath).Error("the interrupted run had other options or inputs, remove its state file to start over")
+			os.Exit(1)
+		case err == nil:
+			logrus.WithFields(logrus.Fields{
+				"done":   state.Done,
+				"frames": state.Frames,
+			}).Info("resuming the interrupted run")
+			resuming = true
+			// Its partial outputs.
+			for _, path := range existing {
+				if err := os.Remove(path); err != nil {
+					logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("cannot remove the partial output")
+					os.Exit(1)
+				}
+			}
+			existing = nil
+		case !os.IsNotExist(err):
+			logrus.WithFields(logrus.Fields{"error": err, "file": statePath}).Error("invalid state file")
+			os.Exit(1)
+		}
+	}
+	// Split and -sizes outputs are named after the -o one, which is not
+	// written.
+	split := *splitSize != "" || *splitFrames > 0
+	if *interval == 0 && !*perSubdir && !split && *sizesSpec == "" && len(existing) > 0 {
+		if _, err := os.Stat(statePath); err == nil {
+			logrus.WithFields(logrus.Fields{"file": existing[0]}).Error("output file already exists, left by an interrupted run: use -resume to continue it")
+			os.Exit(1)
+		}
+		logrus.WithFields(logrus.Fields{"file": existing[0]}).Error("output file already exists")
+		os.Exit(1)
+	}
 
-	if err != nil {
-		logrus.WithField("err", err).Errorf("error while looking for jpeg files")
-		return
+	var poster *posterOptions
+	if *posterSpec != "" {
+		if *interval > 0 || *perSubdir {
+			logrus.Error("-poster is not supported with -interval or -per-subdir")
+			os.Exit(1)
+		}
+		if err, poster = parsePosterOptions(*posterSpec); err != nil {
+			logrus.WithField("error", err).Error("invalid poster option")
+			os.Exit(1)
+		}
+		// That of the interrupted run is replaced.
+		if checkNewOutputs([]string{poster.path}, resuming) != nil {
+			os.Exit(1)
+		}
 	}
 
-	if len(imgPaths) == 0 {
-		logrus.Errorf("could not find any jpeg files at provided path")
-		return
+	args := flag.Args()
+	var urls []string
+	if *urlList != "" {
+		if err, urls = readURLList(*urlList); err != nil {
+			os.Exit(1)
+		}
+	}
+
+	var listPaths []string
+	if *frameList != "" {
+		if len(args) > 0 || *urlList != "" {
+			logrus.Error("-i is not supported with path arguments or -urls")
+			os.Exit(1)
+		}
+		if err, listPaths = readFrameList(*frameList); err != nil {
+			os.Exit(1)
+		}
 	}
 
-	var mutex sync.Mutex
-	gifInfo := &gif.GIF{}
-	gifInfo.Image = make([]*image.Paletted, len(imgPaths))
-	gifInfo.Delay = make([]int, len(imgPaths))
+	if len(args) == 0 && len(urls) == 0 && len(listPaths) == 0 {
+		usage()
+		os.Exit(1)
+	}
 
-	var wg sync.WaitGroup
-	numcpus := runtime.NumCPU()
-	sem := semaphore.NewWeighted(int64(numcpus))
+	allURLs := true
+	for _, arg := range args {
+		allURLs = allURLs && isURL(arg)
+	}
 
-	logrus.WithFields(logrus.Fields{
-		"// jobs":     numcpus,
-		"num of pics": len(imgPaths),
-	}).Info("Parallel processing jpeg files")
+	// Either URLs, or paths.
+	input := ""
+	var inputs []string
+	if allURLs {
+		urls = append(urls, args...)
+	} else if *urlList != "" {
+		logrus.Error("-urls is not supported with path arguments")
+		os.Exit(1)
+	} else {
+		input, inputs = args[0], args
+	}
 
-	bar := pb.New(len(imgPaths))
-	bar.SetMaxWidth(80)
-	bar.Start()
+	if len(inputs) > 1 && (*scroll || *manifestMode || *perSubdir || *fromVideo) {
+		logrus.Error("multiple paths are not supported with -scroll, -manifest, -per-subdir or -from-video")
+		os.Exit(1)
+	}
 
-	for i, jpeg := range imgPaths {
-		wg.Add(1)
-		go func(jpeg string, i int) {
-			defer wg.Done()
-			_ = sem.Acquire(context.Background(), 1)
-			defer sem.Release(1)
-			logrus.WithField("file", jpeg).Debug("processing")
+	if len(urls) > 0 && (*scroll || *manifestMode || *perSubdir || *fromVideo) {
+		logrus.Error("URL inputs are not supported with -scroll, -manifest, -per-subdir or -from-video")
+		os.Exit(1)
+	}
 
-			err, frame := processJpeg(jpeg)
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"error": err,
-					"file":  jpeg}).Error("while processing jpeg file")
-			}
-			mutex.Lock()
-			gifInfo.Image[i] = frame
-			gifInfo.Delay[i] = int(*delayMs / 10)
-			bar.Increment()
-			mutex.Unlock()
-		}(jpeg, i)
+	if len(listPaths) > 0 && (*scroll || *manifestMode || *perSubdir || *fromVideo) {
+		logrus.Error("-i is not supported with -scroll, -manifest, -per-subdir or -from-video")
+		os.Exit(1)
+	}
+
+	*noLocalPalette = *noLocalPalette || *globalPalette || *fixedPalette != ""
+	if *paletteMaxError > 0 && !*noLocalPalette {
+		logrus.Error("-palette-max-error requires -global-palette or -no-local-palette")
+		os.Exit(1)
+	}
+
+	heicConverter = *heicCommand
+	autoRotate = !*noAutoRotate
+	findOpts.strict = *strict
+	findOpts.maxDepth = int(*maxDepth)
+	findOpts.followSymlinks = *followSymlinks
+	if *noRecursive {
+		if *maxDepth > 1 {
+			logrus.Error("-no-recursive is not supported with -max-depth")
+			os.Exit(1)
+		}
+		findOpts.maxDepth = 1
+	}
+
+	selection := &frameSelection{start: *start, end: *end, every: int(*every), maxFrames: int(*maxFrames)}
+	if err, selection.truncate = parseMaxFramesMode(*maxFramesMode); err != nil {
+		logrus.WithField("error", err).Error("invalid options")
+		os.Exit(1)
 	}
-	wg.Wait()
-	bar.Finish()
 
-	gifFile, err := os.OpenFile(*outfile, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	err, sortOrder := parseSortOrder(*sortSpec)
 	if err != nil {
-		logrus.WithField("error", err).Error("While creating gif file")
-		return
+		logrus.WithField("error", err).Error("invalid options")
+		os.Exit(1)
 	}
 
-	defer gifFile.Close()
-	if err := gif.EncodeAll(gifFile, gifInfo); err != nil {
-		logrus.WithField("error", err).Error("While encoding gif file")
-		return
+	if err, progressEvery = parseProgressInterval(*progressSpec); err != nil {
+		logrus.WithField("error", err).Error("invalid progress interval")
+		os.Exit(1)
+	}
+
+	err, loops := giffer.LoopCount(*loop)
+	if err != nil {
+		logrus.WithField("error", err).Error("invalid loop option")
+		os.Exit(1)
+	}
+
+	paletteOpts := &paletteOptions{
+		global:   *noLocalPalette,
+		maxError: *paletteMaxError,
+		fatal:    *paletteErrorFatal,
+	}
+	paletteOpts.quantize.NumColors = int(*colors)
+	paletteOpts.quantize.Lossy = int(*lossy)
+	paletteOpts.quantize.SamplePixels = int(*quantizeSample)
+	if *colors < 2 || *colors > giffer.MAX_COLORS {
+		logrus.Error("-colors must be from 2 to 256")
+		os.Exit(1)
+	}
+	if *fixedPalette != "" && isFlagSet("colors") {
+		logrus.Error("-colors is not supported with -palette, the palette sets the colors")
+		os.Exit(1)
+	}
+	err, paletteOpts.quantize.Quantizer = parseQuantizer(*quantizer)
+	if err != nil {
+		logrus.WithField("error", err).Error("invalid palette options")
+		os.Exit(1)
+	}
+	err, paletteOpts.quantize.Ditherer = parseDitherer(*dither)
+	if err != nil {
+		logrus.WithField("error", err).Error("invalid palette options")
+		os.Exit(1)
+	}
+	if *fixedPalette != "" && isFlagSet("quantizer") {
+		logrus.Error("-quantizer is not supported with -palette")
+		os.Exit(1)
+	}
+	if *fixedPalette != "" && isFlagSet("quantize-sample") {
+		logrus.Error("-quantize-sample is not supported with -palette")
+		os.Exit(1)
+	}
+	if *fixedPalette != "" {
+		err, paletteOpts.fixed = loadPalette(*fixedPalette)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid palette")
+			os.Exit(1)
+		}
+	}
+
+	transformOpts := &transformOptions{equalize: *equalize, palette: paletteOpts}
+	if *rotate != 0 || *flip != "" {
+		if *manifestMode {
+			logrus.Error("-rotate and -flip are not supported with -manifest")
+			os.Exit(1)
+		}
+		if err, transformOpts.rotation = parseRotation(*rotate); err != nil {
+			logrus.WithField("error", err).Error("invalid rotate option")
+			os.Exit(1)
+		}
+		if err, transformOpts.flip = parseFlip(*flip); err != nil {
+			logrus.WithField("error", err).Error("invalid flip option")
+			os.Exit(1)
+		}
+	}
+	if *rotateAutoSquare {
+		err, transformOpts.orientation = parseOrientation(*targetOrientation)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid orientation")
+			os.Exit(1)
+		}
+	}
+	err, resample := parseFilter(*filter)
+	if err != nil {
+		logrus.WithField("error", err).Error("invalid resize options")
+		os.Exit(1)
+	}
+	if *transparentColor != "" {
+		err, transformOpts.chromaKey = parseChromaKeyOptions(*transparentColor, *fuzz)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid transparent color options")
+			os.Exit(1)
+		}
+	} else if isFlagSet("fuzz") {
+		logrus.Error("-fuzz requires -transparent-color")
+		os.Exit(1)
+	}
+	if *crop != "" || *smartCrop != "" {
+		if *manifestMode {
+			logrus.Error("-crop and -smart-crop are not supported with -manifest")
+			os.Exit(1)
+		}
+		if *crop != "" && *smartCrop != "" {
+			logrus.Error("-crop is not supported with -smart-crop")
+			os.Exit(1)
+		}
+	}
+	var smartCropSize image.Point
+	if *smartCrop != "" {
+		if err, smartCropSize = parseSize(*smartCrop); err != nil {
+			logrus.WithField("error", err).Error("invalid smart crop option")
+			os.Exit(1)
+		}
+	}
+	if *crop != "" {
+		err, r := parseGeometry(*crop)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid crop option")
+			os.Exit(1)
+		}
+		transformOpts.crop = &r
+	}
+	if *width != 0 || *height != 0 || *scale != 0 {
+		if *manifestMode {
+			logrus.Error("-width, -height and -scale are not supported with -manifest")
+			os.Exit(1)
+		}
+		err, transformOpts.resize = parseResizeOptions(*width, *height, *scale, resample)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid resize options")
+			os.Exit(1)
+		}
+	}
+	if *fit != "" {
+		if *manifestMode {
+			logrus.Error("-fit is not supported with -manifest")
+			os.Exit(1)
+		}
+		err, transformOpts.fit = parseFitOptions(*fit, *canvas, *fitColor, resample)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid fit options")
+			os.Exit(1)
+		}
+	}
+	if *stabilize {
+		if *manifestMode {
+			logrus.Error("-stabilize is not supported with -manifest")
+			os.Exit(1)
+		}
+		transformOpts.stabilize = &stabilizeOptions{}
+	}
+	if *deflicker {
+		err, transformOpts.deflicker = parseDeflickerOptions(int(*deflickerWindow))
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid deflicker options")
+			os.Exit(1)
+		}
+	}
+	if isFlagSet("brightness") || isFlagSet("contrast") || isFlagSet("gamma") || isFlagSet("saturation") {
+		err, transformOpts.adjust = parseAdjustOptions(*brightness, *contrast, *gamma, *saturation)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid color adjustments")
+			os.Exit(1)
+		}
+	}
+	if *effectSpec != "" {
+		err, transformOpts.effects = parseEffects(*effectSpec)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid effect")
+			os.Exit(1)
+		}
+	}
+	if *watermark != "" {
+		err, transformOpts.watermark = parseWatermarkOptions(*watermark, *watermarkPos, *watermarkOpacity)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid watermark options")
+			os.Exit(1)
+		}
+	}
+	if *text != "" {
+		err, transformOpts.text = parseTextOptions(*text, *textPos, *textColor, int(*textSize))
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid text options")
+			os.Exit(1)
+		}
+	}
+	if *timestamp {
+		err, transformOpts.timestamp = parseTimestampOptions(*timestampFormat, *timestampPos, *timestampColor)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid timestamp options")
+			os.Exit(1)
+		}
+	}
+	if *subtitles != "" {
+		if *manifestMode {
+			logrus.Error("-subtitles is not supported with -manifest")
+			os.Exit(1)
+		}
+		err, transformOpts.subtitles = parseSubtitleOptions(*subtitles, *subtitlesPos, *subtitlesColor)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "file": *subtitles}).Error("invalid subtitles")
+			os.Exit(1)
+		}
+	}
+	if *counter {
+		err, transformOpts.counter = parseCounterOptions(*counterPos, *counterColor)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid counter options")
+			os.Exit(1)
+		}
+	}
+
+	if *progressOverlay {
+		if *manifestMode {
+			logrus.Error("-progress-overlay is not supported with -manifest")
+			os.Exit(1)
+		}
+		err, transformOpts.progressBar = parseProgressBarOptions(*progressOverlayColor, int(*progressOverlayHeight))
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid progress overlay options")
+			os.Exit(1)
+		}
+	}
+	if *border != "" || *rounded > 0 {
+		if *manifestMode {
+			logrus.Error("-border and -rounded are not supported with -manifest")
+			os.Exit(1)
+		}
+		err, transformOpts.border = parseBorderOptions(*border, int(*rounded))
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid border options")
+			os.Exit(1)
+		}
+	}
+	err, transformOpts.background = parseBackground(*background)
+	if err != nil {
+		logrus.WithField("error", err).Error("invalid background")
+		os.Exit(1)
+	}
+	if transformOpts.background != nil && *manifestMode {
+		logrus.Error("-background is not supported with -manifest")
+		os.Exit(1)
+	}
+
+	err, p := parsePipeline(*pipelineSpec, availableTransforms(transformOpts))
+	if err != nil {
+		logrus.WithField("error", err).Error("invalid pipeline")
+		os.Exit(1)
+	}
+
+	// The guard always runs first, before any stage gets to process the
+	// oversized frame.
+	if *maxFrameDim > 0 {
+		maxFrameDimension = int(*maxFrameDim)
+		p = append(pipeline{limitFrameDimension(maxFrameDimension, resample)}, p...)
+	}
+
+	// The stages run on the frames analyzed by the smart crop, and on the
+	// first frame giving its size to the canvas.
+	smartCropStages, ok := stagesBefore(p, *pipelineSpec, "crop")
+	if *smartCrop != "" && !ok {
+		logrus.Error("-smart-crop requires the crop pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "chromakey"); transformOpts.chromaKey != nil && !ok {
+		logrus.Error("-transparent-color requires the chromakey pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "rotate"); (transformOpts.rotation != 0 || transformOpts.flip != "") && !ok {
+		logrus.Error("-rotate and -flip require the rotate pipeline stage")
+		os.Exit(1)
+	}
+	stabilizeStages, ok := stagesBefore(p, *pipelineSpec, "stabilize")
+	if transformOpts.stabilize != nil && !ok {
+		logrus.Error("-stabilize requires the stabilize pipeline stage")
+		os.Exit(1)
+	}
+	deflickerStages, ok := stagesBefore(p, *pipelineSpec, "deflicker")
+	if transformOpts.deflicker != nil && !ok {
+		logrus.Error("-deflicker requires the deflicker pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "adjust"); transformOpts.adjust != nil && !ok {
+		logrus.Error("-brightness, -contrast, -gamma and -saturation require the adjust pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "watermark"); transformOpts.watermark != nil && !ok {
+		logrus.Error("-watermark requires the watermark pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "progressbar"); transformOpts.progressBar != nil && !ok {
+		logrus.Error("-progress-overlay requires the progressbar pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "border"); transformOpts.border != nil && !ok {
+		logrus.Error("-border and -rounded require the border pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "background"); transformOpts.background != nil && !ok {
+		logrus.Error("-background requires the background pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "subtitles"); transformOpts.subtitles != nil && !ok {
+		logrus.Error("-subtitles requires the subtitles pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "timestamp"); transformOpts.timestamp != nil && !ok {
+		logrus.Error("-timestamp requires the timestamp pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "text"); transformOpts.text != nil && !ok {
+		logrus.Error("-text requires the text pipeline stage")
+		os.Exit(1)
+	}
+	if _, ok := stagesBefore(p, *pipelineSpec, "effect"); transformOpts.effects != nil && !ok {
+		logrus.Error("-effect requires the effect pipeline stage")
+		os.Exit(1)
+	}
+	fitStages, ok := stagesBefore(p, *pipelineSpec, "fit")
+	if transformOpts.fit != nil && !ok {
+		logrus.Error("-fit requires the fit pipeline stage")
+		os.Exit(1)
+	}
+	canvasSize := transformOpts.fit != nil && transformOpts.fit.size == image.Point{}
+
+	// The outputs of -sizes, by width then format.
+	var sized *sizedPipeline
+	var sizedOutfiles [][]string
+	if *sizesSpec != "" {
+		// The options resizing the frames all alike, or computed on the
+		// frames of a single size.
+		for _, name := range []string{"width", "height", "scale", "fit", "stabilize", "deflicker", "manifest", "target-size",
+			"split-size", "split-frames", "spill-dir", "cache-dir", "interval", "per-subdir", "expect-checksum"} {
+			if isFlagSet(name) {
+				logrus.Errorf("-%s is not supported with -sizes", name)
+				os.Exit(1)
+			}
+		}
+		err, widths := parseWidths(*sizesSpec)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid sizes")
+			os.Exit(1)
+		}
+		resizeStages, ok := stagesBefore(p, *pipelineSpec, "resize")
+		if !ok {
+			logrus.Error("-sizes requires the resize pipeline stage")
+			os.Exit(1)
+		}
+		sized = newSizedPipeline(p, len(resizeStages), widths, resample)
+
+		template := *outputTemplate
+		if template == "" {
+			template = filepath.Join(filepath.Dir(*outfile), DEFAULT_SIZES_TEMPLATE)
+		}
+		err, tmpl := parseOutputTemplate(template)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid output template")
+			os.Exit(1)
+		}
+		base := strings.TrimSuffix(filepath.Base(*outfile), filepath.Ext(*outfile))
+		var all []string
+		for k, width := range widths {
+			var paths []string
+			for _, f := range formats {
+				paths = append(paths, tmpl.render(&outputNameVars{base: base, index: k + 1, width: width, ext: f.ext()}))
+			}
+			sizedOutfiles = append(sizedOutfiles, paths)
+			all = append(all, paths...)
+		}
+		if err := checkOutputConflicts(all); err != nil {
+			logrus.WithField("error", err).Error("conflicting output file names")
+			os.Exit(1)
+		}
+		if checkNewOutputs(all, false) != nil {
+			os.Exit(1)
+		}
+	}
+
+	err, interpolateWith := parseInterpolateMode(*interpolateMode)
+	if err != nil {
+		logrus.WithField("error", err).Error("invalid interpolation options")
+		os.Exit(1)
+	}
+
+	if *crossfade > 0 {
+		if *interpolate > 0 {
+			logrus.Error("-crossfade is not supported with -interpolate")
+			os.Exit(1)
+		}
+		if *duration > 0 {
+			logrus.Error("-crossfade is not supported with -duration")
+			os.Exit(1)
+		}
+		if *crossfadeDuration <= 0 {
+			logrus.Error("-crossfade-duration must be positive")
+			os.Exit(1)
+		}
+		if durationToCs(*crossfadeDuration)/int(*crossfade) < MIN_DELAY_CS {
+			logrus.WithField("duration", *crossfadeDuration).Warn("too many -crossfade frames to play within the transition")
+		}
+		// The same blended frames, with their own delays.
+		*interpolate = *crossfade
+	}
+
+	if *scroll && *interpolate > 0 {
+		logrus.Error("-interpolate and -crossfade are not supported with -scroll")
+		os.Exit(1)
+	}
+
+	var kenBurnsOpts *kenBurnsOptions
+	if *kenBurns {
+		if *scroll || *manifestMode || *interpolate > 0 {
+			logrus.Error("-kenburns is not supported with -scroll, -manifest, -interpolate or -crossfade")
+			os.Exit(1)
+		}
+		err, kenBurnsOpts = parseKenBurnsOptions(int(*kenBurnsFrames), *kenBurnsZoom)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid ken burns options")
+			os.Exit(1)
+		}
+	}
+
+	if *manifestMode && (*scroll || *interpolate > 0 || *perSubdir || *duration > 0 || *newest > 0) {
+		logrus.Error("-manifest is not supported with -scroll, -interpolate, -crossfade, -per-subdir, -duration or -n")
+		os.Exit(1)
+	}
+
+	if *manifestMode && (*start != "" || *end != "" || *every > 0 || isFlagSet("sort") || *sortDesc) {
+		logrus.Error("-start, -end, -every, -sort and -sort-desc are not supported with -manifest, list the frames in the manifest")
+		os.Exit(1)
+	}
+
+	if *downloadJobs == 0 {
+		logrus.Error("-download-jobs must be positive")
+		os.Exit(1)
+	}
+
+	if *fromVideo && (*scroll || *manifestMode || *perSubdir) {
+		logrus.Error("-from-video is not supported with -scroll, -manifest or -per-subdir")
+		os.Exit(1)
+	}
+
+	if *fromVideo && *videoFps <= 0 {
+		logrus.Error("-video-fps must be positive")
+		os.Exit(1)
+	}
+
+	if *duration < 0 {
+		logrus.Error("-duration must be positive")
+		os.Exit(1)
+	}
+
+	if *finalDelay < 0 || durationToCs(*finalDelay) > MAX_DELAY_CS {
+		logrus.Error("-final-delay is out of range")
+		os.Exit(1)
+	}
+
+	if *duration > 0 && *finalDelay >= *duration {
+		logrus.Error("-final-delay must be shorter than -duration")
+		os.Exit(1)
+	}
+
+	if *duration > 0 && (isFlagSet("t") || isFlagSet("fps")) {
+		logrus.WithField("duration", *duration).Warn("-t and -fps are ignored with -duration")
+	}
+
+	if *realTime && (*manifestMode || *interpolate > 0 || *kenBurns) {
+		logrus.Error("-real-time is not supported with -manifest, -interpolate, -crossfade or -kenburns")
+		os.Exit(1)
+	}
+
+	if *realTimeScale <= 0 {
+		logrus.Error("-real-time-scale must be positive")
+		os.Exit(1)
+	}
+
+	var overrides delayOverrides
+	if *delaysFile != "" {
+		if *manifestMode {
+			logrus.Error("-delays is not supported with -manifest, set the delays in the manifest")
+			os.Exit(1)
+		}
+		if err, overrides = loadDelayOverrides(*delaysFile); err != nil {
+			os.Exit(1)
+		}
+	}
+
+	if isFlagSet("fps") && isFlagSet("t") {
+		logrus.Error("-fps is not supported with -t")
+		os.Exit(1)
+	}
+
+	if isFlagSet("fps") && *fps <= 0 {
+		logrus.Error("-fps must be positive")
+		os.Exit(1)
+	}
+
+	// Extracted frames play at the speed of the video, unless told otherwise.
+	if *fromVideo && !isFlagSet("t") && !isFlagSet("fps") {
+		*fps = *videoFps
+	}
+
+	if *fps > 0 {
+		if 100 / *fps < MIN_DELAY_CS {
+			logrus.WithField("fps", *fps).Warnf("frame rate above %d fps, most viewers play it slower", 100/MIN_DELAY_CS)
+		}
+		// The rounded delay of the frames not timed by -fps, e.g. blended ones.
+		*delayMs = uint(math.Round(1000 / *fps))
+	}
+
+	if *outputTemplate != "" && !*perSubdir && !split && *sizesSpec == "" {
+		logrus.Error("-output-template is only supported with multiple outputs (-per-subdir, -sizes, -split-size or -split-frames)")
+		os.Exit(1)
+	}
+
+	if *deltaFrames && *manifestMode {
+		logrus.Error("-delta is not supported with -manifest")
+		os.Exit(1)
+	}
+	if _, ok := disposalMethods[strings.ToLower(*disposal)]; !ok {
+		logrus.WithField("disposal", *disposal).Error("unknown disposal, expected none, background or previous")
+		os.Exit(1)
+	}
+	if *disposal != "" && (*manifestMode || *deltaFrames) {
+		logrus.Error("-disposal is not supported with -manifest and -delta, which set the disposal of each frame")
+		os.Exit(1)
+	}
+	if *foldDuplicates && *manifestMode {
+		logrus.Error("-fold-duplicates is not supported with -manifest")
+		os.Exit(1)
+	}
+	if isFlagSet("duplicate-threshold") && !*foldDuplicates {
+		logrus.Error("-duplicate-threshold requires -fold-duplicates")
+		os.Exit(1)
+	}
+	if *duplicateThreshold < 0 {
+		logrus.Error("-duplicate-threshold must be positive")
+		os.Exit(1)
+	}
+
+	if *jobs > 0 {
+		maxJobs = int(*jobs)
+		giffer.Jobs = maxJobs
+	}
+	if *maxMemory != "0" {
+		err, maxFrameMemory = parseByteSize(*maxMemory)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid max memory")
+			os.Exit(1)
+		}
+	}
+
+	if *spillDir != "" {
+		if *manifestMode || *targetSize != "" || *interval > 0 || *perSubdir || format.name != "gif" || len(formats) > 1 {
+			logrus.Error("-spill-dir is only supported with the gif format alone, and not with -manifest, -target-size, -interval or -per-subdir")
+			os.Exit(1)
+		}
+		if info, err := os.Stat(*spillDir); err != nil || !info.IsDir() {
+			logrus.WithField("dir", *spillDir).Error("-spill-dir is not a directory")
+			os.Exit(1)
+		}
+	}
+
+	if *cacheDir != "" {
+		if *paletteMaxError > 0 {
+			logrus.Error("-palette-max-error is not supported with -cache-dir, cached frames are not quantized again")
+			os.Exit(1)
+		}
+		err, cache = newFrameCache(*cacheDir, transformOpts)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "dir": *cacheDir}).Error("cannot create the frame cache")
+			os.Exit(1)
+		}
+	}
+
+	var targetOpts *targetSizeOptions
+	if *targetSize != "" {
+		if *manifestMode {
+			logrus.Error("-target-size is not supported with -manifest")
+			os.Exit(1)
+		}
+		err, size := parseByteSize(*targetSize)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid target size")
+			os.Exit(1)
+		}
+		targetOpts = &targetSizeOptions{size: size, palette: paletteOpts, filter: resample, format: format}
+	}
+
+	var splitOpts *splitOptions
+	if split {
+		if *manifestMode || *targetSize != "" || *spillDir != "" || *interval > 0 || *perSubdir || *expectChecksum != "" {
+			logrus.Error("-split-size and -split-frames are not supported with -manifest, -target-size, -spill-dir, -interval, -per-subdir or -expect-checksum")
+			os.Exit(1)
+		}
+		splitOpts = &splitOptions{frames: int(*splitFrames)}
+		if *splitSize != "" {
+			if err, splitOpts.size = parseByteSize(*splitSize); err != nil {
+				logrus.WithField("error", err).Error("invalid split size")
+				os.Exit(1)
+			}
+		}
+		template := *outputTemplate
+		if template == "" {
+			template = filepath.Join(filepath.Dir(*outfile), DEFAULT_SPLIT_TEMPLATE)
+		}
+		if err, splitOpts.names = parseOutputTemplate(template); err != nil {
+			logrus.WithField("error", err).Error("invalid output template")
+			os.Exit(1)
+		}
+		// Those of the interrupted run are replaced.
+		if splitOpts.checkFirstParts(outfiles, formats, resuming) != nil {
+			os.Exit(1)
+		}
+	}
+
+	if (*reverse || *shuffle || *boomerang) && *manifestMode {
+		logrus.Error("-reverse, -shuffle and -boomerang are not supported with -manifest")
+		os.Exit(1)
+	}
+
+	if *reverse && *shuffle {
+		logrus.Error("-reverse is not supported with -shuffle")
+		os.Exit(1)
+	}
+
+	if *perSubdir && (*scroll || *interval > 0) {
+		logrus.Error("-per-subdir is not supported with -scroll or -interval")
+		os.Exit(1)
+	}
+
+	// Sets the disposal of the frames of the gif, or delta encodes them.
+	finish := func(gifInfo *gif.GIF) {
+		if !*deltaFrames || !giffer.DeltaEncode(gifInfo) {
+			if *deltaFrames {
+				logrus.Warn("frames with transparent pixels cannot be delta encoded, -delta ignored")
+			}
+			giffer.SetDisposal(gifInfo)
+		}
+		if *disposal != "" {
+			for i := range gifInfo.Disposal {
+				gifInfo.Disposal[i] = disposalMethods[strings.ToLower(*disposal)]
+			}
+		}
+	}
+	if targetOpts != nil {
+		targetOpts.finish = finish
+	}
+	if splitOpts != nil {
+		splitOpts.finish = finish
+	}
+
+	// Builds the gif of path, or with -sizes one for each width. With an out
+	// file, the gif is streamed to it as the frames complete, and not
+	// returned.
+	buildSizes := func(path string, out *os.File) (error, []*animation) {
+		var source frameSource
+		var m *manifest
+		numFrames := 0
+		numSources := 0
+		var sourceDelays []int
+		var frameNames []string // of the source frames, if they have files
+		if *manifestMode {
+			var err error
+			if err, m = loadManifest(path); err != nil {
+				return err, nil
+			}
+			numFrames = len(m.Frames)
+			source = fileSource(m.paths())
+		} else if *scroll {
+			err, opts := parseScrollOptions(*scrollDir, *scrollSize, *scrollFrames)
+			if err != nil {
+				logrus.WithField("error", err).Error("invalid scroll options")
+				return err, nil
+			}
+
+			if *fitFrames && *duration > 0 {
+				opts.numFrames = fitToDuration(opts.numFrames, *duration)
+			}
+
+			if err, source = scrollSource(path, opts); err != nil {
+				return err, nil
+			}
+			numFrames = opts.numFrames
+		} else if len(inputs) == 1 && isGifFile(path) {
+			if *interpolate > 0 || kenBurnsOpts != nil {
+				err := fmt.Errorf("-interpolate, -crossfade and -kenburns are not supported with a gif input")
+				logrus.WithField("error", err).Error("invalid options")
+				return err, nil
+			}
+
+			err, images, delays := decodeGif(path)
+			if err != nil {
+				return err, nil
+			}
+
+			if !selection.all() {
+				err, selected := selection.indices(len(images), nil)
+				if err != nil {
+					logrus.WithField("error", err).Error("cannot select the frames")
+					return err, nil
+				}
+
+				var kept []image.Image
+				var keptDelays []int
+				for _, i := range selected {
+					kept = append(kept, images[i])
+					keptDelays = append(keptDelays, delays[i])
+				}
+				images, delays = kept, keptDelays
+			}
+
+			if *fitFrames && *duration > 0 {
+				var kept []image.Image
+				for _, i := range evenlySample(len(images), fitToDuration(len(images), *duration)) {
+					kept = append(kept, images[i])
+				}
+				images = kept
+			}
+
+			numFrames = len(images)
+			source = imagesSource(images)
+			sourceDelays = delays
+		} else if len(inputs) == 1 && isArchive(path) {
+			if *interpolate > 0 || kenBurnsOpts != nil {
+				err := fmt.Errorf("-interpolate, -crossfade and -kenburns are not supported with an archive input")
+				logrus.WithField("error", err).Error("invalid options")
+				return err, nil
+			}
+
+			err, entries, cleanup := readArchive(path)
+			if err != nil {
+				return err, nil
+			}
+			defer cleanup()
+			sortEntries(entries, sortOrder, *sortDesc)
+
+			if *newest > 0 {
+				entries = newestEntries(entries, int(*newest))
+			}
+
+			if !selection.all() {
+				names := make([]string, len(entries))
+				for i, entry := range entries {
+					names[i] = entry.name
+				}
+				err, selected := selection.indices(len(entries), names)
+				if err != nil {
+					logrus.WithField("error", err).Error("cannot select the frames")
+					return err, nil
+				}
+
+				var kept []archiveEntry
+				for _, i := range selected {
+					kept = append(kept, entries[i])
+				}
+				entries = kept
+			}
+
+			if *fitFrames && *duration > 0 {
+				var kept []archiveEntry
+				for _, i := range evenlySample(len(entries), fitToDuration(len(entries), *duration)) {
+					kept = append(kept, entries[i])
+				}
+				entries = kept
+			}
+
+			numFrames = len(entries)
+			source = archiveSource(path, entries)
+			for _, entry := range entries {
+				frameNames = append(frameNames, entry.name)
+			}
+
+			if *realTime {
+				times := make([]time.Time, len(entries))
+				found := make([]bool, len(entries))
+				fallback := make([]int, len(entries))
+				for i, entry := range entries {
+					times[i], found[i] = entryCaptureTime(entry)
+					fallback[i] = int(*delayMs / 10)
+				}
+				sourceDelays = realTimeDelays(times, found, *realTimeScale, fallback)
+			}
+		} else {
+			var imgPaths []string
+			if len(listPaths) > 0 {
+				imgPaths = listPaths
+			} else if len(urls) > 0 {
+				err, files, cleanup := downloadFiles(urls, nil, int(*downloadJobs), int(*downloadRetries))
+				if err != nil {
+					return err, nil
+				}
+				defer cleanup()
+				imgPaths = files
+			} else if isObjectStoreURL(path) {
+				err, objects, sign := listObjects(path)
+				if err != nil {
+					return err, nil
+				}
+				err, files, cleanup := downloadFiles(objects, sign, int(*downloadJobs), int(*downloadRetries))
+				if err != nil {
+					return err, nil
+				}
+				defer cleanup()
+				imgPaths = files
+			} else if *fromVideo {
+				err, frames, cleanup := extractVideoFrames(path, *videoFps)
+				if err != nil {
+					return err, nil
+				}
+				defer cleanup()
+				imgPaths = frames
+			} else {
+				// The frames of all the path arguments are combined, in
+				// order. Per subdirectory builds get one subdirectory.
+				paths := inputs
+				if *perSubdir {
+					paths = []string{path}
+				}
+
+				for _, input := range paths {
+					err, found, cleanup := findInputImages(input, findOpts, int(*pdfDpi))
+					if err != nil {
+						return err, nil
+					}
+					if cleanup != nil {
+						defer cleanup()
+					}
+					sortPaths(found, sortOrder, *sortDesc)
+					imgPaths = append(imgPaths, found...)
+				}
+
+				// The output of a previous run is not a frame.
+				imgPaths = excludeFile(imgPaths, *outfile)
+			}
+
+			if *newest > 0 {
+				if err, imgPaths = newestFiles(imgPaths, int(*newest)); err != nil {
+					return err, nil
+				}
+			}
+
+			if !selection.all() {
+				err, selected := selection.indices(len(imgPaths), imgPaths)
+				if err != nil {
+					logrus.WithField("error", err).Error("cannot select the frames")
+					return err, nil
+				}
+
+				var kept []string
+				for _, i := range selected {
+					kept = append(kept, imgPaths[i])
+				}
+				imgPaths = kept
+			}
+
+			if *fitFrames && *duration > 0 {
+				var kept []string
+				for _, i := range evenlySample(len(imgPaths), fitToDuration(len(imgPaths), *duration)) {
+					kept = append(kept, imgPaths[i])
+				}
+				imgPaths = kept
+			}
+
+			if *interpolate > 0 || kenBurnsOpts != nil {
+				for _, path := range imgPaths {
+					if isGifFile(path) {
+						err := fmt.Errorf("-interpolate, -crossfade and -kenburns are not supported with gif files")
+						logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("invalid options")
+						return err, nil
+					}
+				}
+			}
+
+			if kenBurnsOpts != nil {
+				numFrames = len(imgPaths) * kenBurnsOpts.frames
+				source = kenBurnsSource(imgPaths, kenBurnsOpts)
+				for i := 0; i < numFrames; i++ {
+					frameNames = append(frameNames, imgPaths[i/kenBurnsOpts.frames])
+				}
+			} else if *interpolate > 0 {
+				numSources = len(imgPaths)
+				numFrames = interpolatedCount(numSources, int(*interpolate))
+				source = interpolatedSource(imgPaths, int(*interpolate), interpolateWith)
+			} else {
+				err, frames := expandGifs(imgPaths)
+				if err != nil {
+					return err, nil
+				}
+				numFrames = len(frames)
+				source = dirFramesSource(frames)
+				sourceDelays = dirFramesDelays(frames, int(*delayMs/10))
+				for _, frame := range frames {
+					frameNames = append(frameNames, frame.path)
+				}
+
+				if *realTime {
+					// The frames of gifs keep their own delays.
+					times := make([]time.Time, len(frames))
+					found := make([]bool, len(frames))
+					fallback := make([]int, len(frames))
+					for i, frame := range frames {
+						fallback[i] = frame.delay
+						if frame.image == nil {
+							times[i], found[i] = fileCaptureTime(frame.path)
+							fallback[i] = int(*delayMs / 10)
+						}
+					}
+					sourceDelays = realTimeDelays(times, found, *realTimeScale, fallback)
+				}
+			}
+		}
+
+		var perm []int
+		if *reverse {
+			perm = reversedOrder(numFrames)
+		} else if *shuffle {
+			seed := *shuffleSeed
+			if !isFlagSet("shuffle-seed") {
+				seed = time.Now().UnixNano()
+			}
+			logrus.WithField("seed", seed).Info("shuffling frames, use -shuffle-seed to repeat the order")
+			perm = rand.New(rand.NewSource(seed)).Perm(numFrames)
+		}
+		if *boomerang {
+			if perm == nil {
+				perm = make([]int, numFrames)
+				for i := range perm {
+					perm[i] = i
+				}
+			}
+			perm = boomerangOrder(perm)
+		}
+		if perm != nil {
+			source = permutedSource(source, perm)
+			numFrames = len(perm)
+		}
+
+		if *smartCrop != "" {
+			err, r := computeSmartCrop(numFrames, source, smartCropStages, smartCropSize)
+			if err != nil {
+				logrus.WithField("error", err).Error("cannot place the smart crop")
+				return err, nil
+			}
+			transformOpts.crop = &r
+		}
+
+		if canvasSize && numFrames > 0 {
+			err, img := source(0)
+			if err != nil {
+				return err, nil
+			}
+			for _, t := range fitStages {
+				img = t(img, &frameInfo{index: 0, total: numFrames})
+			}
+			transformOpts.fit.size = img.Bounds().Size()
+			logrus.WithField("size", transformOpts.fit.size).Debug("canvas of the first frame")
+		}
+
+		// The delays are known before the frames are processed, for the
+		// subtitles timing.
+		var delays []int
+		if *duration > 0 && *finalDelay > 0 && numFrames > 1 {
+			// The last frame takes its part of the duration.
+			delays = spreadDelay(numFrames-1, durationToCs(*duration-*finalDelay))
+			delays = append(delays, durationToCs(*finalDelay))
+			if delays[0] < MIN_DELAY_CS {
+				logrus.WithField("duration", *duration).Warn("too many frames to play within duration")
+			}
+		} else if *duration > 0 {
+			delays = spreadDelay(numFrames, durationToCs(*duration))
+			if numFrames > 0 && delays[0] < MIN_DELAY_CS {
+				logrus.WithField("duration", *duration).Warn("too many frames to play within duration, " +
+					"use -fit-frames-to-duration to drop the excess frames")
+			}
+		} else if numSources > 0 || sourceDelays != nil {
+			delays = sourceDelays
+			if numSources > 0 {
+				if *crossfade > 0 {
+					delays = crossfadeDelays(numSources, int(*crossfade), int(*delayMs/10), durationToCs(*crossfadeDuration))
+				} else {
+					delays = interpolatedDelays(numSources, int(*interpolate), int(*delayMs/10))
+				}
+			}
+			if perm != nil {
+				// Each frame keeps its own delay.
+				delays = permuteDelays(delays, perm)
+			}
+		} else if *fps > 0 {
+			delays = fpsDelays(numFrames, *fps)
+		} else {
+			delays = make([]int, numFrames)
+			for i := range delays {
+				delays[i] = int(*delayMs / 10)
+			}
+		}
+
+		if *finalDelay > 0 && numFrames > 0 {
+			delays[numFrames-1] = durationToCs(*finalDelay)
+		}
+
+		if overrides != nil {
+			overrides.apply(delays, perm, frameNames)
+		}
+
+		if transformOpts.subtitles != nil {
+			transformOpts.subtitles.place(delays)
+		}
+		if transformOpts.progressBar != nil {
+			transformOpts.progressBar.place(delays)
+		}
+
+		// The files of the frames, in playback order, for the overlays.
+		var playbackNames []string
+		if frameNames != nil {
+			playbackNames = make([]string, numFrames)
+			for i := range playbackNames {
+				src := i
+				if perm != nil {
+					src = perm[i]
+				}
+				playbackNames[i] = frameNames[src]
+			}
+		}
+		if transformOpts.text != nil {
+			transformOpts.text.names = playbackNames
+		}
+		if transformOpts.timestamp != nil {
+			transformOpts.timestamp.load(playbackNames)
+		}
+
+		if numFrames > 0 {
+			limitFrameJobs(source)
+		}
+		if cache != nil {
+			cache.reset()
+			defer cache.report()
+		}
+		if resumeState != nil {
+			resumeState.track(numFrames, cache.frames)
+			defer resumeState.finish()
+		}
+
+		if transformOpts.stabilize != nil {
+			transformOpts.stabilize.compute(numFrames, source, stabilizeStages)
+		}
+		if transformOpts.deflicker != nil {
+			transformOpts.deflicker.compute(numFrames, source, deflickerStages)
+		}
+
+		if paletteOpts.global {
+			paletteOpts.reset()
+			if paletteOpts.fixed != nil {
+				paletteOpts.palette = paletteOpts.fixed
+			} else {
+				paletteOpts.palette = computeGlobalPalette(numFrames, source, p[:len(p)-1], paletteOpts)
+			}
+		}
+
+		if poster != nil {
+			// With -sizes, the poster is of the first width.
+			stages := p[:len(p)-1]
+			if sized != nil {
+				first := sized.sizes[0]
+				stages = append(append(pipeline(nil), sized.shared...), first[:len(first)-1]...)
+			}
+			if err := poster.write(numFrames, source, stages); err != nil {
+				logrus.WithFields(logrus.Fields{"error": err, "file": poster.path}).Error("cannot write the poster")
+				return err, nil
+			}
+		}
+
+		if out != nil {
+			enc := giffer.NewStreamEncoder(out)
+			enc.LoopCount = loops
+			enc.Palette = paletteOpts.palette
+			enc.Disposal = disposalMethods[strings.ToLower(*disposal)]
+			enc.Interlace = interlaceGif
+			w := &frameWriter{enc: enc}
+			if *foldDuplicates {
+				w.same = func(a, b *image.Paletted) bool {
+					return giffer.SameFrame(a, b, *duplicateThreshold)
+				}
+			}
+			var err error
+			if *spillDir != "" {
+				err = spillGif(w, *spillDir, numFrames, source, p, delays, *deltaFrames)
+			} else {
+				err = streamGif(w, numFrames, source, p, delays)
+			}
+			if err != nil {
+				logrus.WithField("error", err).Error("cannot build the gif")
+				return err, nil
+			}
+			if paletteOpts.fatal && paletteOpts.exceeded > 0 {
+				err := fmt.Errorf("%d frames exceed the maximum palette error", paletteOpts.exceeded)
+				logrus.WithField("error", err).Error("global palette is inadequate")
+				return err, nil
+			}
+			return nil, nil
+		}
+
+		// Assembles the animation of the processed frames, in full color, or
+		// quantized for the gif formats, or both with several formats.
+		assemble := func(fullColorFrames []image.Image, frames []*image.Paletted) (error, *animation) {
+			if fullColorFrames != nil {
+				var screen image.Rectangle
+				failed := 0
+				for _, frame := range fullColorFrames {
+					if frame == nil {
+						failed++
+						continue
+					}
+					screen = screen.Union(frame.Bounds())
+				}
+				if failed > 0 {
+					err := fmt.Errorf("%d of %d frames could not be read", failed, numFrames)
+					logrus.WithField("error", err).Error("cannot build the animation")
+					return err, nil
+				}
+
+				if paletted == nil {
+					gifInfo := &gif.GIF{Delay: delays, LoopCount: loops}
+					gifInfo.Config.Width, gifInfo.Config.Height = screen.Max.X, screen.Max.Y
+					return nil, &animation{GIF: gifInfo, fullColor: fullColorFrames}
+				}
+			}
+
+			if fullColorFrames != nil {
+				frames = quantizeFullColorFrames(fullColorFrames, p[len(p)-1])
+			}
+
+			failed := 0
+			for _, frame := range frames {
+				if frame == nil {
+					failed++
+				}
+			}
+			if failed > 0 {
+				err := fmt.Errorf("%d of %d frames could not be read", failed, numFrames)
+				logrus.WithField("error", err).Error("cannot build the gif")
+				return err, nil
+			}
+
+			if paletteOpts.fatal && paletteOpts.exceeded > 0 {
+				err := fmt.Errorf("%d frames exceed the maximum palette error", paletteOpts.exceeded)
+				logrus.WithField("error", err).Error("global palette is inadequate")
+				return err, nil
+			}
+
+			gifInfo := &gif.GIF{}
+			gifInfo.Image = frames
+			gifInfo.LoopCount = loops
+			if paletteOpts.global {
+				// Frames matching the global color table get no local one.
+				gifInfo.Config = globalPaletteConfig(frames, paletteOpts.palette)
+			} else {
+				// Frames of different sizes, e.g. rotated ones, all fit the
+				// screen.
+				screen := giffer.ScreenRect(frames)
+				gifInfo.Config.Width, gifInfo.Config.Height = screen.Max.X, screen.Max.Y
+			}
+			gifInfo.Delay = delays
+			if *foldDuplicates {
+				if dropped := giffer.FoldDuplicates(gifInfo, *duplicateThreshold); dropped > 0 {
+					logrus.WithFields(logrus.Fields{
+						"dropped": dropped,
+						"frames":  len(gifInfo.Image),
+					}).Info("folded duplicate frames")
+				}
+			}
+
+			switch {
+			case m != nil:
+				if err := m.layout(gifInfo); err != nil {
+					logrus.WithField("error", err).Error("invalid manifest layout")
+					return err, nil
+				}
+			case targetOpts != nil:
+				var err error
+				if err, gifInfo = fitTargetSize(gifInfo, targetOpts); err != nil {
+					logrus.WithField("error", err).Error("cannot fit the target size")
+					return err, nil
+				}
+			case splitOpts != nil:
+				// Each part is finished once split.
+			default:
+				finish(gifInfo)
+			}
+
+			return nil, &animation{GIF: gifInfo, fullColor: fullColorFrames}
+		}
+
+		if sized != nil {
+			fullColorSizes, frameSizes := processSizedFrames(numFrames, source, sized, fullColor != nil)
+			anims := make([]*animation, len(sized.sizes))
+			for k := range anims {
+				var err error
+				if err, anims[k] = assemble(fullColorSizes[k], frameSizes[k]); err != nil {
+					return err, nil
+				}
+			}
+			return nil, anims
+		}
+
+		var fullColorFrames []image.Image
+		var frames []*image.Paletted
+		if fullColor != nil {
+			fullColorFrames = processFullColorFrames(numFrames, source, p[:len(p)-1])
+		} else {
+			frames = processFrames(numFrames, source, p)
+		}
+		err, anim := assemble(fullColorFrames, frames)
+		if err != nil {
+			return err, nil
+		}
+		return nil, []*animation{anim}
+	}
+
+	build := func(path string, out *os.File) (error, *animation) {
+		err, anims := buildSizes(path, out)
+		if err != nil || anims == nil {
+			return err, nil
+		}
+		return nil, anims[0]
+	}
+
+	if *interval > 0 {
+		runDaemon(*outfile, *interval, format, func() (error, *animation) {
+			return build(input, nil)
+		})
+		return
+	}
+
+	if *perSubdir {
+		template := *outputTemplate
+		if template == "" {
+			template = filepath.Join(filepath.Dir(*outfile), "{subdir}.{ext}")
+		}
+
+		err, tmpl := parseOutputTemplate(template)
+		if err != nil {
+			logrus.WithField("error", err).Error("invalid output template")
+			os.Exit(1)
+		}
+
+		base := strings.TrimSuffix(filepath.Base(*outfile), filepath.Ext(*outfile))
+		buildAnimation := func(path string) (error, *animation) {
+			return build(path, nil)
+		}
+		if !buildPerSubdir(input, tmpl, base, format, buildAnimation, *checksum) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cache != nil {
+		if err, resumeState = newRunState(statePath); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "file": statePath}).Error("cannot write the state file")
+			os.Exit(1)
+		}
+	}
+
+	// Gifs are written as their frames complete, unless the whole gif is
+	// needed first, and not spilled to disk.
+	var written, sums []string
+	if len(formats) == 1 && format.name == "gif" && !*manifestMode && (!*deltaFrames || *spillDir != "") && targetOpts == nil && splitOpts == nil && sized == nil {
+		var sum string
+		err, sum = writeStreamedOutput(*outfile, func(out *os.File) error {
+			err, _ := build(input, out)
+			return err
+		})
+		written, sums = []string{*outfile}, []string{sum}
+	} else {
+		var anims []*animation
+		err, anims = buildSizes(input, nil)
+		for k := 0; err == nil && k < len(anims); k++ {
+			anim := anims[k]
+			for i, f := range formats {
+				parts, paths := []*animation{anim}, outfiles[i:i+1]
+				if sized != nil {
+					paths = sizedOutfiles[k][i : i+1]
+				}
+				if splitOpts != nil {
+					if err, parts = splitAnimation(anim, splitOpts, f); err != nil {
+						logrus.WithFields(logrus.Fields{"error": err, "format": f.name}).Error("cannot split the output")
+						break
+					}
+					if err, paths = splitOpts.partPaths(outfiles[i], f, len(parts), resuming); err != nil {
+						break
+					}
+				}
+				for j, part := range parts {
+					var sum string
+					if err, sum = writeOutput(paths[j], part, f); err != nil {
+						break
+					}
+					written, sums = append(written, paths[j]), append(sums, sum)
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	if resumeState != nil {
+		resumeState.remove()
+	}
+
+	if *checksum {
+		for i, sum := range sums {
+			fmt.Printf("%s  %s\n", sum, written[i])
+		}
+	}
+
+	if sum := sums[0]; *expectChecksum != "" && !strings.EqualFold(*expectChecksum, sum) {
+		logrus.WithFields(logrus.Fields{
+			"expected": *expectChecksum,
+			"actual":   sum,
+		}).Error("output checksum mismatch")
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A frame of a manifest: its file and where it is drawn on the gif logical
+// screen.
+type manifestFrame struct {
+	File     string `json:"file"`     // relative to the manifest directory
+	X        int    `json:"x"`        // left offset on the screen
+	Y        int    `json:"y"`        // top offset on the screen
+	DelayMs  *int   `json:"delay"`    // default: -t
+	Disposal string `json:"disposal"` // none, background or previous
+}
+
+// A manifest describes the exact layout of a gif, like:
+//
+//	{
+//	  "width": 320, "height": 240,
+//	  "frames": [
+//	    {"file": "full.jpg"},
+//	    {"file": "patch.jpg", "x": 40, "y": 32, "delay": 500, "disposal": "previous"}
+//	  ]
+//	}
+//
+// The logical screen size, both width and height, defaults to the area covered
+// by all the frames.
+type manifest struct {
+	Width  int             `json:"width"`
+	Height int             `json:"height"`
+	Frames []manifestFrame `json:"frames"`
+
+	dir string
+}
+
+var disposalMethods = map[string]byte{
+	"":           0,
+	"none":       gif.DisposalNone,
+	"background": gif.DisposalBackground,
+	"previous":   gif.DisposalPrevious,
+}
+
+func loadManifest(path string) (error, *manifest) {
+	f, err := os.Open(path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("While opening manifest")
+		return err, nil
+	}
+	defer f.Close()
+
+	m := &manifest{dir: filepath.Dir(path)}
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while decoding manifest")
+		return err, nil
+	}
+
+	if m.Width < 0 || m.Height < 0 || (m.Width == 0) != (m.Height == 0) {
+		err := fmt.Errorf("invalid %dx%d screen, set both the width and height, or neither", m.Width, m.Height)
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("invalid manifest")
+		return err, nil
+	}
+
+	if len(m.Frames) == 0 {
+		err := fmt.Errorf("no frames in manifest")
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("invalid manifest")
+		return err, nil
+	}
+
+	for i, frame := range m.Frames {
+		err := func() error {
+			if frame.File == "" {
+				return fmt.Errorf("frame %d has no file", i+1)
+			}
+			if frame.X < 0 || frame.Y < 0 {
+				return fmt.Errorf("frame %d has a negative offset", i+1)
+			}
+			if frame.DelayMs != nil && *frame.DelayMs < 0 {
+				return fmt.Errorf("frame %d has a negative delay", i+1)
+			}
+			if _, ok := disposalMethods[strings.ToLower(frame.Disposal)]; !ok {
+				return fmt.Errorf("frame %d has an unknown disposal %q", i+1, frame.Disposal)
+			}
+			return nil
+		}()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("invalid manifest")
+			return err, nil
+		}
+	}
+
+	if disposalMethods[strings.ToLower(m.Frames[0].Disposal)] == gif.DisposalPrevious {
+		err := fmt.Errorf("first frame cannot be disposed to the previous frame")
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("invalid manifest")
+		return err, nil
+	}
+
+	return nil, m
+}
+
+// Returns the paths of the manifest frames files.
+func (m *manifest) paths() []string {
+	paths := make([]string, len(m.Frames))
+	for i, frame := range m.Frames {
+		paths[i] = frame.File
+		if !filepath.IsAbs(paths[i]) {
+			paths[i] = filepath.Join(m.dir, frame.File)
+		}
+	}
+	return paths
+}
+
+// Positions the processed frames on the logical screen, and sets their delays
+// and disposal methods. Fails if a frame does not fit the screen.
+func (m *manifest) layout(gifInfo *gif.GIF) error {
+	screen := image.Rect(0, 0, m.Width, m.Height)
+	gifInfo.Disposal = make([]byte, len(gifInfo.Image))
+
+	for i, frame := range gifInfo.Image {
+		if frame == nil {
+			continue
+		}
+
+		mf := m.Frames[i]
+		frame.Rect = frame.Rect.Sub(frame.Rect.Min).Add(image.Pt(mf.X, mf.Y))
+		if m.Width == 0 && m.Height == 0 {
+			continue
+		}
+
+		if !frame.Rect.In(screen) {
+			return fmt.Errorf("frame %d (%s at %v) does not fit the %dx%d screen",
+				i+1, mf.File, frame.Rect, m.Width, m.Height)
+		}
+	}
+
+	if m.Width == 0 && m.Height == 0 {
+		for _, frame := range gifInfo.Image {
+			if frame != nil {
+				screen = screen.Union(frame.Rect)
+			}
+		}
+	}
+
+	if first := gifInfo.Image[0]; first != nil && first.Rect != screen {
+		logrus.WithField("frame", m.Frames[0].File).Warn("first frame does not cover the whole screen, " +
+			"viewers show their own background around it")
+	}
+
+	for i, mf := range m.Frames {
+		if mf.DelayMs != nil {
+			gifInfo.Delay[i] = *mf.DelayMs / 10
+		}
+		gifInfo.Disposal[i] = disposalMethods[strings.ToLower(mf.Disposal)]
+	}
+
+	gifInfo.Config.Width, gifInfo.Config.Height = screen.Max.X, screen.Max.Y
+	return nil
+}
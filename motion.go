@@ -0,0 +1,120 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// Larger side of the frames compared to estimate the motion of their
+	// content, downscaled for speed.
+	MOTION_ANALYSIS_SIDE = 128
+	// Side of the blocks of the analyzed frames moving as one.
+	MOTION_BLOCK_SIDE = 8
+	// Largest motion of a block, in analyzed pixels.
+	MOTION_MAX_SHIFT = 8
+)
+
+// The motion of the content of a frame to the next one, by block.
+type motionField struct {
+	cols, rows int
+	vectors    []image.Point // in analyzed pixels, by block row
+	scaleX     float64       // frame pixels per analyzed pixel
+	scaleY     float64
+}
+
+// Estimates the motion from a to b, of the same size, by matching each block
+// of a in b: the best match minimizes the sum of absolute luma differences,
+// ties going to the smallest motion so that flat areas stay still.
+func estimateMotion(a, b image.Image) *motionField {
+	size := a.Bounds().Size()
+	mapSize := analysisSize(size, MOTION_ANALYSIS_SIDE)
+	la, lb := lumaMap(a, mapSize), lumaMap(b, mapSize)
+
+	field := &motionField{
+		cols:   (mapSize.X + MOTION_BLOCK_SIDE - 1) / MOTION_BLOCK_SIDE,
+		rows:   (mapSize.Y + MOTION_BLOCK_SIDE - 1) / MOTION_BLOCK_SIDE,
+		scaleX: float64(size.X) / float64(mapSize.X),
+		scaleY: float64(size.Y) / float64(mapSize.Y),
+	}
+	field.vectors = make([]image.Point, field.cols*field.rows)
+
+	for by := 0; by < field.rows; by++ {
+		for bx := 0; bx < field.cols; bx++ {
+			block := image.Rect(bx*MOTION_BLOCK_SIDE, by*MOTION_BLOCK_SIDE, (bx+1)*MOTION_BLOCK_SIDE, (by+1)*MOTION_BLOCK_SIDE).
+				Intersect(image.Rectangle{Max: mapSize})
+
+			best, bestSum := image.Point{}, math.Inf(1)
+			for sy := -MOTION_MAX_SHIFT; sy <= MOTION_MAX_SHIFT; sy++ {
+				for sx := -MOTION_MAX_SHIFT; sx <= MOTION_MAX_SHIFT; sx++ {
+					moved := block.Add(image.Pt(sx, sy))
+					if !moved.In(image.Rectangle{Max: mapSize}) {
+						continue
+					}
+
+					sum := 0.0
+					for y := block.Min.Y; y < block.Max.Y; y++ {
+						for x := block.Min.X; x < block.Max.X; x++ {
+							sum += math.Abs(lb[(y+sy)*mapSize.X+x+sx] - la[y*mapSize.X+x])
+						}
+					}
+					if sum < bestSum || (sum == bestSum && sx*sx+sy*sy < best.X*best.X+best.Y*best.Y) {
+						best, bestSum = image.Pt(sx, sy), sum
+					}
+				}
+			}
+			field.vectors[by*field.cols+bx] = best
+		}
+	}
+	return field
+}
+
+// Returns the motion at the frame pixel x, y, in frame pixels, bilinearly
+// interpolated between the block centers.
+func (f *motionField) at(x, y int) (float64, float64) {
+	// Position in blocks, relative to the first block center.
+	fx := (float64(x)+0.5)/f.scaleX/MOTION_BLOCK_SIDE - 0.5
+	fy := (float64(y)+0.5)/f.scaleY/MOTION_BLOCK_SIDE - 0.5
+	x0, y0 := int(math.Floor(fx)), int(math.Floor(fy))
+	tx, ty := fx-float64(x0), fy-float64(y0)
+
+	var vx, vy float64
+	for _, c := range []struct {
+		dx, dy int
+		w      float64
+	}{{0, 0, (1 - tx) * (1 - ty)}, {1, 0, tx * (1 - ty)}, {0, 1, (1 - tx) * ty}, {1, 1, tx * ty}} {
+		v := f.vectors[clampIndex(y0+c.dy, f.rows)*f.cols+clampIndex(x0+c.dx, f.cols)]
+		vx += c.w * float64(v.X)
+		vy += c.w * float64(v.Y)
+	}
+	return vx * f.scaleX, vy * f.scaleY
+}
+
+// Synthesizes the frame at t between a and b, t = 0 returning a and t = 1
+// returning b: both are moved along the estimated motion to their position
+// at t, then blended. Frames of different sizes are only blended.
+func motionBlendImages(a, b image.Image, t float64) *image.RGBA {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return blendImages(a, b, t)
+	}
+
+	src, dst := toRGBA(a), toRGBA(b)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	out := image.NewRGBA(src.Rect)
+	field := estimateMotion(src, dst)
+	wb := uint32(t * 256)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			vx, vy := field.at(x, y)
+			i := src.PixOffset(clampIndex(int(math.Round(float64(x)-t*vx)), w), clampIndex(int(math.Round(float64(y)-t*vy)), h))
+			j := dst.PixOffset(clampIndex(int(math.Round(float64(x)+(1-t)*vx)), w), clampIndex(int(math.Round(float64(y)+(1-t)*vy)), h))
+			k := out.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				out.Pix[k+c] = uint8((uint32(src.Pix[i+c])*(256-wb) + uint32(dst.Pix[j+c])*wb) >> 8)
+			}
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Objects are listed and downloaded through the S3 REST and GCS JSON APIs,
+// with the credentials of the usual environment variables:
+//
+//   - S3: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and
+//     AWS_REGION, AWS_ENDPOINT_URL for S3 compatible services;
+//   - GCS: GOOGLE_OAUTH_ACCESS_TOKEN (e.g. from gcloud auth
+//     print-access-token), STORAGE_EMULATOR_HOST for the emulator.
+//
+// Requests are anonymous without credentials, for public buckets.
+const (
+	DEFAULT_AWS_REGION = "us-east-1"
+	GCS_ENDPOINT       = "https://storage.googleapis.com"
+)
+
+func isObjectStoreURL(s string) bool {
+	return strings.HasPrefix(s, "s3://") || strings.HasPrefix(s, "gs://")
+}
+
+// Splits s3://bucket/prefix or gs://bucket/prefix.
+func parseObjectStoreURL(s string) (error, string, string, string) {
+	i := strings.Index(s, "://")
+	scheme, rest := s[:i], s[i+3:]
+	bucket, prefix := rest, ""
+	if j := strings.IndexByte(rest, '/'); j >= 0 {
+		bucket, prefix = rest[:j], rest[j+1:]
+	}
+	if bucket == "" {
+		return fmt.Errorf("no bucket in %q", s), "", "", ""
+	}
+	return nil, scheme, bucket, prefix
+}
+
+// Lists the image objects under the s3:// or gs:// URL, sorted by name.
+// Returns their download URLs, and the signer of the download requests.
+func listObjects(rawurl string) (error, []string, requestSigner) {
+	err, scheme, bucket, prefix := parseObjectStoreURL(rawurl)
+	if err != nil {
+		logrus.WithField("error", err).Error("invalid object store URL")
+		return err, nil, nil
+	}
+
+	var urls []string
+	var sign requestSigner
+	if scheme == "s3" {
+		s3 := newS3Client()
+		sign = s3.sign
+		err, urls = s3.list(bucket, prefix)
+	} else {
+		sign = signGCS
+		err, urls = listGCS(bucket, prefix)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "url": rawurl}).Error("while listing objects")
+		return err, nil, nil
+	}
+
+	if len(urls) == 0 {
+		logrus.WithField("url", rawurl).Errorf("could not find any image objects")
+		return errNoImages, nil, nil
+	}
+
+	logrus.WithFields(logrus.Fields{"url": rawurl, "objects": len(urls)}).Info("Listed objects")
+	return nil, urls, sign
+}
+
+// Escapes s as AWS signature version 4 expects: everything but the unreserved
+// characters, and the slashes of paths.
+func awsEscape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+type s3Client struct {
+	endpoint  string // path style if set
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+}
+
+func newS3Client() *s3Client {
+	c := &s3Client{
+		endpoint:  strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/"),
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if c.region == "" {
+		c.region = DEFAULT_AWS_REGION
+	}
+	return c
+}
+
+// Returns the URL of the key, with the query parameters sorted as the
+// signature requires.
+func (c *s3Client) url(bucket, key string, query map[string]string) string {
+	u := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, c.region, awsEscape(key, true))
+	if c.endpoint != "" {
+		u = fmt.Sprintf("%s/%s/%s", c.endpoint, bucket, awsEscape(key, true))
+	}
+
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		sep := "&"
+		if i == 0 {
+			sep = "?"
+		}
+		u += sep + awsEscape(name, false) + "=" + awsEscape(query[name], false)
+	}
+	return u
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Signs the request with AWS signature version 4. The URL must have been
+// built by url.
+func (c *s3Client) sign(req *http.Request) error {
+	if c.accessKey == "" {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := hex.EncodeToString(sha256.New().Sum(nil))
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+// Sends a signed GET request, and returns the response body.
+func getObjectStore(rawurl string, sign requestSigner) (error, []byte) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return err, nil
+	}
+	if err := sign(req); err != nil {
+		return err, nil
+	}
+
+	client := &http.Client{Timeout: DOWNLOAD_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err, nil
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body))), nil
+	}
+	return nil, body
+}
+
+// Lists the image objects with ListObjectsV2, following the continuation
+// tokens of truncated listings.
+func (c *s3Client) list(bucket, prefix string) (error, []string) {
+	var urls []string
+	token := ""
+
+	for {
+		query := map[string]string{"list-type": "2", "prefix": prefix}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+
+		err, body := getObjectStore(c.url(bucket, "", query), c.sign)
+		if err != nil {
+			return err, nil
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return err, nil
+		}
+
+		for _, object := range result.Contents {
+			if isImageFile(object.Key) {
+				urls = append(urls, c.url(bucket, object.Key, nil))
+			}
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	return nil, urls
+}
+
+func gcsEndpoint() string {
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return strings.TrimSuffix(host, "/")
+	}
+	return GCS_ENDPOINT
+}
+
+func signGCS(req *http.Request) error {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// Lists the image objects with the JSON API, following the page tokens.
+func listGCS(bucket, prefix string) (error, []string) {
+	endpoint := gcsEndpoint()
+	base := endpoint + "/storage/v1/b/" + awsEscape(bucket, false) + "/o"
+
+	var names []string
+	pageToken := ""
+	for {
+		u := base + "?fields=items(name),nextPageToken&prefix=" + awsEscape(prefix, false)
+		if pageToken != "" {
+			u += "&pageToken=" + awsEscape(pageToken, false)
+		}
+
+		err, body := getObjectStore(u, signGCS)
+		if err != nil {
+			return err, nil
+		}
+
+		var result struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return err, nil
+		}
+
+		for _, object := range result.Items {
+			if isImageFile(object.Name) {
+				names = append(names, object.Name)
+			}
+		}
+
+		if result.NextPageToken == "" {
+			break
+		}
+		pageToken = result.NextPageToken
+	}
+
+	sort.Strings(names)
+	urls := make([]string, len(names))
+	for i, name := range names {
+		urls[i] = base + "/" + awsEscape(name, false) + "?alt=media"
+	}
+	return nil, urls
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Orders of the frames found in a directory.
+const (
+	SORT_NAME    = "name"    // byte-wise name order, per directory
+	SORT_NATURAL = "natural" // name order, comparing the digit runs as numbers
+	SORT_MTIME   = "mtime"   // modification time, oldest first
+	SORT_SIZE    = "size"    // file size, smallest first
+	SORT_EXIF    = "exif"    // EXIF capture time of jpeg files, then name order
+)
+
+var sortOrders = []string{SORT_NAME, SORT_NATURAL, SORT_MTIME, SORT_SIZE, SORT_EXIF}
+
+func parseSortOrder(order string) (error, string) {
+	for _, known := range sortOrders {
+		if order == known {
+			return nil, order
+		}
+	}
+	return fmt.Errorf("unknown sort order %q, expected one of: %s", order, strings.Join(sortOrders, ", ")), ""
+}
+
+// Returns whether a sorts before b in natural order, so that "img2" sorts
+// before "img10". Ties, like "img02" and "img2", fall back on byte-wise order.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			starti, startj := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			na := strings.TrimLeft(a[starti:i], "0")
+			nb := strings.TrimLeft(b[startj:j], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+		if a[i] != b[j] {
+			return a[i] < b[j]
+		}
+		i++
+		j++
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// Returns whether path a sorts before path b in natural order, one path
+// element at a time, so that the content of a directory stays together.
+func naturalPathLess(a, b string) bool {
+	ea := strings.Split(filepath.ToSlash(a), "/")
+	eb := strings.Split(filepath.ToSlash(b), "/")
+	for k := 0; k < len(ea) && k < len(eb); k++ {
+		if ea[k] != eb[k] {
+			return naturalLess(ea[k], eb[k])
+		}
+	}
+	return len(ea) < len(eb)
+}
+
+// The sort keys of a frame file, only the ones of the sort order are set.
+type sortItem struct {
+	name        string
+	modTime     time.Time
+	size        int64
+	captureTime time.Time
+	hasCapture  bool
+}
+
+// Returns the indexes of the items, in name order already, in the given
+// order. The ties keep the name order, and the frames without capture time
+// come last. Descending reverses the whole order.
+func orderIndexes(items []sortItem, order string, desc bool) []int {
+	index := make([]int, len(items))
+	for i := range index {
+		index[i] = i
+	}
+
+	var less func(a, b *sortItem) bool
+	switch order {
+	case SORT_NATURAL:
+		less = func(a, b *sortItem) bool { return naturalPathLess(a.name, b.name) }
+	case SORT_MTIME:
+		less = func(a, b *sortItem) bool { return a.modTime.Before(b.modTime) }
+	case SORT_SIZE:
+		less = func(a, b *sortItem) bool { return a.size < b.size }
+	case SORT_EXIF:
+		less = func(a, b *sortItem) bool {
+			if a.hasCapture && b.hasCapture {
+				return a.captureTime.Before(b.captureTime)
+			}
+			return a.hasCapture && !b.hasCapture
+		}
+
+		missing := 0
+		for i := range items {
+			if !items[i].hasCapture {
+				missing++
+			}
+		}
+		if missing > 0 {
+			logrus.WithField("count", missing).Info("frames without capture time, placed last in name order")
+		}
+	}
+
+	if less != nil {
+		sort.SliceStable(index, func(i, j int) bool { return less(&items[index[i]], &items[index[j]]) })
+	}
+
+	if desc {
+		for i, j := 0, len(index)-1; i < j; i, j = i+1, j-1 {
+			index[i], index[j] = index[j], index[i]
+		}
+	}
+	return index
+}
+
+// Sorts the paths found in a directory in the given order. The name order is
+// the directory walk order already.
+func sortPaths(paths []string, order string, desc bool) {
+	items := make([]sortItem, len(paths))
+	for i, path := range paths {
+		items[i].name = path
+		switch order {
+		case SORT_MTIME, SORT_SIZE:
+			if info, err := os.Stat(path); err == nil {
+				items[i].modTime, items[i].size = info.ModTime(), info.Size()
+			}
+		case SORT_EXIF:
+			items[i].captureTime, items[i].hasCapture = fileCaptureTime(path)
+		}
+	}
+
+	sorted := make([]string, len(paths))
+	for i, k := range orderIndexes(items, order, desc) {
+		sorted[i] = paths[k]
+	}
+	copy(paths, sorted)
+}
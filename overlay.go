@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Margin between overlays and the frame edges, in unscaled font pixels.
+const OVERLAY_MARGIN = 4
+
+type counterOptions struct {
+	position string
+	color    color.Color
+}
+
+// Options of the text overlay.
+type textOptions struct {
+	template *template.Template
+	position string
+	color    color.Color
+	scale    int      // of the font, 0 to follow the frame size
+	names    []string // files of the frames, in playback order, set for each build
+}
+
+// Options of the watermark overlay.
+type watermarkOptions struct {
+	image    image.Image
+	position string
+	opacity  float64
+}
+
+func parseWatermarkOptions(path, position string, opacity float64) (error, *watermarkOptions) {
+	if opacity < 0 || opacity > 1 {
+		return fmt.Errorf("watermark opacity %v out of range, expected 0 to 1", opacity), nil
+	}
+
+	err, pos := parsePosition(position)
+	if err != nil {
+		return err, nil
+	}
+
+	err, img := decodeImage(path)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, &watermarkOptions{image: img, position: pos, opacity: opacity}
+}
+
+// Composites the watermark, and its own transparency, onto the frame.
+func drawWatermark(img image.Image, opts *watermarkOptions) image.Image {
+	dst := copyRGBA(img)
+	b := opts.image.Bounds()
+	r := placeRect(dst.Rect, b.Size(), opts.position, OVERLAY_MARGIN)
+	mask := image.NewUniform(color.Alpha{uint8(math.Round(opts.opacity * 0xff))})
+	draw.DrawMask(dst, r, opts.image, b.Min, mask, image.Point{}, draw.Over)
+	return dst
+}
+
+// Options of the progress bar overlay.
+type progressBarOptions struct {
+	color     color.Color
+	height    int       // 0 to follow the frame size
+	fractions []float64 // of the animation played at the end of each frame, set for each build
+}
+
+func parseProgressBarOptions(barColor string, height int) (error, *progressBarOptions) {
+	if height < 0 {
+		return fmt.Errorf("negative progress bar height %d", height), nil
+	}
+
+	err, c := parseColor(barColor)
+	if err != nil {
+		return err, nil
+	}
+	return nil, &progressBarOptions{color: c, height: height}
+}
+
+// Sets the progress of each frame, from the delays of the frames: with
+// uneven delays the bar follows the time, not the frame number.
+func (opts *progressBarOptions) place(delays []int) {
+	total := 0
+	for _, delay := range delays {
+		total += delay
+	}
+
+	opts.fractions = make([]float64, len(delays))
+	elapsed := 0
+	for i, delay := range delays {
+		elapsed += delay
+		if total > 0 {
+			opts.fractions[i] = float64(elapsed) / float64(total)
+		} else {
+			opts.fractions[i] = float64(i+1) / float64(len(delays))
+		}
+	}
+}
+
+// Draws the bar along the bottom edge of the frame, as long as the part of
+// the animation played at the end of the frame.
+func drawProgressBar(img image.Image, frame *frameInfo, opts *progressBarOptions) image.Image {
+	if frame.index >= len(opts.fractions) {
+		return img
+	}
+
+	dst := copyRGBA(img)
+	height := opts.height
+	if height == 0 {
+		height = maxInt(2, dst.Rect.Dy()/60)
+	}
+	width := int(math.Round(opts.fractions[frame.index] * float64(dst.Rect.Dx())))
+	bar := image.Rect(0, dst.Rect.Dy()-height, width, dst.Rect.Dy()).Intersect(dst.Rect)
+	draw.Draw(dst, bar, image.NewUniform(opts.color), image.Point{}, draw.Src)
+	return dst
+}
+
+// Format of the timestamp overlay, as a Go time layout, unless set.
+const DEFAULT_TIMESTAMP_FORMAT = "2006-01-02 15:04"
+
+// Options of the timestamp overlay.
+type timestampOptions struct {
+	format   string
+	position string
+	color    color.Color
+	times    []time.Time // of the frames, in playback order, set for each build
+	found    []bool
+}
+
+func parseTimestampOptions(format, position, textColor string) (error, *timestampOptions) {
+	if format == "" {
+		return fmt.Errorf("empty timestamp format"), nil
+	}
+
+	err, pos := parsePosition(position)
+	if err != nil {
+		return err, nil
+	}
+
+	err, c := parseColor(textColor)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, &timestampOptions{format: format, position: pos, color: c}
+}
+
+// Reads the capture times of the frame files, in playback order. names is nil
+// if the frames have no files.
+func (opts *timestampOptions) load(names []string) {
+	opts.times = make([]time.Time, len(names))
+	opts.found = make([]bool, len(names))
+	missing := 0
+	for i, name := range names {
+		if name != "" {
+			opts.times[i], opts.found[i] = fileCaptureTime(name)
+		}
+		if !opts.found[i] {
+			missing++
+		}
+	}
+	if missing > 0 {
+		logrus.WithField("count", missing).Info("frames without capture time, not timestamped")
+	}
+}
+
+// Draws the capture time of the frame, if it has one.
+func drawTimestamp(img image.Image, frame *frameInfo, opts *timestampOptions) image.Image {
+	if frame.index >= len(opts.found) || !opts.found[frame.index] {
+		return img
+	}
+	return drawText(img, opts.times[frame.index].Format(opts.format), opts.position, opts.color, 0)
+}
+
+// The values of the text overlay template fields.
+type textVars struct {
+	Filename string // base name of the frame file, "" if none
+	Path     string // path of the frame file, "" if none
+	Index    int    // 1-based, in playback order
+	Total    int
+}
+
+// Parses a #rrggbb or #rgb color.
+func parseColor(s string) (error, color.Color) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return fmt.Errorf("invalid color %q, expected #rrggbb", s), nil
+	}
+
+	return nil, color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
+
+func parsePosition(s string) (error, string) {
+	switch s = strings.ToLower(s); s {
+	case "tl", "tr", "bl", "br":
+		return nil, s
+	}
+	return fmt.Errorf("invalid position %q, expected tl, tr, bl or br", s), ""
+}
+
+func parseCounterOptions(position, textColor string) (error, *counterOptions) {
+	err, pos := parsePosition(position)
+	if err != nil {
+		return err, nil
+	}
+
+	err, c := parseColor(textColor)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, &counterOptions{position: pos, color: c}
+}
+
+// Parses the text overlay options. The text is a Go template of textVars,
+// like "{{.Filename}} ({{.Index}}/{{.Total}})". The size is the font height in
+// pixels, rounded to a multiple of the 13 pixels of the font, 0 to follow the
+// frame size.
+func parseTextOptions(text, position, textColor string, size int) (error, *textOptions) {
+	tmpl, err := template.New("text").Parse(text)
+	if err != nil {
+		return err, nil
+	}
+	// Catches the unknown fields before the first frame.
+	if err := tmpl.Execute(ioutil.Discard, textVars{}); err != nil {
+		return err, nil
+	}
+
+	err, pos := parsePosition(position)
+	if err != nil {
+		return err, nil
+	}
+
+	err, c := parseColor(textColor)
+	if err != nil {
+		return err, nil
+	}
+
+	if size < 0 {
+		return fmt.Errorf("negative text size %d", size), nil
+	}
+	scale := 0
+	if size > 0 {
+		scale = maxInt(1, (size+basicfont.Face7x13.Height/2)/basicfont.Face7x13.Height)
+	}
+
+	return nil, &textOptions{template: tmpl, position: pos, color: c, scale: scale}
+}
+
+// Renders a single line of text to an alpha mask, using the basic 7x13 font.
+func textMask(text string) *image.Alpha {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	mask := image.NewAlpha(image.Rect(0, 0, width, face.Height))
+
+	d := &font.Drawer{
+		Dst:  mask,
+		Src:  image.Opaque,
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+	d.DrawString(text)
+
+	return mask
+}
+
+// Renders lines of text to an alpha mask, one below the other, centered.
+func linesMask(lines []string) *image.Alpha {
+	masks := make([]*image.Alpha, len(lines))
+	width := 0
+	for i, line := range lines {
+		masks[i] = textMask(line)
+		width = maxInt(width, masks[i].Rect.Dx())
+	}
+
+	height := basicfont.Face7x13.Height
+	mask := image.NewAlpha(image.Rect(0, 0, width, height*len(lines)))
+	for i, m := range masks {
+		x := (width - m.Rect.Dx()) / 2
+		draw.Draw(mask, m.Rect.Add(image.Pt(x, i*height)), m, image.Point{}, draw.Src)
+	}
+	return mask
+}
+
+// Scales the mask up by an integer factor.
+func scaleMask(mask *image.Alpha, scale int) *image.Alpha {
+	if scale == 1 {
+		return mask
+	}
+
+	b := mask.Bounds()
+	scaled := image.NewAlpha(image.Rect(0, 0, b.Dx()*scale, b.Dy()*scale))
+	for y := 0; y < scaled.Rect.Dy(); y++ {
+		for x := 0; x < scaled.Rect.Dx(); x++ {
+			scaled.Pix[scaled.PixOffset(x, y)] = mask.Pix[mask.PixOffset(x/scale, y/scale)]
+		}
+	}
+	return scaled
+}
+
+// Returns the text scale factor for a frame: the font is 13 pixels high, so
+// keep the text readable on big frames.
+func textScale(frame image.Rectangle) int {
+	scale := frame.Dy() / 300
+	if scale < 1 {
+		scale = 1
+	}
+	return scale
+}
+
+// Returns the rectangle of the given size placed at the position (tl, tr, bl
+// or br, or tc and bc centered) inside the bounds, spaced from the edges by
+// margin.
+func placeRect(bounds image.Rectangle, size image.Point, position string, margin int) image.Rectangle {
+	x := bounds.Min.X + margin
+	if strings.HasSuffix(position, "r") {
+		x = bounds.Max.X - margin - size.X
+	} else if strings.HasSuffix(position, "c") {
+		x = bounds.Min.X + (bounds.Dx()-size.X)/2
+	}
+
+	y := bounds.Min.Y + margin
+	if strings.HasPrefix(position, "b") {
+		y = bounds.Max.Y - margin - size.Y
+	}
+
+	return image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x+size.X, y+size.Y)}
+}
+
+// Draws a line of text on img, over a translucent box so that it is readable
+// on any background. The font is scaled up by scale, or by textScale if 0.
+func drawText(img image.Image, text string, position string, textColor color.Color, scale int) *image.RGBA {
+	return drawTextMask(img, textMask(text), position, textColor, scale)
+}
+
+// Draws the text rendered to mask, as drawText.
+func drawTextMask(img image.Image, mask *image.Alpha, position string, textColor color.Color, scale int) *image.RGBA {
+	dst := copyRGBA(img)
+	if scale == 0 {
+		scale = textScale(dst.Rect)
+	}
+	mask = scaleMask(mask, scale)
+
+	pad := scale * 2
+	box := placeRect(dst.Rect, mask.Rect.Size().Add(image.Pt(2*pad, 2*pad)), position, OVERLAY_MARGIN*scale)
+	draw.Draw(dst, box, image.NewUniform(color.RGBA{0, 0, 0, 0x80}), image.Point{}, draw.Over)
+
+	r := box.Inset(pad)
+	draw.DrawMask(dst, r, image.NewUniform(textColor), image.Point{}, mask, image.Point{}, draw.Over)
+
+	return dst
+}
+
+// Draws the "index / total" frame counter, with 1-based indexes.
+func drawCounter(img image.Image, frame *frameInfo, opts *counterOptions) image.Image {
+	text := fmt.Sprintf("%d / %d", frame.index+1, frame.total)
+	return drawText(img, text, opts.position, opts.color, 0)
+}
+
+// Draws the text overlay, rendered from its template for the frame.
+func drawTextOverlay(img image.Image, frame *frameInfo, opts *textOptions) image.Image {
+	vars := textVars{Index: frame.index + 1, Total: frame.total}
+	if frame.index < len(opts.names) {
+		vars.Path = opts.names[frame.index]
+		vars.Filename = filepath.Base(vars.Path)
+	}
+
+	var text bytes.Buffer
+	if err := opts.template.Execute(&text, vars); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "frame": vars.Index}).Warn("cannot render the text overlay")
+		return img
+	}
+	// The font draws a single line.
+	line := strings.TrimSpace(strings.NewReplacer("\r\n", " ", "\n", " ").Replace(text.String()))
+	if line == "" {
+		return img
+	}
+	return drawText(img, line, opts.position, opts.color, opts.scale)
+}
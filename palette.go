@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/marcov/giffer/pkg/giffer"
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum number of pixels sampled across all the frames to compute the
+// global palette, and per frame bounds of the samples side.
+const (
+	PALETTE_SAMPLE_PIXELS   = 1 << 20
+	PALETTE_SAMPLE_MIN_SIDE = 16
+	PALETTE_SAMPLE_MAX_SIDE = 128
+)
+
+type paletteOptions struct {
+	global   bool // a single palette for all frames
+	quantize giffer.QuantizeOptions
+	maxError float64       // maximum RMS quantization error, 0 if unchecked
+	fatal    bool          // fail, instead of warning, above maxError
+	fixed    color.Palette // the -palette one, nil to compute it
+	palette  color.Palette // the global palette of the build
+	exceeded int32         // number of frames above maxError
+}
+
+// Clears the results of a previous build.
+func (opts *paletteOptions) reset() {
+	opts.palette = nil
+	atomic.StoreInt32(&opts.exceeded, 0)
+}
+
+func parseQuantizer(name string) (error, giffer.Quantizer) {
+	q, ok := giffer.Quantizers[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for name := range giffer.Quantizers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown quantizer %q, expected one of: %s", name, strings.Join(names, ", ")), nil
+	}
+	return nil, q
+}
+
+// Parses the name of a ditherer, nil for none.
+func parseDitherer(name string) (error, giffer.Ditherer) {
+	if strings.EqualFold(name, "none") {
+		return nil, nil
+	}
+	d, ok := giffer.Ditherers[strings.ToLower(name)]
+	if !ok {
+		names := []string{"none"}
+		for name := range giffer.Ditherers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown dithering %q, expected one of: %s", name, strings.Join(names, ", ")), nil
+	}
+	return nil, d
+}
+
+// Named fixed palettes.
+var namedPalettes = map[string]func() color.Palette{
+	// The 6x6x6 color cube of the web safe colors.
+	"web216": func() color.Palette {
+		var p color.Palette
+		for r := 0; r < 6; r++ {
+			for g := 0; g < 6; g++ {
+				for b := 0; b < 6; b++ {
+					p = append(p, color.RGBA{uint8(r * 51), uint8(g * 51), uint8(b * 51), 0xff})
+				}
+			}
+		}
+		return p
+	},
+	// 255 evenly spaced grays, leaving room for the transparent entry.
+	"gray": func() color.Palette {
+		var p color.Palette
+		for v := 0; v < 255; v++ {
+			p = append(p, color.Gray{uint8(v * 255 / 254)})
+		}
+		return p
+	},
+}
+
+// Reads a GIMP palette: a "GIMP Palette" header, then lines of the red, green
+// and blue values of a color, optionally followed by its name. Name and
+// Columns lines, and comments starting with #, are ignored.
+func readGimpPalette(path string) (error, color.Palette) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err, nil
+	}
+	defer f.Close()
+
+	var p color.Palette
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if line == 1 {
+			if text != "GIMP Palette" {
+				return fmt.Errorf("%s is not a GIMP palette", path), nil
+			}
+			continue
+		}
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "Name:") || strings.HasPrefix(text, "Columns:") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		var rgb [3]uint8
+		for i := range rgb {
+			var v uint64
+			if i < len(fields) {
+				v, err = strconv.ParseUint(fields[i], 10, 8)
+			}
+			if i >= len(fields) || err != nil {
+				return fmt.Errorf("%s line %d: expected red, green and blue values, got %q", path, line, text), nil
+			}
+			rgb[i] = uint8(v)
+		}
+		p = append(p, color.RGBA{rgb[0], rgb[1], rgb[2], 0xff})
+	}
+	return scanner.Err(), p
+}
+
+// Returns the colors of the image, in the order they first appear, or its
+// palette if it has one.
+func imagePalette(path string) (error, color.Palette) {
+	err, img := decodeImage(path)
+	if err != nil {
+		return err, nil
+	}
+	if pm, ok := img.(*image.Paletted); ok {
+		return nil, pm.Palette
+	}
+
+	var p color.Palette
+	seen := make(map[color.Color]bool)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y))
+			if seen[c] {
+				continue
+			}
+			if len(p) == 256 {
+				return fmt.Errorf("%s has more than 256 colors", path), nil
+			}
+			seen[c] = true
+			p = append(p, c)
+		}
+	}
+	return nil, p
+}
+
+// Returns the palette named by spec, web216 or gray, or read from a GIMP
+// palette (.gpl) or image file. A transparent entry is added if there is room
+// for it, for the transparent pixels of the frames.
+func loadPalette(spec string) (error, color.Palette) {
+	var err error
+	var p color.Palette
+	if named, ok := namedPalettes[strings.ToLower(spec)]; ok {
+		p = named()
+	} else if strings.EqualFold(filepath.Ext(spec), ".gpl") {
+		err, p = readGimpPalette(spec)
+	} else {
+		err, p = imagePalette(spec)
+	}
+	if err != nil {
+		return err, nil
+	}
+
+	switch {
+	case len(p) == 0:
+		return fmt.Errorf("empty palette %s", spec), nil
+	case len(p) > 256:
+		return fmt.Errorf("palette %s has %d colors, more than 256", spec, len(p)), nil
+	case len(p) < 256 && !hasTransparentEntry(p):
+		p = append(p, color.RGBA{})
+	}
+	return nil, p
+}
+
+func hasTransparentEntry(p color.Palette) bool {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a side x side sample of the image pixels.
+func samplePixels(img image.Image, side int) *image.RGBA {
+	b := img.Bounds()
+	sample := image.NewRGBA(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			sample.Set(x, y, img.At(b.Min.X+x*b.Dx()/side, b.Min.Y+y*b.Dy()/side))
+		}
+	}
+	return sample
+}
+
+// Computes a palette fitting all the numFrames frames of source, after they
+// went through the pre-quantization stages.
+func computeGlobalPalette(numFrames int, source frameSource, stages pipeline, opts *paletteOptions) color.Palette {
+	side := int(math.Sqrt(float64(PALETTE_SAMPLE_PIXELS / numFrames)))
+	if side < PALETTE_SAMPLE_MIN_SIDE {
+		side = PALETTE_SAMPLE_MIN_SIDE
+	}
+	if side > PALETTE_SAMPLE_MAX_SIDE {
+		side = PALETTE_SAMPLE_MAX_SIDE
+	}
+
+	// All the frames samples, stacked vertically.
+	mosaic := image.NewRGBA(image.Rect(0, 0, side, side*numFrames))
+
+	runFrameJobs(numFrames, "sampling frames for the global palette", func(i int) {
+		err, img := source(i)
+		if err != nil {
+			return
+		}
+
+		frame := &frameInfo{index: i, total: numFrames}
+		for _, t := range stages {
+			img = t(img, frame)
+		}
+
+		r := image.Rect(0, side*i, side, side*(i+1))
+		draw.Draw(mosaic, r, samplePixels(img, side), image.Point{}, draw.Src)
+	})
+
+	// Only the palette is used, the pixels are not dithered nor made lossy.
+	quantize := opts.quantize
+	quantize.Ditherer, quantize.Lossy = nil, 0
+	return quantize.Quantize(mosaic).Palette
+}
+
+// Returns the RMS error, per color channel, between img and its quantized
+// version.
+func quantizationError(img image.Image, pm *image.Paletted) float64 {
+	src := toRGBA(img)
+	sum := 0.0
+	for y := 0; y < src.Rect.Dy(); y++ {
+		for x := 0; x < src.Rect.Dx(); x++ {
+			i := src.PixOffset(x, y)
+			r, g, b, _ := pm.Palette[pm.Pix[pm.PixOffset(pm.Rect.Min.X+x, pm.Rect.Min.Y+y)]].RGBA()
+			for c, v := range []uint32{r >> 8, g >> 8, b >> 8} {
+				d := float64(src.Pix[i+c]) - float64(v)
+				sum += d * d
+			}
+		}
+	}
+
+	return math.Sqrt(sum / float64(3*src.Rect.Dx()*src.Rect.Dy()))
+}
+
+// Quantizes the frame, either with its own palette or against the global one.
+func quantizeFrame(img image.Image, frame *frameInfo, opts *paletteOptions) image.Image {
+	if opts.palette == nil {
+		return opts.quantize.Quantize(img)
+	}
+
+	b := img.Bounds()
+	pm := image.NewPaletted(b, opts.palette)
+	if opts.quantize.Ditherer != nil {
+		opts.quantize.Ditherer.Dither(pm, img)
+	} else {
+		draw.Draw(pm, b, img, b.Min, draw.Src)
+	}
+	giffer.Lossy(pm, opts.quantize.Lossy)
+
+	if opts.maxError > 0 {
+		if rmse := quantizationError(img, pm); rmse > opts.maxError {
+			atomic.AddInt32(&opts.exceeded, 1)
+			entry := logrus.WithFields(logrus.Fields{
+				"frame":     frame.index + 1,
+				"error":     rmse,
+				"max error": opts.maxError,
+			})
+			if opts.fatal {
+				entry.Error("frame quantization error too high for the global palette")
+			} else {
+				entry.Warn("frame quantization error too high for the global palette")
+			}
+		}
+	}
+
+	return pm
+}
+
+// Returns the gif configuration making the global palette the gif global
+// color table.
+func globalPaletteConfig(frames []*image.Paletted, palette color.Palette) image.Config {
+	screen := giffer.ScreenRect(frames)
+	return image.Config{ColorModel: palette, Width: screen.Max.X, Height: screen.Max.Y}
+}
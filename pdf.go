@@ -0,0 +1,58 @@
+//go:build pdf
+// +build pdf
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Rasterizes each page of the PDF file at path to a jpeg file, at the given
+// resolution, using pdftoppm (from poppler-utils). Returns the pages jpeg
+// files, in page order, and a function removing them.
+func rasterizePdf(path string, dpi int) (error, []string, func()) {
+	rasterizer, err := exec.LookPath("pdftoppm")
+	if err != nil {
+		err = errors.New("PDF input requires pdftoppm, install poppler-utils")
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("cannot rasterize PDF")
+		return err, nil, nil
+	}
+
+	tmpdir, err := ioutil.TempDir("", MYNAME+"-pdf")
+	if err != nil {
+		logrus.WithField("error", err).Error("While creating temporary directory")
+		return err, nil, nil
+	}
+	cleanup := func() { os.RemoveAll(tmpdir) }
+
+	logrus.WithFields(logrus.Fields{"file": path, "dpi": dpi}).Info("Rasterizing PDF pages")
+
+	cmd := exec.Command(rasterizer, "-r", strconv.Itoa(dpi), "-jpeg", "-jpegopt", "quality=95",
+		path, filepath.Join(tmpdir, "page"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path, "output": string(out)}).Error("while rasterizing PDF")
+		cleanup()
+		return err, nil, nil
+	}
+
+	// Page numbers are zero padded to the same width, so that the names sort
+	// in page order.
+	pages, err := filepath.Glob(filepath.Join(tmpdir, "page-*.jpg"))
+	if err != nil || len(pages) == 0 {
+		err = errors.New("no pages rasterized")
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while rasterizing PDF")
+		cleanup()
+		return err, nil, nil
+	}
+	sort.Strings(pages)
+
+	return nil, pages, cleanup
+}
@@ -0,0 +1,16 @@
+//go:build !pdf
+// +build !pdf
+
+package main
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+func rasterizePdf(path string, dpi int) (error, []string, func()) {
+	err := errors.New("PDF input is not supported by this build, rebuild giffer with -tags pdf")
+	logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("cannot rasterize PDF")
+	return err, nil, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// The processing stages applied to each frame, in order. Stages that are not
+// enabled by their options leave the frame unchanged.
+const DEFAULT_PIPELINE = "rotate,orient,chromakey,crop,resize,fit,stabilize,deflicker,adjust,equalize,effect,watermark,text,timestamp,subtitles,counter,progressbar,border,background,quantize"
+
+// Information about the frame being processed.
+type frameInfo struct {
+	index int // in playback order
+	total int
+}
+
+// A per-frame processing stage.
+type transform func(image.Image, *frameInfo) image.Image
+
+// The ordered list of stages applied to each frame, quantize being the last.
+type pipeline []transform
+
+// Options of the processing stages.
+type transformOptions struct {
+	rotation    int               // clockwise, in degrees, 0 if disabled
+	flip        string            // "" if disabled
+	orientation string            // "" if disabled
+	chromaKey   *chromaKeyOptions // nil if disabled
+	crop        *image.Rectangle  // nil if disabled
+	resize      *resizeOptions    // nil if disabled
+	fit         *fitOptions       // nil if disabled
+	stabilize   *stabilizeOptions // nil if disabled
+	deflicker   *deflickerOptions // nil if disabled
+	adjust      *adjustOptions    // nil if disabled
+	equalize    bool
+	effects     []effect            // nil if disabled
+	watermark   *watermarkOptions   // nil if disabled
+	text        *textOptions        // nil if disabled
+	timestamp   *timestampOptions   // nil if disabled
+	subtitles   *subtitleOptions    // nil if disabled
+	counter     *counterOptions     // nil if disabled
+	progressBar *progressBarOptions // nil if disabled
+	border      *borderOptions      // nil if disabled
+	background  color.Color         // nil to keep the transparency
+	palette     *paletteOptions
+}
+
+// Returns the processing stages, by name.
+func availableTransforms(opts *transformOptions) map[string]transform {
+	return map[string]transform{
+		"rotate": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.rotation == 0 && opts.flip == "" {
+				return img
+			}
+			return turnImage(img, opts.rotation, opts.flip)
+		},
+		"orient": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.orientation == "" {
+				return img
+			}
+			return orientImage(img, opts.orientation)
+		},
+		"chromakey": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.chromaKey == nil {
+				return img
+			}
+			return chromaKeyFrame(img, opts.chromaKey)
+		},
+		"crop": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.crop == nil {
+				return img
+			}
+			return cropFrame(img, *opts.crop)
+		},
+		"resize": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.resize == nil {
+				return img
+			}
+			return resizeFrame(img, opts.resize)
+		},
+		"fit": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.fit == nil {
+				return img
+			}
+			return fitFrame(img, opts.fit)
+		},
+		"stabilize": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.stabilize == nil {
+				return img
+			}
+			return stabilizeFrame(img, frame, opts.stabilize)
+		},
+		"deflicker": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.deflicker == nil {
+				return img
+			}
+			return deflickerFrame(img, frame, opts.deflicker)
+		},
+		"adjust": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.adjust == nil {
+				return img
+			}
+			return applyEffects(img, []effect{opts.adjust.effect()})
+		},
+		"equalize": func(img image.Image, frame *frameInfo) image.Image {
+			if !opts.equalize {
+				return img
+			}
+			return equalizeImage(img)
+		},
+		"effect": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.effects == nil {
+				return img
+			}
+			return applyEffects(img, opts.effects)
+		},
+		"watermark": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.watermark == nil {
+				return img
+			}
+			return drawWatermark(img, opts.watermark)
+		},
+		"text": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.text == nil {
+				return img
+			}
+			return drawTextOverlay(img, frame, opts.text)
+		},
+		"timestamp": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.timestamp == nil {
+				return img
+			}
+			return drawTimestamp(img, frame, opts.timestamp)
+		},
+		"subtitles": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.subtitles == nil {
+				return img
+			}
+			return drawSubtitles(img, frame, opts.subtitles)
+		},
+		"counter": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.counter == nil {
+				return img
+			}
+			return drawCounter(img, frame, opts.counter)
+		},
+		"progressbar": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.progressBar == nil {
+				return img
+			}
+			return drawProgressBar(img, frame, opts.progressBar)
+		},
+		"border": func(img image.Image, frame *frameInfo) image.Image {
+			if opts.border == nil {
+				return img
+			}
+			return borderFrame(img, opts.border)
+		},
+		"background": func(img image.Image, frame *frameInfo) image.Image {
+			return flattenFrame(img, opts.background)
+		},
+		"quantize": func(img image.Image, frame *frameInfo) image.Image {
+			return quantizeFrame(img, frame, opts.palette)
+		},
+	}
+}
+
+// Parses a comma separated list of stage names into a pipeline.
+func parsePipeline(spec string, transforms map[string]transform) (error, pipeline) {
+	var p pipeline
+	seen := make(map[string]bool)
+	names := strings.Split(spec, ",")
+
+	for i, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		t, ok := transforms[name]
+		if !ok {
+			return fmt.Errorf("unknown pipeline stage %q", name), nil
+		}
+
+		if seen[name] {
+			return fmt.Errorf("duplicate pipeline stage %q", name), nil
+		}
+		seen[name] = true
+
+		// Any stage after quantize would reintroduce colors that are not
+		// in the gif palette.
+		if name == "quantize" && i != len(names)-1 {
+			return fmt.Errorf("pipeline stage quantize must be the last one"), nil
+		}
+
+		p = append(p, t)
+	}
+
+	if !seen["quantize"] {
+		return fmt.Errorf("pipeline stage quantize is mandatory"), nil
+	}
+
+	return nil, p
+}
+
+// Returns the stages of p, parsed from spec, that run before the stage name,
+// and whether it is part of the pipeline. Extra stages, like the oversized
+// frames guard, run before the spec ones.
+func stagesBefore(p pipeline, spec, name string) (pipeline, bool) {
+	names := strings.Split(spec, ",")
+	for i, stage := range names {
+		if strings.ToLower(strings.TrimSpace(stage)) == name {
+			return p[:len(p)-len(names)+i], true
+		}
+	}
+	return nil, false
+}
+
+// Runs the frame through all the stages of the pipeline, or returns it from
+// the -cache-dir cache.
+func (p pipeline) apply(img image.Image, frame *frameInfo) *image.Paletted {
+	var key string
+	if cache != nil {
+		key = cache.key(img, frame)
+		if pm := cache.get(key); pm != nil {
+			return pm
+		}
+	}
+
+	for _, t := range p {
+		img = t(img, frame)
+	}
+	pm := img.(*image.Paletted)
+	if cache != nil {
+		cache.put(key, pm)
+	}
+	return pm
+}
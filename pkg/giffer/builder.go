@@ -0,0 +1,118 @@
+// Package giffer assembles animated gifs, for programs that need to build them
+// without going through the giffer command.
+package giffer
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/gif"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+var ErrNoFrames = errors.New("no frames")
+
+// Number of frames quantized or compressed at a time, one per cpu by default.
+var Jobs = runtime.NumCPU()
+
+// A Builder collects frames and encodes them to an animated gif:
+//
+//	b := giffer.NewBuilder()
+//	for _, img := range images {
+//		b.AddFrame(img, 100*time.Millisecond)
+//	}
+//	err := b.Encode(w)
+type Builder struct {
+	// As gif.GIF.LoopCount, 0 loops forever: see LoopCount to convert a
+	// number of plays.
+	LoopCount int
+	// How the frames are quantized.
+	QuantizeOptions
+	// Encodes the frames after the first one as their changes: see
+	// DeltaEncode.
+	DeltaFrames bool
+
+	frames []image.Image
+	delays []int // centiseconds
+}
+
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// Appends a frame, displayed for delay. Gif delays have a 10ms resolution.
+func (b *Builder) AddFrame(img image.Image, delay time.Duration) {
+	b.frames = append(b.frames, img)
+	b.delays = append(b.delays, 0)
+	b.SetDelay(len(b.frames)-1, delay)
+}
+
+// Changes the delay of the i-th frame, 0-based.
+func (b *Builder) SetDelay(i int, delay time.Duration) {
+	b.delays[i] = int(delay / (10 * time.Millisecond))
+}
+
+// Returns the number of frames added so far.
+func (b *Builder) Len() int {
+	return len(b.frames)
+}
+
+// Quantizes the frames, in parallel, and returns the gif.
+func (b *Builder) GIF() (error, *gif.GIF) {
+	if len(b.frames) == 0 {
+		return ErrNoFrames, nil
+	}
+
+	frames := make([]*image.Paletted, len(b.frames))
+	var wg sync.WaitGroup
+	sem := semaphore.NewWeighted(int64(Jobs))
+	for i := range b.frames {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			frames[i] = b.QuantizeOptions.Quantize(b.frames[i])
+		}(i)
+	}
+	wg.Wait()
+
+	g := &gif.GIF{
+		Image:     frames,
+		Delay:     append([]int{}, b.delays...),
+		LoopCount: b.LoopCount,
+	}
+	screen := ScreenRect(frames)
+	g.Config.Width, g.Config.Height = screen.Max.X, screen.Max.Y
+	if !b.DeltaFrames || !DeltaEncode(g) {
+		SetDisposal(g)
+	}
+
+	return nil, g
+}
+
+// Encodes the gif to w.
+func (b *Builder) Encode(w io.Writer) error {
+	err, g := b.GIF()
+	if err != nil {
+		return err
+	}
+	return EncodeAll(w, g)
+}
+
+// Returns the gif logical screen fitting all the frames.
+func ScreenRect(frames []*image.Paletted) image.Rectangle {
+	var screen image.Rectangle
+	for _, frame := range frames {
+		if frame != nil {
+			screen = screen.Union(frame.Rect)
+		}
+	}
+	return screen
+}
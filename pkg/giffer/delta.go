@@ -0,0 +1,152 @@
+package giffer
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+)
+
+// Returns whether some pixels of the frame are transparent.
+func UsesTransparency(pm *image.Paletted) bool {
+	t := transparentIndex(pm.Palette)
+	if t < 0 {
+		return false
+	}
+	for y := pm.Rect.Min.Y; y < pm.Rect.Max.Y; y++ {
+		for _, index := range pm.Pix[pm.PixOffset(pm.Rect.Min.X, y):pm.PixOffset(pm.Rect.Max.X, y)] {
+			if int(index) == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the palette with a transparent entry, added if there is room for
+// it, and the index of the entry, or -1.
+func withTransparentIndex(palette color.Palette) (color.Palette, int) {
+	if t := transparentIndex(palette); t >= 0 || len(palette) == MAX_COLORS {
+		return palette, t
+	}
+	return append(palette[:len(palette):len(palette)], color.RGBA{}), len(palette)
+}
+
+// Returns the part of the frame that changes the canvas, the pixels of the
+// frame, with those already showing on the canvas made transparent, if the
+// palette has room for a transparent entry.
+func deltaFrame(frame *image.Paletted, canvas *image.RGBA) *image.Paletted {
+	colors := make([]color.RGBA, len(frame.Palette))
+	for i, c := range frame.Palette {
+		colors[i] = color.RGBAModel.Convert(c).(color.RGBA)
+	}
+	unchanged := func(x, y int) bool {
+		return colors[frame.ColorIndexAt(x, y)] == canvas.RGBAAt(x, y)
+	}
+
+	var changed image.Rectangle
+	for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+		for x := frame.Rect.Min.X; x < frame.Rect.Max.X; x++ {
+			if !unchanged(x, y) {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if changed.Empty() {
+		// Still a frame, holding the delay.
+		changed = image.Rectangle{Min: frame.Rect.Min, Max: frame.Rect.Min.Add(image.Pt(1, 1))}
+	}
+
+	palette, t := withTransparentIndex(frame.Palette)
+	delta := image.NewPaletted(changed, palette)
+	for y := changed.Min.Y; y < changed.Max.Y; y++ {
+		for x := changed.Min.X; x < changed.Max.X; x++ {
+			index := frame.ColorIndexAt(x, y)
+			if t >= 0 && unchanged(x, y) {
+				index = uint8(t)
+			}
+			delta.SetColorIndex(x, y, index)
+		}
+	}
+	return delta
+}
+
+// Delta encodes frames one at a time, in order, as DeltaEncode does for a
+// whole gif, for frames that are not all held at once, like those written to
+// a StreamEncoder. The frames must be opaque, and fit the screen.
+type DeltaEncoder struct {
+	// The global color table, with a transparent entry, or nil: frames using
+	// the global palette use this one instead.
+	Palette color.Palette
+
+	global color.Palette
+	canvas *image.RGBA
+	frames int
+}
+
+func NewDeltaEncoder(width, height int, global color.Palette) *DeltaEncoder {
+	d := &DeltaEncoder{global: global, canvas: image.NewRGBA(image.Rect(0, 0, width, height))}
+	if global != nil {
+		d.Palette, _ = withTransparentIndex(global)
+	}
+	return d
+}
+
+// Returns the frame as the part of it changing the previous frame, the first
+// frame as is.
+func (d *DeltaEncoder) Frame(frame *image.Paletted) *image.Paletted {
+	if d.global != nil && samePalette(frame.Palette, d.global) {
+		frame.Palette = d.Palette
+	}
+
+	delta := frame
+	if d.frames > 0 {
+		delta = deltaFrame(frame, d.canvas)
+	}
+	draw.Draw(d.canvas, frame.Rect, frame, frame.Rect.Min, draw.Src)
+	d.frames++
+	return delta
+}
+
+// Replaces the frames after the first one by the part of them changing the
+// previous frame, with the pixels that don't change made transparent, and
+// drawn over the previous frame. Sequences with a steady background, like
+// screen captures and timelapses, become much smaller. Frames with
+// transparent pixels would show the previous frame through: the gif is then
+// left as is, and false returned.
+func DeltaEncode(g *gif.GIF) bool {
+	for _, frame := range g.Image {
+		if UsesTransparency(frame) {
+			return false
+		}
+	}
+
+	// Frames using the global color table keep using it, with the
+	// transparent entry.
+	global, _ := g.Config.ColorModel.(color.Palette)
+	d := NewDeltaEncoder(g.Config.Width, g.Config.Height, global)
+	for i, frame := range g.Image {
+		g.Image[i] = d.Frame(frame)
+	}
+	if d.Palette != nil {
+		g.Config.ColorModel = d.Palette
+	}
+
+	g.Disposal = make([]byte, len(g.Image))
+	for i := range g.Disposal {
+		g.Disposal[i] = gif.DisposalNone
+	}
+	return true
+}
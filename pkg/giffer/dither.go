@@ -0,0 +1,67 @@
+package giffer
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Maps the pixels of an image to a palette.
+type Ditherer interface {
+	// Sets the pixels of pm, of the bounds of img, to the colors of its
+	// palette rendering img.
+	Dither(pm *image.Paletted, img image.Image)
+}
+
+// The ditherers, by name.
+var Ditherers = map[string]Ditherer{
+	"floyd-steinberg": FloydSteinberg{},
+	"ordered":         Ordered{},
+}
+
+// Floyd-Steinberg error diffusion: the quantization error of each pixel is
+// carried over to the next ones, so that gradients are rendered by a mix of
+// the closest colors, as noise.
+type FloydSteinberg struct{}
+
+func (FloydSteinberg) Dither(pm *image.Paletted, img image.Image) {
+	draw.FloydSteinberg.Draw(pm, pm.Rect, img, img.Bounds().Min)
+}
+
+// 8x8 Bayer matrix, of the thresholds from 0 to 63.
+var bayerMatrix = [8][8]int{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// Ordered dithering: the pixels are offset by a fixed pattern before being
+// mapped to the closest color, rendering gradients as a regular crosshatch.
+// Unlike error diffusion, the pattern doesn't move between frames where the
+// image doesn't change, and compresses better.
+type Ordered struct{}
+
+func (Ordered) Dither(pm *image.Paletted, img image.Image) {
+	// The offsets span the distance between the colors of a palette evenly
+	// spread over the color cube.
+	spread := 255 / math.Cbrt(float64(len(pm.Palette)))
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			offset := (float64(bayerMatrix[y&7][x&7])+0.5)/64 - 0.5
+			// The color is alpha premultiplied, and so is the offset.
+			d := offset * spread * float64(c.A) / 0xff
+			for _, v := range []*uint8{&c.R, &c.G, &c.B} {
+				*v = uint8(math.Max(0, math.Min(float64(c.A), math.Round(float64(*v)+d))))
+			}
+			pm.SetColorIndex(x, y, uint8(pm.Palette.Index(c)))
+		}
+	}
+}
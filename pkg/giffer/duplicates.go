@@ -0,0 +1,75 @@
+package giffer
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+)
+
+// Returns whether the frames cover the same rectangle, with an RMS difference
+// per channel, alpha included, of at most threshold, in 0-255: 0 for
+// identical pixels.
+func SameFrame(a, b *image.Paletted, threshold float64) bool {
+	if a.Rect != b.Rect {
+		return false
+	}
+
+	colors := func(palette color.Palette) []color.RGBA {
+		rgba := make([]color.RGBA, len(palette))
+		for i, c := range palette {
+			rgba[i] = color.RGBAModel.Convert(c).(color.RGBA)
+		}
+		return rgba
+	}
+	ca, cb := colors(a.Palette), colors(b.Palette)
+
+	// The sum of the squared differences, past which the RMS difference
+	// exceeds the threshold.
+	limit := threshold * threshold * float64(4*a.Rect.Dx()*a.Rect.Dy())
+	sum := 0.0
+	for y := a.Rect.Min.Y; y < a.Rect.Max.Y; y++ {
+		for x := a.Rect.Min.X; x < a.Rect.Max.X; x++ {
+			pa, pb := ca[a.ColorIndexAt(x, y)], cb[b.ColorIndexAt(x, y)]
+			for _, d := range []int{int(pa.R) - int(pb.R), int(pa.G) - int(pb.G), int(pa.B) - int(pb.B), int(pa.A) - int(pb.A)} {
+				sum += float64(d * d)
+			}
+			if sum > limit {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Drops the frames that are the same as the frame before them, within an RMS
+// difference per channel of threshold, adding their delay to it, and
+// returns the number of dropped frames. Timelapses of a still scene, or
+// screen captures, show the same frame for many frames. The frames are
+// compared to the one they would be folded into, so that slow changes still
+// make new frames.
+func FoldDuplicates(g *gif.GIF, threshold float64) int {
+	if len(g.Image) == 0 {
+		return 0
+	}
+
+	disposal := len(g.Disposal) == len(g.Image)
+	kept := 0
+	for i := 1; i < len(g.Image); i++ {
+		if SameFrame(g.Image[kept], g.Image[i], threshold) {
+			g.Delay[kept] += g.Delay[i]
+			continue
+		}
+		kept++
+		g.Image[kept], g.Delay[kept] = g.Image[i], g.Delay[i]
+		if disposal {
+			g.Disposal[kept] = g.Disposal[i]
+		}
+	}
+
+	dropped := len(g.Image) - kept - 1
+	g.Image, g.Delay = g.Image[:kept+1], g.Delay[:kept+1]
+	if disposal {
+		g.Disposal = g.Disposal[:kept+1]
+	}
+	return dropped
+}
@@ -0,0 +1,111 @@
+package giffer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/gif"
+	"io"
+
+	"golang.org/x/sync/semaphore"
+)
+
+var errMismatchedFrames = errors.New("gif: mismatched image, delay and disposal lengths")
+
+// Encodes the single frame gif g, and returns its header, up to the global
+// color table, and the image block of the frame, with its graphic control
+// extension: the parts of a gif of several frames, as gif.EncodeAll writes
+// them.
+func encodeAlone(g *gif.GIF, interlace bool) (error, []byte, []byte) {
+	buf := &bytes.Buffer{}
+	var err error
+	if interlace {
+		err = EncodeInterlaced(buf, g)
+	} else {
+		err = gif.EncodeAll(buf, g)
+	}
+	if err != nil {
+		return err, nil, nil
+	}
+
+	data := buf.Bytes()
+	headerLen := 13 // header and logical screen descriptor
+	if packed := data[10]; packed&0x80 != 0 {
+		headerLen += 3 << (packed&0x07 + 1)
+	}
+	// Without the trailer.
+	return nil, data[:headerLen], data[headerLen : len(data)-1]
+}
+
+// The NETSCAPE2.0 application extension, of the loop count of animated gifs.
+func loopExtension(loopCount int) []byte {
+	ext := append([]byte{0x21, 0xff, 0x0b}, "NETSCAPE2.0"...)
+	return append(ext, 0x03, 0x01, byte(loopCount), byte(loopCount>>8), 0x00)
+}
+
+// Encodes the gif to w as gif.EncodeAll does, compressing Jobs frames in
+// parallel, which gif.EncodeAll does one after the other.
+func EncodeAll(w io.Writer, g *gif.GIF) error {
+	if len(g.Image) == 0 {
+		return ErrNoFrames
+	}
+	if len(g.Delay) != len(g.Image) || (g.Disposal != nil && len(g.Disposal) != len(g.Image)) {
+		return errMismatchedFrames
+	}
+	config := g.Config
+	if config == (image.Config{}) {
+		max := g.Image[0].Bounds().Max
+		config.Width, config.Height = max.X, max.Y
+	}
+
+	type encoded struct {
+		err           error
+		header, block []byte
+	}
+	done := make([]chan encoded, len(g.Image))
+	sem := semaphore.NewWeighted(int64(Jobs))
+	for i := range g.Image {
+		done[i] = make(chan encoded, 1)
+		go func(i int) {
+			_ = sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			frame := &gif.GIF{
+				Image:           []*image.Paletted{g.Image[i]},
+				Delay:           []int{g.Delay[i]},
+				Config:          config,
+				BackgroundIndex: g.BackgroundIndex,
+			}
+			if g.Disposal != nil {
+				frame.Disposal = []byte{g.Disposal[i]}
+			}
+			var e encoded
+			e.err, e.header, e.block = encodeAlone(frame, false)
+			done[i] <- e
+		}(i)
+	}
+
+	// The frames are written in order, as they complete.
+	for i := range done {
+		e := <-done[i]
+		if e.err != nil {
+			return e.err
+		}
+		if i == 0 {
+			if _, err := w.Write(e.header); err != nil {
+				return err
+			}
+			if len(g.Image) > 1 && g.LoopCount >= 0 {
+				if _, err := w.Write(loopExtension(g.LoopCount)); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := w.Write(e.block); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0x3b})
+	return err
+}
@@ -0,0 +1,215 @@
+package giffer
+
+import (
+	"image"
+	"image/color"
+)
+
+// Bits per channel of the colors counted by the Fast quantizer, and of the
+// colors of its lookup table of the closest palette entries.
+const (
+	FAST_HISTOGRAM_BITS = 5
+	FAST_LOOKUP_BITS    = 6
+)
+
+// The fast median cut quantizer, for large frames: the pixels are counted in a
+// histogram of the colors, of 5 bits per channel, which the boxes are cut
+// from with integer math, instead of sorting the pixels, and mapped to the
+// palette through a table of the closest entries of 6 bits per channel
+// colors, instead of searching the closest entry of every pixel. Several
+// times faster than MedianCut, for about the same quality.
+type Fast struct{}
+
+type histogramBin struct {
+	count uint64
+	sum   [3]uint64 // of the 8 bits channels of the pixels
+}
+
+// A box of the histogram, its bounds included.
+type colorBox struct {
+	min, max [3]int
+	count    uint64
+	sum      [3]uint64
+}
+
+// Calls f with the 8 bits, alpha premultiplied, channels of each pixel of
+// img, in order.
+func eachPixel(img image.Image, f func(i int, r, g, b uint8)) {
+	bounds := img.Bounds()
+	w := bounds.Dx()
+	switch src := img.(type) {
+	case *image.RGBA:
+		for y := 0; y < bounds.Dy(); y++ {
+			row := src.Pix[y*src.Stride : y*src.Stride+4*w]
+			for x := 0; x < w; x++ {
+				f(y*w+x, row[4*x], row[4*x+1], row[4*x+2])
+			}
+		}
+	case *image.NRGBA:
+		for y := 0; y < bounds.Dy(); y++ {
+			row := src.Pix[y*src.Stride : y*src.Stride+4*w]
+			for x := 0; x < w; x++ {
+				p := row[4*x : 4*x+4]
+				if p[3] == 0xff {
+					f(y*w+x, p[0], p[1], p[2])
+					continue
+				}
+				r, g, b, _ := color.NRGBA{p[0], p[1], p[2], p[3]}.RGBA()
+				f(y*w+x, uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			}
+		}
+	default:
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < w; x++ {
+				r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				f(y*w+x, uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			}
+		}
+	}
+}
+
+func histogramIndex(c [3]int) int {
+	return c[0]<<(2*FAST_HISTOGRAM_BITS) | c[1]<<FAST_HISTOGRAM_BITS | c[2]
+}
+
+// Shrinks the box to the bins of pixels it has, and sums them.
+func (box *colorBox) shrink(hist []histogramBin) {
+	lo, hi := box.min, box.max
+	box.min, box.max = hi, lo
+	box.count, box.sum = 0, [3]uint64{}
+	var c [3]int
+	for c[0] = lo[0]; c[0] <= hi[0]; c[0]++ {
+		for c[1] = lo[1]; c[1] <= hi[1]; c[1]++ {
+			for c[2] = lo[2]; c[2] <= hi[2]; c[2]++ {
+				bin := &hist[histogramIndex(c)]
+				if bin.count == 0 {
+					continue
+				}
+				for ch := range c {
+					box.min[ch] = minInt(box.min[ch], c[ch])
+					box.max[ch] = maxInt(box.max[ch], c[ch])
+					box.sum[ch] += bin.sum[ch]
+				}
+				box.count += bin.count
+			}
+		}
+	}
+}
+
+func (box *colorBox) longestSide() int {
+	longest := 0
+	for ch := 1; ch < 3; ch++ {
+		if box.max[ch]-box.min[ch] > box.max[longest]-box.min[longest] {
+			longest = ch
+		}
+	}
+	return longest
+}
+
+// Cuts the box in two along its longest side, at the median of its pixels.
+func (box *colorBox) split(hist []histogramBin) (*colorBox, *colorBox) {
+	axis := box.longestSide()
+	planes := make([]uint64, box.max[axis]-box.min[axis]+1)
+	var c [3]int
+	for c[0] = box.min[0]; c[0] <= box.max[0]; c[0]++ {
+		for c[1] = box.min[1]; c[1] <= box.max[1]; c[1]++ {
+			for c[2] = box.min[2]; c[2] <= box.max[2]; c[2]++ {
+				planes[c[axis]-box.min[axis]] += hist[histogramIndex(c)].count
+			}
+		}
+	}
+
+	// The last plane of the first box, leaving one to the second.
+	cut, below := 0, planes[0]
+	for cut < len(planes)-2 && below < box.count/2 {
+		cut++
+		below += planes[cut]
+	}
+
+	first, second := *box, *box
+	first.max[axis] = box.min[axis] + cut
+	second.min[axis] = box.min[axis] + cut + 1
+	first.shrink(hist)
+	second.shrink(hist)
+	return &first, &second
+}
+
+func (Fast) Quantize(img image.Image, numColors int) *image.Paletted {
+	const shift = 8 - FAST_HISTOGRAM_BITS
+	hist := make([]histogramBin, 1<<(3*FAST_HISTOGRAM_BITS))
+	eachPixel(img, func(_ int, r, g, b uint8) {
+		bin := &hist[int(r>>shift)<<(2*FAST_HISTOGRAM_BITS)|int(g>>shift)<<FAST_HISTOGRAM_BITS|int(b>>shift)]
+		bin.count++
+		bin.sum[0] += uint64(r)
+		bin.sum[1] += uint64(g)
+		bin.sum[2] += uint64(b)
+	})
+
+	last := 1<<FAST_HISTOGRAM_BITS - 1
+	boxes := []*colorBox{{max: [3]int{last, last, last}}}
+	boxes[0].shrink(hist)
+	for len(boxes) < numColors {
+		// The box with the most pixels over the longest side.
+		best, bestScore := -1, uint64(0)
+		for i, box := range boxes {
+			side := box.max[box.longestSide()] - box.min[box.longestSide()]
+			if score := box.count * uint64(side); side > 0 && score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+		first, second := boxes[best].split(hist)
+		boxes[best] = first
+		boxes = append(boxes, second)
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		var c [3]uint8
+		for ch := range c {
+			c[ch] = uint8((box.sum[ch] + box.count/2) / box.count)
+		}
+		palette[i] = color.RGBA{c[0], c[1], c[2], 0xff}
+	}
+	return lookupToPalette(img, palette)
+}
+
+// Maps the pixels of img to the palette, ignoring their alpha, through a
+// table of the closest entry to the center of 6 bits per channel colors,
+// filled as the pixels have them.
+func lookupToPalette(img image.Image, palette color.Palette) *image.Paletted {
+	rgb := make([][3]int, len(palette))
+	for i, c := range palette {
+		r, g, b, _ := c.RGBA()
+		rgb[i] = [3]int{int(r >> 8), int(g >> 8), int(b >> 8)}
+	}
+
+	const lookupShift = 8 - FAST_LOOKUP_BITS
+	lookup := make([]int16, 1<<(3*FAST_LOOKUP_BITS))
+	for i := range lookup {
+		lookup[i] = -1
+	}
+	pm := image.NewPaletted(img.Bounds(), palette)
+	eachPixel(img, func(i int, r, g, b uint8) {
+		key := int(r>>lookupShift)<<(2*FAST_LOOKUP_BITS) | int(g>>lookupShift)<<FAST_LOOKUP_BITS | int(b>>lookupShift)
+		if lookup[key] < 0 {
+			center := [3]int{
+				int(r>>lookupShift)<<lookupShift | 1<<(lookupShift-1),
+				int(g>>lookupShift)<<lookupShift | 1<<(lookupShift-1),
+				int(b>>lookupShift)<<lookupShift | 1<<(lookupShift-1),
+			}
+			closest, closestDist := 0, 1<<30
+			for k, c := range rgb {
+				dr, dg, db := c[0]-center[0], c[1]-center[1], c[2]-center[2]
+				if dist := dr*dr + dg*dg + db*db; dist < closestDist {
+					closest, closestDist = k, dist
+				}
+			}
+			lookup[key] = int16(closest)
+		}
+		pm.Pix[i/pm.Rect.Dx()*pm.Stride+i%pm.Rect.Dx()] = uint8(lookup[key])
+	})
+	return pm
+}
@@ -0,0 +1,113 @@
+package giffer
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"io"
+)
+
+// Interlace flag of the packed byte of gif image descriptors.
+const GIF_INTERLACE_FLAG = 0x40
+
+var errGifStructure = errors.New("unexpected gif structure")
+
+// The rows of an interlaced image, in the order they are stored: every 8th
+// row from 0, every 8th from 4, every 4th from 2, then every other row from 1.
+func interlacedRows(height int) []int {
+	rows := make([]int, 0, height)
+	for _, pass := range []struct{ start, step int }{{0, 8}, {4, 8}, {2, 4}, {1, 2}} {
+		for y := pass.start; y < height; y += pass.step {
+			rows = append(rows, y)
+		}
+	}
+	return rows
+}
+
+// Returns a copy of the frame with its rows in interlaced order.
+func interlaceRows(pm *image.Paletted) *image.Paletted {
+	out := image.NewPaletted(pm.Rect, pm.Palette)
+	w := pm.Rect.Dx()
+	for i, y := range interlacedRows(pm.Rect.Dy()) {
+		copy(out.Pix[i*out.Stride:i*out.Stride+w], pm.Pix[y*pm.Stride:y*pm.Stride+w])
+	}
+	return out
+}
+
+// Skips the data sub-blocks starting at data[i], returning the index after
+// the block terminator.
+func skipSubBlocks(data []byte, i int) (error, int) {
+	for {
+		if i >= len(data) {
+			return errGifStructure, 0
+		}
+		size := int(data[i])
+		i += 1 + size
+		if size == 0 {
+			return nil, i
+		}
+	}
+}
+
+// Sets the interlace flag of all the image descriptors of the encoded gif.
+func setInterlaceFlags(data []byte) error {
+	if len(data) < 13 {
+		return errGifStructure
+	}
+	i := 13 // header and logical screen descriptor
+	if packed := data[10]; packed&0x80 != 0 {
+		i += 3 << (packed&0x07 + 1)
+	}
+
+	for i < len(data) {
+		var err error
+		switch data[i] {
+		case 0x21: // extension
+			if err, i = skipSubBlocks(data, i+2); err != nil {
+				return err
+			}
+		case 0x2c: // image descriptor
+			if i+10 > len(data) {
+				return errGifStructure
+			}
+			packed := &data[i+9]
+			*packed |= GIF_INTERLACE_FLAG
+			i += 10
+			if *packed&0x80 != 0 {
+				i += 3 << (*packed&0x07 + 1)
+			}
+			// LZW minimum code size, then the image data.
+			if err, i = skipSubBlocks(data, i+1); err != nil {
+				return err
+			}
+		case 0x3b: // trailer
+			return nil
+		default:
+			return errGifStructure
+		}
+	}
+	return errGifStructure
+}
+
+// Encodes the gif to w with interlaced frames, which viewers render
+// progressively, as a coarse image sharpening while it downloads. The Go gif
+// encoder doesn't interlace: the rows are reordered before encoding, and the
+// images marked as interlaced.
+func EncodeInterlaced(w io.Writer, g *gif.GIF) error {
+	interlaced := *g
+	interlaced.Image = make([]*image.Paletted, len(g.Image))
+	for i, frame := range g.Image {
+		interlaced.Image[i] = interlaceRows(frame)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := EncodeAll(buf, &interlaced); err != nil {
+		return err
+	}
+	if err := setInterlaceFlags(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
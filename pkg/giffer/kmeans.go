@@ -0,0 +1,90 @@
+package giffer
+
+import (
+	"image"
+	"math"
+	"sort"
+
+	"github.com/andybons/gogif"
+)
+
+const (
+	// Pixels sampled to refine the palette.
+	KMEANS_SAMPLE_PIXELS = 1 << 16
+	// Refinement passes over the sample, unless it converges earlier.
+	KMEANS_ITERATIONS = 10
+)
+
+// The k-means quantizer: the median cut palette is refined by moving each
+// color to the mean of the pixels closest to it, until they no longer move.
+// The slowest quantizer, with the lowest error on photos and gradients.
+type KMeans struct{}
+
+func closestPoint(p [3]float64, centers [][3]float64) int {
+	best, bestDist := 0, math.Inf(1)
+	for i, c := range centers {
+		dr, dg, db := p[0]-c[0], p[1]-c[1], p[2]-c[2]
+		if d := dr*dr + dg*dg + db*db; d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+func (KMeans) Quantize(img image.Image, numColors int) *image.Paletted {
+	points := samplePoints(img, KMEANS_SAMPLE_PIXELS)
+
+	// The median cut palette of the sample is the starting point.
+	sample := image.NewRGBA(image.Rect(0, 0, len(points), 1))
+	for i, p := range points {
+		copy(sample.Pix[4*i:], []uint8{uint8(p[0]), uint8(p[1]), uint8(p[2]), 0xff})
+	}
+	start := image.NewPaletted(sample.Rect, nil)
+	(&gogif.MedianCutQuantizer{NumColor: numColors}).Quantize(start, sample.Rect, sample, image.ZP)
+
+	centers := make([][3]float64, len(start.Palette))
+	for i, c := range start.Palette {
+		r, g, b, _ := c.RGBA()
+		centers[i] = [3]float64{float64(r >> 8), float64(g >> 8), float64(b >> 8)}
+	}
+	// gogif returns the colors of samples with few of them in random order.
+	sort.Slice(centers, func(i, j int) bool {
+		a, b := centers[i], centers[j]
+		return a[0] < b[0] || (a[0] == b[0] && (a[1] < b[1] || (a[1] == b[1] && a[2] < b[2])))
+	})
+
+	assigned := make([]int, len(points))
+	for i := range assigned {
+		assigned[i] = -1
+	}
+	for iteration := 0; iteration < KMEANS_ITERATIONS; iteration++ {
+		moved := false
+		for i, p := range points {
+			if c := closestPoint(p, centers); c != assigned[i] {
+				assigned[i], moved = c, true
+			}
+		}
+		if !moved {
+			break
+		}
+
+		sums := make([][3]float64, len(centers))
+		counts := make([]int, len(centers))
+		for i, p := range points {
+			for ch := range p {
+				sums[assigned[i]][ch] += p[ch]
+			}
+			counts[assigned[i]]++
+		}
+		// Colors left without pixels stay where they are.
+		for i := range centers {
+			if counts[i] > 0 {
+				for ch := range centers[i] {
+					centers[i][ch] = sums[i][ch] / float64(counts[i])
+				}
+			}
+		}
+	}
+
+	return mapToPalette(img, pointsPalette(centers))
+}
@@ -0,0 +1,24 @@
+package giffer
+
+import "fmt"
+
+// The Netscape application extension stores the loop count on 16 bits.
+const MAX_LOOP_COUNT = 0xffff
+
+// Returns the gif.GIF LoopCount playing the animation the given number of
+// times, 0 being forever. -1 plays once too, as the gif.GIF LoopCount does.
+//
+// LoopCount is the value of the Netscape extension, that is the number of
+// repetitions after the first play: LoopCount N plays N+1 times, and playing
+// once requires no extension at all, which the encoder omits for -1.
+func LoopCount(plays int) (error, int) {
+	switch {
+	case plays < -1 || plays > MAX_LOOP_COUNT+1:
+		return fmt.Errorf("invalid loop count %d, expected 0 (forever) to %d, or -1 (once)", plays, MAX_LOOP_COUNT+1), 0
+	case plays == 0:
+		return nil, 0
+	case plays == 1 || plays == -1:
+		return nil, -1
+	}
+	return nil, plays - 1
+}
@@ -0,0 +1,133 @@
+package giffer
+
+import (
+	"image"
+	"math"
+)
+
+// Parameters of the NeuQuant network, from Anthony Dekker's implementation.
+const (
+	// One pixel in NEUQUANT_SAMPLING trains the network: 1 for the highest
+	// quality, 30 for the fastest.
+	NEUQUANT_SAMPLING = 10
+	// Learning cycles, after each of which the learning rate and radius
+	// decrease.
+	NEUQUANT_CYCLES = 100
+	// Decrease of the neighborhood radius after each cycle, as a fraction.
+	NEUQUANT_RADIUS_DECREASE = 30
+	// Frequency and bias learning rates.
+	NEUQUANT_BETA  = 1.0 / 1024
+	NEUQUANT_GAMMA = 1024
+)
+
+// Steps through the pixels, one of which doesn't divide their count, so
+// that the sampled pixels are spread over the whole image.
+var neuQuantPrimes = []int{499, 491, 487, 503}
+
+// The NeuQuant quantizer: a self-organizing map of the colors, the neurons
+// of a one-dimensional network being moved toward the pixels closest to them,
+// along with their neighbors. Smooth gradients, at a medium speed.
+type NeuQuant struct{}
+
+type neuQuantNetwork struct {
+	neurons [][3]float64
+	freq    []float64
+	bias    []float64
+}
+
+// Returns the neuron closest to p, counting its bias against neurons that
+// win too often, and updates the frequencies.
+func (n *neuQuantNetwork) contest(p [3]float64) int {
+	bestBiased, bestBiasedDist := 0, math.Inf(1)
+	for i, neuron := range n.neurons {
+		dist := math.Abs(neuron[0]-p[0]) + math.Abs(neuron[1]-p[1]) + math.Abs(neuron[2]-p[2])
+		if biased := dist - n.bias[i]; biased < bestBiasedDist {
+			bestBiased, bestBiasedDist = i, biased
+		}
+		betaFreq := n.freq[i] * NEUQUANT_BETA
+		n.freq[i] -= betaFreq
+		n.bias[i] += betaFreq * NEUQUANT_GAMMA
+	}
+	n.freq[bestBiased] += NEUQUANT_BETA
+	n.bias[bestBiased] -= NEUQUANT_BETA * NEUQUANT_GAMMA
+	return bestBiased
+}
+
+// Moves the neuron i toward p by alpha, and its neighbors within radius by
+// less as they are farther.
+func (n *neuQuantNetwork) learn(i int, p [3]float64, alpha float64, radius int) {
+	for k := maxInt(0, i-radius+1); k < minInt(len(n.neurons), i+radius); k++ {
+		a := alpha
+		if k != i {
+			d := float64(k - i)
+			a = alpha * (float64(radius*radius) - d*d) / float64(radius*radius)
+		}
+		for ch := range p {
+			n.neurons[k][ch] -= a * (n.neurons[k][ch] - p[ch])
+		}
+	}
+}
+
+func (NeuQuant) Quantize(img image.Image, numColors int) *image.Paletted {
+	points := samplePoints(img, img.Bounds().Dx()*img.Bounds().Dy())
+
+	n := &neuQuantNetwork{
+		neurons: make([][3]float64, numColors),
+		freq:    make([]float64, numColors),
+		bias:    make([]float64, numColors),
+	}
+	// The neurons start along the gray axis.
+	for i := range n.neurons {
+		v := float64(i) * 256 / float64(numColors)
+		n.neurons[i] = [3]float64{v, v, v}
+		n.freq[i] = 1 / float64(numColors)
+	}
+
+	step := neuQuantPrimes[len(neuQuantPrimes)-1]
+	for _, prime := range neuQuantPrimes {
+		if len(points)%prime != 0 {
+			step = prime
+			break
+		}
+	}
+	samples := len(points) / NEUQUANT_SAMPLING
+	if samples < NEUQUANT_CYCLES {
+		// Small images train on all their pixels.
+		samples = len(points)
+	}
+	delta := maxInt(1, samples/NEUQUANT_CYCLES)
+	alphaDecrease := 30 + float64(NEUQUANT_SAMPLING-1)/3
+
+	alpha, radius := 1.0, float64(numColors)/8
+	pos := 0
+	for i := 1; i <= samples; i++ {
+		p := points[pos]
+		r := int(radius)
+		if r <= 1 {
+			r = 1 // the winner alone
+		}
+		n.learn(n.contest(p), p, alpha, r)
+
+		pos = (pos + step) % len(points)
+		if i%delta == 0 {
+			alpha -= alpha / alphaDecrease
+			radius -= radius / NEUQUANT_RADIUS_DECREASE
+		}
+	}
+
+	return mapToPalette(img, pointsPalette(n.neurons))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
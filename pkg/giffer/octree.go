@@ -0,0 +1,110 @@
+package giffer
+
+import (
+	"image"
+	"image/color"
+)
+
+// Depth of the octree leaves, one level per bit of the color channels.
+const OCTREE_DEPTH = 8
+
+type octreeNode struct {
+	children [8]*octreeNode
+	leaf     bool
+	count    int
+	sum      [3]int
+}
+
+// The octree quantizer: the colors are sorted in a tree splitting each
+// channel by one more bit at each level, then the most specific branches are
+// merged until there are few enough leaves left. Keeps small areas of
+// distinct colors, like text, better than median cut.
+type Octree struct{}
+
+type octree struct {
+	root   *octreeNode
+	leaves int
+	// Nodes that have children, by level, that can be merged into leaves.
+	reducible [OCTREE_DEPTH][]*octreeNode
+}
+
+func (t *octree) insert(r, g, b uint8) {
+	node := t.root
+	for level := 0; !node.leaf; level++ {
+		shift := OCTREE_DEPTH - 1 - level
+		i := (r>>shift&1)<<2 | (g>>shift&1)<<1 | b>>shift&1
+		child := node.children[i]
+		if child == nil {
+			child = &octreeNode{leaf: level+1 == OCTREE_DEPTH}
+			if child.leaf {
+				t.leaves++
+			} else {
+				t.reducible[level+1] = append(t.reducible[level+1], child)
+			}
+			node.children[i] = child
+		}
+		node = child
+	}
+	node.count++
+	node.sum[0] += int(r)
+	node.sum[1] += int(g)
+	node.sum[2] += int(b)
+}
+
+// Merges the children of the last branch of the deepest level into it.
+func (t *octree) reduce() {
+	level := OCTREE_DEPTH - 1
+	for level > 0 && len(t.reducible[level]) == 0 {
+		level--
+	}
+	nodes := t.reducible[level]
+	node := nodes[len(nodes)-1]
+	t.reducible[level] = nodes[:len(nodes)-1]
+
+	for i, child := range node.children {
+		if child == nil {
+			continue
+		}
+		node.count += child.count
+		for c := range node.sum {
+			node.sum[c] += child.sum[c]
+		}
+		node.children[i] = nil
+		t.leaves--
+	}
+	node.leaf = true
+	t.leaves++
+}
+
+func (t *octree) palette(node *octreeNode, colors [][3]float64) [][3]float64 {
+	if node.leaf {
+		if node.count == 0 {
+			return colors
+		}
+		n := float64(node.count)
+		return append(colors, [3]float64{float64(node.sum[0]) / n, float64(node.sum[1]) / n, float64(node.sum[2]) / n})
+	}
+	for _, child := range node.children {
+		if child != nil {
+			colors = t.palette(child, colors)
+		}
+	}
+	return colors
+}
+
+func (Octree) Quantize(img image.Image, numColors int) *image.Paletted {
+	t := &octree{root: &octreeNode{}}
+	t.reducible[0] = []*octreeNode{t.root}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			t.insert(c.R, c.G, c.B)
+			// Merging as the tree grows bounds its size.
+			for t.leaves > numColors {
+				t.reduce()
+			}
+		}
+	}
+	return mapToPalette(img, pointsPalette(t.palette(t.root, nil)))
+}
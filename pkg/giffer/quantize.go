@@ -0,0 +1,217 @@
+package giffer
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+
+	"github.com/andybons/gogif"
+)
+
+// Largest number of colors of a gif palette.
+const MAX_COLORS = 256
+
+// Builds the palette of an image and maps its pixels to it.
+type Quantizer interface {
+	// Quantizes img to at most numColors colors, ignoring its alpha.
+	Quantize(img image.Image, numColors int) *image.Paletted
+}
+
+// The quantizers, by name.
+var Quantizers = map[string]Quantizer{
+	"mediancut": MedianCut{},
+	"octree":    Octree{},
+	"kmeans":    KMeans{},
+	"neuquant":  NeuQuant{},
+	"fast":      Fast{},
+}
+
+// How images are quantized. The zero value quantizes to 256 colors with median
+// cut, without dithering.
+type QuantizeOptions struct {
+	// Number of colors, including the transparent entry, from 2 to 256, 0 for
+	// 256.
+	NumColors int
+	// Builds the palettes, median cut if nil.
+	Quantizer Quantizer
+	// Maps the pixels to the palettes, to the closest color if nil.
+	Ditherer Ditherer
+	// Largest color error of the pixels changed to compress better, 0 for
+	// none: see Lossy.
+	Lossy int
+	// Largest number of pixels, evenly spread over the image, the palette is
+	// built from, 0 for all of them. The pixels are all mapped to it as the
+	// Fast quantizer maps them.
+	SamplePixels int
+}
+
+// Converts an image to an image.Paletted with up to 256 colors. Transparent
+// pixels are mapped to a transparent palette entry.
+func Quantize(img image.Image) *image.Paletted {
+	return QuantizeOptions{}.Quantize(img)
+}
+
+// Converts an image to an image.Paletted with up to opts.NumColors colors.
+// Transparent pixels are mapped to a transparent palette entry.
+func (opts QuantizeOptions) Quantize(img image.Image) *image.Paletted {
+	if opts.NumColors == 0 {
+		opts.NumColors = MAX_COLORS
+	}
+	if opts.Quantizer == nil {
+		opts.Quantizer = MedianCut{}
+	}
+
+	pm, ok := img.(*image.Paletted)
+	switch {
+	case ok && len(pm.Palette) <= opts.NumColors:
+		if opts.Lossy > 0 {
+			// Not changing the pixels of the caller.
+			pm = &image.Paletted{Pix: append([]uint8{}, pm.Pix...), Stride: pm.Stride, Rect: pm.Rect, Palette: pm.Palette}
+		}
+	case hasTransparency(img):
+		pm = transparentToPaletted(img, opts)
+	default:
+		pm = opaqueToPaletted(img, opts)
+	}
+
+	if opts.Lossy > 0 {
+		Lossy(pm, opts.Lossy)
+	}
+	return pm
+}
+
+// Quantizes the image to at most opts.NumColors colors, ignoring its alpha.
+func opaqueToPaletted(img image.Image, opts QuantizeOptions) *image.Paletted {
+	b := img.Bounds()
+	if palette := exactPalette(img, opts.NumColors); palette != nil {
+		pm := image.NewPaletted(b, palette)
+		draw.Draw(pm, b, img, b.Min, draw.Src)
+		return pm
+	}
+
+	var pm *image.Paletted
+	if opts.SamplePixels > 0 && b.Dx()*b.Dy() > opts.SamplePixels {
+		palette := opts.Quantizer.Quantize(sampleImage(img, opts.SamplePixels), opts.NumColors).Palette
+		pm = lookupToPalette(img, palette)
+	} else {
+		pm = opts.Quantizer.Quantize(img, opts.NumColors)
+	}
+	if opts.Ditherer != nil {
+		opts.Ditherer.Dither(pm, img)
+	}
+	return pm
+}
+
+// The median cut quantizer of gogif: the color space is split in boxes of
+// as many pixels, each giving its mean color. Fast, but with visible banding
+// on gradients.
+type MedianCut struct{}
+
+func (MedianCut) Quantize(img image.Image, numColors int) *image.Paletted {
+	b := img.Bounds()
+	pm := image.NewPaletted(b, nil)
+	q := &gogif.MedianCutQuantizer{NumColor: numColors}
+	q.Quantize(pm, b, img, image.ZP)
+	return pm
+}
+
+// Maps the pixels of img to the closest colors of the palette, as pm.Set
+// does. Images have far fewer colors than pixels: the closest color of each
+// one is only searched once.
+func mapToPalette(img image.Image, palette color.Palette) *image.Paletted {
+	b := img.Bounds()
+	pm := image.NewPaletted(b, palette)
+	closest := make(map[uint64]uint8)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := pm.Pix[(y-b.Min.Y)*pm.Stride:]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.At(x, y)
+			r, g, bl, a := c.RGBA()
+			key := uint64(r)<<48 | uint64(g)<<32 | uint64(bl)<<16 | uint64(a)
+			index, ok := closest[key]
+			if !ok {
+				index = uint8(palette.Index(c))
+				closest[key] = index
+			}
+			row[x-b.Min.X] = index
+		}
+	}
+	return pm
+}
+
+// Returns an image of about maxPixels pixels evenly spread over img, in a
+// single row.
+func sampleImage(img image.Image, maxPixels int) image.Image {
+	b := img.Bounds()
+	total := b.Dx() * b.Dy()
+	n := minInt(total, maxPixels)
+	sample := image.NewRGBA(image.Rect(0, 0, n, 1))
+	for k := 0; k < n; k++ {
+		i := k * total / n
+		sample.Set(k, 0, img.At(b.Min.X+i%b.Dx(), b.Min.Y+i/b.Dx()))
+	}
+	return sample
+}
+
+// Returns the RGB values, from 0 to 255, of about maxPixels pixels evenly
+// spread over img, ignoring their alpha.
+func samplePoints(img image.Image, maxPixels int) [][3]float64 {
+	b := img.Bounds()
+	total := b.Dx() * b.Dy()
+	points := make([][3]float64, minInt(total, maxPixels))
+	for k := range points {
+		i := k * total / len(points)
+		r, g, bl, _ := img.At(b.Min.X+i%b.Dx(), b.Min.Y+i/b.Dx()).RGBA()
+		points[k] = [3]float64{float64(r >> 8), float64(g >> 8), float64(bl >> 8)}
+	}
+	return points
+}
+
+// Returns the palette of the colors, rounded.
+func pointsPalette(colors [][3]float64) color.Palette {
+	palette := make(color.Palette, len(colors))
+	for i, c := range colors {
+		palette[i] = color.RGBA{roundUint8(c[0]), roundUint8(c[1]), roundUint8(c[2]), 0xff}
+	}
+	return palette
+}
+
+func roundUint8(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// Returns the sorted palette of all the colors of img, or nil if there are
+// more than maxColors. gogif builds the palette of such images out of a map,
+// in random order, which would make the output not reproducible.
+func exactPalette(img image.Image, maxColors int) color.Palette {
+	bounds := img.Bounds()
+	colorSet := make(map[uint32]bool, maxColors)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			colorSet[(r>>8)<<16|(g>>8)<<8|b>>8] = true
+			if len(colorSet) > maxColors {
+				return nil
+			}
+		}
+	}
+
+	keys := make([]uint32, 0, len(colorSet))
+	for key := range colorSet {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	palette := make(color.Palette, len(keys))
+	for i, key := range keys {
+		palette[i] = color.RGBA{uint8(key >> 16), uint8(key >> 8), uint8(key), 0xff}
+	}
+	return palette
+}
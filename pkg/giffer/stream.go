@@ -0,0 +1,202 @@
+package giffer
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+)
+
+// A StreamEncoder writes the frames of a gif as they are given, instead of
+// holding them all until gif.EncodeAll, so that the memory used doesn't grow
+// with the number of frames:
+//
+//	e := giffer.NewStreamEncoder(f)
+//	for _, frame := range frames {
+//		err := e.Encode(frame, 10)
+//	}
+//	err := e.Close()
+//
+// The logical screen fitting all the frames, and the disposal SetDisposal
+// would set, are only known once all the frames are written: Close writes
+// them over the placeholders written first, w must be seekable, like a file.
+// The output is the same as gif.EncodeAll's.
+type StreamEncoder struct {
+	// As gif.GIF.LoopCount.
+	LoopCount int
+	// The global color table, nil for none, used by the frames having the
+	// same palette.
+	Palette color.Palette
+	// The disposal of all the frames, 0 to set it as SetDisposal does.
+	Disposal byte
+	// Writes interlaced frames, see EncodeInterlaced.
+	Interlace bool
+
+	w      io.WriteSeeker
+	offset int64  // of the next byte written
+	header []byte // of the gif, with the first frame, until the second one
+	first  []byte // shows whether it is animated
+	frames int
+	// The graphic control extensions of the frames, and the logical screen.
+	controls []frameControl
+	screen   image.Rectangle
+	rect     image.Rectangle // of all the frames, or empty if they differ
+	// Some frames are transparent.
+	transparent bool
+}
+
+// The graphic control extension of a written frame, to set its disposal.
+type frameControl struct {
+	offset int64
+	packed byte // its disposal and transparency flag
+}
+
+func NewStreamEncoder(w io.WriteSeeker) *StreamEncoder {
+	return &StreamEncoder{w: w}
+}
+
+func (e *StreamEncoder) write(data []byte) error {
+	n, err := e.w.Write(data)
+	e.offset += int64(n)
+	return err
+}
+
+// A frame compressed by StreamEncoder.EncodeFrame, to be written by
+// StreamEncoder.WriteFrame.
+type EncodedFrame struct {
+	header      []byte // of the gif of the frame alone
+	block       []byte // its graphic control extension and image
+	rect        image.Rectangle
+	transparent bool
+}
+
+// Compresses the frame, in parallel with the other frames: the options of
+// the encoder must not change until it is closed.
+func (e *StreamEncoder) EncodeFrame(pm *image.Paletted) (error, *EncodedFrame) {
+	g := &gif.GIF{
+		Image: []*image.Paletted{pm},
+		Delay: []int{0},
+		// A placeholder, so that the frames all have a graphic control
+		// extension, for their delay and disposal.
+		Disposal:  []byte{gif.DisposalNone},
+		LoopCount: e.LoopCount,
+		Config:    image.Config{Width: pm.Rect.Max.X, Height: pm.Rect.Max.Y},
+	}
+	if e.Palette != nil {
+		g.Config.ColorModel = e.Palette
+	}
+
+	err, header, block := encodeAlone(g, e.Interlace)
+	if err != nil {
+		return err, nil
+	}
+	return nil, &EncodedFrame{header: header, block: block, rect: pm.Rect, transparent: hasTransparentIndex(pm)}
+}
+
+// Writes the frame, displayed for delay centiseconds.
+func (e *StreamEncoder) Encode(pm *image.Paletted, delay int) error {
+	err, frame := e.EncodeFrame(pm)
+	if err != nil {
+		return err
+	}
+	return e.WriteFrame(frame, delay)
+}
+
+// Writes the frame compressed by EncodeFrame, displayed for delay
+// centiseconds. The frames are written in the order of the calls.
+func (e *StreamEncoder) WriteFrame(frame *EncodedFrame, delay int) error {
+	binary.LittleEndian.PutUint16(frame.block[4:6], uint16(delay))
+
+	e.screen = e.screen.Union(frame.rect)
+	if e.frames == 0 {
+		e.rect = frame.rect
+	} else if frame.rect != e.rect {
+		e.rect = image.Rectangle{}
+	}
+	e.transparent = e.transparent || frame.transparent
+	e.frames++
+
+	switch e.frames {
+	case 1:
+		e.header, e.first = frame.header, frame.block
+		return nil
+	case 2:
+		if err := e.writeHeader(true); err != nil {
+			return err
+		}
+	}
+	return e.writeBlock(frame.block)
+}
+
+// Writes the gif header, and the first frame.
+func (e *StreamEncoder) writeHeader(animated bool) error {
+	if err := e.write(e.header); err != nil {
+		return err
+	}
+	if animated && e.LoopCount >= 0 {
+		if err := e.write(loopExtension(e.LoopCount)); err != nil {
+			return err
+		}
+	}
+
+	err := e.writeBlock(e.first)
+	e.header, e.first = nil, nil
+	return err
+}
+
+// Writes an image block, starting with its graphic control extension, as the
+// disposal is set.
+func (e *StreamEncoder) writeBlock(block []byte) error {
+	e.controls = append(e.controls, frameControl{offset: e.offset, packed: block[3]})
+	return e.write(block)
+}
+
+// Writes data at offset.
+func (e *StreamEncoder) patch(offset int64, data []byte) error {
+	if _, err := e.w.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := e.w.Write(data)
+	return err
+}
+
+// Writes the end of the gif, then its logical screen and the disposal of the
+// frames.
+func (e *StreamEncoder) Close() error {
+	if e.frames == 0 {
+		return ErrNoFrames
+	}
+	if e.frames == 1 {
+		if err := e.writeHeader(false); err != nil {
+			return err
+		}
+	}
+	if err := e.write([]byte{0x3b}); err != nil {
+		return err
+	}
+
+	disposal := e.Disposal
+	if disposal == 0 {
+		disposal = gif.DisposalNone
+		if e.transparent || e.rect != image.Rect(0, 0, e.screen.Max.X, e.screen.Max.Y) {
+			disposal = gif.DisposalBackground
+		}
+	}
+
+	screen := make([]byte, 4)
+	binary.LittleEndian.PutUint16(screen[0:2], uint16(e.screen.Max.X))
+	binary.LittleEndian.PutUint16(screen[2:4], uint16(e.screen.Max.Y))
+	if err := e.patch(6, screen); err != nil {
+		return err
+	}
+	for _, c := range e.controls {
+		packed := c.packed&^0x1c | disposal<<2
+		if err := e.patch(c.offset+3, []byte{packed}); err != nil {
+			return err
+		}
+	}
+
+	_, err := e.w.Seek(0, io.SeekEnd)
+	return err
+}
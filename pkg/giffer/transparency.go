@@ -0,0 +1,106 @@
+package giffer
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+)
+
+// Pixels with a lower alpha are transparent in the gif.
+const TRANSPARENT_ALPHA = 0x80
+
+// Returns whether some pixels of the image are transparent.
+func hasTransparency(img image.Image) bool {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a>>8 < TRANSPARENT_ALPHA {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Quantizes the opaque pixels of the image to opts.NumColors-1 colors, and
+// maps the transparent ones to an extra fully transparent palette entry, that
+// the gif encoder writes as the transparent index.
+func transparentToPaletted(img image.Image, opts QuantizeOptions) *image.Paletted {
+	b := img.Bounds()
+	flat := image.NewNRGBA(b)
+	// Transparent pixels repeat the previous opaque color, or the first one,
+	// so that they don't take a palette entry of their own.
+	last := color.NRGBA{0, 0, 0, 0xff}
+	for i := 0; i < b.Dx()*b.Dy(); i++ {
+		c := color.NRGBAModel.Convert(img.At(b.Min.X+i%b.Dx(), b.Min.Y+i/b.Dx())).(color.NRGBA)
+		if c.A >= TRANSPARENT_ALPHA {
+			last = color.NRGBA{c.R, c.G, c.B, 0xff}
+			break
+		}
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A >= TRANSPARENT_ALPHA {
+				last = color.NRGBA{c.R, c.G, c.B, 0xff}
+			}
+			flat.SetNRGBA(x, y, last)
+		}
+	}
+
+	opts.NumColors--
+	pm := opaqueToPaletted(flat, opts)
+	transparent := uint8(len(pm.Palette))
+	pm.Palette = append(append(color.Palette{}, pm.Palette...), color.RGBA{})
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a>>8 < TRANSPARENT_ALPHA {
+				pm.SetColorIndex(x, y, transparent)
+			}
+		}
+	}
+	return pm
+}
+
+// Returns whether the palette has a transparent entry.
+func hasTransparentIndex(pm *image.Paletted) bool {
+	return transparentIndex(pm.Palette) >= 0
+}
+
+// Returns the index of the transparent entry of the palette, or -1.
+func transparentIndex(palette color.Palette) int {
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Sets the disposal of all the frames, as SetDisposal.
+//
+// Deprecated: use SetDisposal.
+func DisposeTransparentFrames(gifInfo *gif.GIF) {
+	SetDisposal(gifInfo)
+}
+
+// Sets the disposal of all the frames: background if some of them are
+// transparent or don't cover the whole screen, as the previous frame would
+// show through or around them, and none otherwise. Some viewers smear frames
+// of an unspecified disposal.
+func SetDisposal(gifInfo *gif.GIF) {
+	screen := image.Rect(0, 0, gifInfo.Config.Width, gifInfo.Config.Height)
+	disposal := byte(gif.DisposalNone)
+	for _, frame := range gifInfo.Image {
+		if frame != nil && (hasTransparentIndex(frame) || frame.Rect != screen) {
+			disposal = gif.DisposalBackground
+		}
+	}
+
+	gifInfo.Disposal = make([]byte, len(gifInfo.Image))
+	for i := range gifInfo.Disposal {
+		gifInfo.Disposal[i] = disposal
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Quality of the jpeg posters.
+const POSTER_JPEG_QUALITY = 90
+
+// Options of -poster.
+type posterOptions struct {
+	path  string
+	index int // 1-based, in playback order
+}
+
+// Parses the -poster path, optionally followed by :INDEX, the 1-based index of
+// the frame in playback order, the first one by default.
+func parsePosterOptions(spec string) (error, *posterOptions) {
+	opts := &posterOptions{path: spec, index: 1}
+	if i := strings.LastIndexByte(spec, ':'); i >= 0 {
+		if index, err := strconv.Atoi(spec[i+1:]); err == nil {
+			if index < 1 {
+				return fmt.Errorf("invalid poster frame index %d, expected 1 or more", index), nil
+			}
+			opts.path, opts.index = spec[:i], index
+		}
+	}
+
+	switch strings.ToLower(filepath.Ext(opts.path)) {
+	case ".jpg", ".jpeg", ".png":
+	default:
+		return fmt.Errorf("unsupported poster file %q, expected a .jpg or .png one", opts.path), nil
+	}
+	return nil, opts
+}
+
+// Writes the poster frame of the numFrames frames of source, through the
+// stages, the pipeline without quantize: it keeps all its colors. Jpeg
+// posters are drawn on white, without transparency.
+func (opts *posterOptions) write(numFrames int, source frameSource, stages pipeline) error {
+	if opts.index > numFrames {
+		return fmt.Errorf("poster frame %d is past the last frame, %d", opts.index, numFrames)
+	}
+	err, img := source(opts.index - 1)
+	if err != nil {
+		return err
+	}
+	frame := &frameInfo{index: opts.index - 1, total: numFrames}
+	for _, t := range stages {
+		img = t(img, frame)
+	}
+
+	f, err := os.Create(opts.path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(opts.path), ".png") {
+		err = png.Encode(f, img)
+	} else {
+		err = jpeg.Encode(f, flattenFrame(img, color.White), &jpeg.Options{Quality: POSTER_JPEG_QUALITY})
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{"file": opts.path, "frame": opts.index}).Info("poster written")
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// Refresh the progress bar at most a few times per second by default.
+const DEFAULT_PROGRESS_INTERVAL = 250 * time.Millisecond
+
+// How often the progress of the frame jobs is reported: every count frames, or
+// every period.
+type progressInterval struct {
+	count  int
+	period time.Duration
+}
+
+// Set by -progress-interval.
+var progressEvery = &progressInterval{period: DEFAULT_PROGRESS_INTERVAL}
+
+// Parses a progress interval: a number of frames, like 100, or a duration,
+// like 500ms.
+func parseProgressInterval(s string) (error, *progressInterval) {
+	if count, err := strconv.Atoi(s); err == nil {
+		if count <= 0 {
+			return fmt.Errorf("invalid progress interval %q, expected a positive number of frames", s), nil
+		}
+		return nil, &progressInterval{count: count}
+	}
+
+	period, err := time.ParseDuration(s)
+	if err != nil || period <= 0 {
+		return fmt.Errorf("invalid progress interval %q, expected a number of frames or a duration", s), nil
+	}
+	return nil, &progressInterval{period: period}
+}
+
+// A progress bar that can be incremented concurrently by the frame jobs. The
+// completed frames are counted atomically, and the bar is only redrawn at the
+// progress interval.
+type frameProgress struct {
+	bar      *pb.ProgressBar
+	interval *progressInterval
+	done     int64
+	mutex    sync.Mutex // serializes the manual redraws
+}
+
+func startProgress(total int, interval *progressInterval) *frameProgress {
+	bar := pb.New(total)
+	bar.SetMaxWidth(80)
+	if interval.count > 0 {
+		bar.ManualUpdate = true
+	} else {
+		bar.SetRefreshRate(interval.period)
+	}
+	bar.Start()
+
+	p := &frameProgress{bar: bar, interval: interval}
+	if bar.ManualUpdate {
+		bar.Update()
+	}
+	return p
+}
+
+func (p *frameProgress) increment() {
+	done := atomic.AddInt64(&p.done, 1)
+	p.bar.Set64(done)
+
+	if p.interval.count > 0 && done%int64(p.interval.count) == 0 {
+		p.mutex.Lock()
+		p.bar.Update()
+		p.mutex.Unlock()
+	}
+}
+
+func (p *frameProgress) finish() {
+	p.bar.Finish()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	DEFAULT_DOWNLOAD_JOBS    = 4
+	DEFAULT_DOWNLOAD_RETRIES = 3
+	DOWNLOAD_TIMEOUT         = time.Minute
+	DOWNLOAD_RETRY_BACKOFF   = time.Second // multiplied by the attempt number
+)
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// Reads a list of URLs, as readLines.
+func readURLList(listPath string) (error, []string) {
+	err, urls := readLines(listPath)
+	if err != nil {
+		return err, nil
+	}
+
+	for i, s := range urls {
+		if !isURL(s) {
+			err := fmt.Errorf("entry %d: %q is not an http(s) URL", i+1, s)
+			logrus.WithFields(logrus.Fields{"error": err, "file": listPath}).Error("invalid URL list")
+			return err, nil
+		}
+	}
+
+	return nil, urls
+}
+
+// An error worth retrying the download for.
+type temporaryError struct {
+	error
+}
+
+// Adds the credentials of a storage service to a request, nil for none.
+type requestSigner func(*http.Request) error
+
+// Downloads rawurl to a file of dir named after index. The extension comes
+// from the URL, or from the response content type.
+func downloadFile(client *http.Client, rawurl string, sign requestSigner, dir string, index int) (error, string) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return err, ""
+	}
+	if sign != nil {
+		if err := sign(req); err != nil {
+			return err, ""
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return temporaryError{err}, ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s: %s", rawurl, resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return temporaryError{err}, ""
+		}
+		return err, ""
+	}
+
+	ext := ""
+	if u, err := url.Parse(rawurl); err == nil {
+		ext = path.Ext(u.Path)
+	}
+	if ext == "" {
+		if exts, err := mime.ExtensionsByType(resp.Header.Get("Content-Type")); err == nil && len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+
+	file := filepath.Join(dir, fmt.Sprintf("%08d%s", index, ext))
+	f, err := os.Create(file)
+	if err != nil {
+		return err, ""
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return temporaryError{err}, ""
+	}
+
+	return nil, file
+}
+
+// Downloads the urls to a temporary directory, jobs at a time, retrying the
+// failed downloads up to retries times. Returns the downloaded files, in the
+// urls order, and a function removing them.
+func downloadFiles(urls []string, sign requestSigner, jobs, retries int) (error, []string, func()) {
+	tmpdir, err := ioutil.TempDir("", MYNAME+"-download")
+	if err != nil {
+		logrus.WithField("error", err).Error("While creating temporary directory")
+		return err, nil, nil
+	}
+	cleanup := func() { os.RemoveAll(tmpdir) }
+
+	logrus.WithFields(logrus.Fields{
+		"// jobs":      jobs,
+		"num of files": len(urls),
+	}).Info("Parallel downloading")
+
+	client := &http.Client{Timeout: DOWNLOAD_TIMEOUT}
+	files := make([]string, len(urls))
+	errs := make([]error, len(urls))
+
+	var wg sync.WaitGroup
+	sem := semaphore.NewWeighted(int64(jobs))
+	progress := startProgress(len(urls), progressEvery)
+
+	for i := range urls {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			for attempt := 0; ; attempt++ {
+				errs[i], files[i] = downloadFile(client, urls[i], sign, tmpdir, i)
+				if _, ok := errs[i].(temporaryError); !ok || attempt == retries {
+					break
+				}
+				logrus.WithFields(logrus.Fields{"error": errs[i], "url": urls[i]}).Warn("retrying download")
+				time.Sleep(time.Duration(attempt+1) * DOWNLOAD_RETRY_BACKOFF)
+			}
+			progress.increment()
+		}(i)
+	}
+	wg.Wait()
+	progress.finish()
+
+	for i, err := range errs {
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "url": urls[i]}).Error("while downloading")
+			cleanup()
+			return err, nil, nil
+		}
+	}
+
+	return nil, files, cleanup
+}
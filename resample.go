@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A resampling filter: its kernel and the radius it covers, in source pixels
+// when upscaling.
+type resampleFilter struct {
+	support float64
+	kernel  func(x float64) float64
+}
+
+var resampleFilters = map[string]*resampleFilter{
+	"nearest": nil, // picks the closest source pixel, no weights
+	"bilinear": {1, func(x float64) float64 {
+		return 1 - math.Abs(x)
+	}},
+	"lanczos": {3, func(x float64) float64 {
+		if x == 0 {
+			return 1
+		}
+		px := math.Pi * x
+		return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+	}},
+}
+
+// Options of the resize stage: the frame size, or scale factor.
+type resizeOptions struct {
+	width  int     // 0 to follow the height aspect ratio
+	height int     // 0 to follow the width aspect ratio
+	scale  float64 // instead of width and height, 0 if unset
+	filter *resampleFilter
+}
+
+func parseFilter(name string) (error, *resampleFilter) {
+	filter, ok := resampleFilters[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for name := range resampleFilters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown filter %q, expected one of: %s", name, strings.Join(names, ", ")), nil
+	}
+	return nil, filter
+}
+
+func parseResizeOptions(width, height int, scale float64, filter *resampleFilter) (error, *resizeOptions) {
+	if width < 0 || height < 0 || scale < 0 {
+		return fmt.Errorf("negative frame size"), nil
+	}
+	if scale > 0 && (width > 0 || height > 0) {
+		return fmt.Errorf("-scale is not supported with -width or -height"), nil
+	}
+
+	return nil, &resizeOptions{width: width, height: height, scale: scale, filter: filter}
+}
+
+// Returns the size of a resized frame of the given size.
+func (opts *resizeOptions) size(size image.Point) image.Point {
+	w, h := opts.width, opts.height
+	switch {
+	case opts.scale > 0:
+		w = int(math.Round(float64(size.X) * opts.scale))
+		h = int(math.Round(float64(size.Y) * opts.scale))
+	case w == 0:
+		w = int(math.Round(float64(size.X) * float64(h) / float64(size.Y)))
+	case h == 0:
+		h = int(math.Round(float64(size.Y) * float64(w) / float64(size.X)))
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return image.Pt(w, h)
+}
+
+// The source pixels, and their weights, contributing to a destination pixel.
+type contribution struct {
+	start   int
+	weights []float64
+}
+
+// Returns the contributions of the n source pixels to each of the m
+// destination pixels along one axis.
+func contributions(n, m int, filter *resampleFilter) []contribution {
+	scale := float64(n) / float64(m)
+	// Downscaling widens the kernel, to cover all the source pixels.
+	fscale := math.Max(scale, 1)
+	support := filter.support * fscale
+
+	contribs := make([]contribution, m)
+	for i := range contribs {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := int(math.Ceil(center - support))
+		end := int(math.Floor(center + support))
+
+		weights := make([]float64, 0, end-start+1)
+		sum := 0.0
+		for j := start; j <= end; j++ {
+			w := filter.kernel((float64(j) - center) / fscale)
+			weights = append(weights, w)
+			sum += w
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+		contribs[i] = contribution{start: start, weights: weights}
+	}
+	return contribs
+}
+
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+// Resizes img to w x h with the filter, nil for nearest neighbour.
+func resampleImage(img image.Image, w, h int, filter *resampleFilter) *image.RGBA {
+	src := toRGBA(img)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	if filter == nil {
+		for y := 0; y < h; y++ {
+			sy := (2*y + 1) * sh / (2 * h)
+			for x := 0; x < w; x++ {
+				sx := (2*x + 1) * sw / (2 * w)
+				copy(dst.Pix[dst.PixOffset(x, y):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+			}
+		}
+		return dst
+	}
+
+	// Horizontal pass into floats, then vertical pass. The pixels are alpha
+	// premultiplied, so transparent pixels do not bleed their color.
+	tmp := make([]float64, w*sh*4)
+	for y, contribs := 0, contributions(sw, w, filter); y < sh; y++ {
+		for x, c := range contribs {
+			var sum [4]float64
+			for k, weight := range c.weights {
+				i := src.PixOffset(clampIndex(c.start+k, sw), y)
+				for ch := 0; ch < 4; ch++ {
+					sum[ch] += weight * float64(src.Pix[i+ch])
+				}
+			}
+			copy(tmp[(y*w+x)*4:], sum[:])
+		}
+	}
+
+	for x, contribs := 0, contributions(sh, h, filter); x < w; x++ {
+		for y, c := range contribs {
+			var sum [4]float64
+			for k, weight := range c.weights {
+				i := (clampIndex(c.start+k, sh)*w + x) * 4
+				for ch := 0; ch < 4; ch++ {
+					sum[ch] += weight * tmp[i+ch]
+				}
+			}
+
+			// Lanczos lobes overshoot: clamp, with colors within alpha.
+			a := math.Max(0, math.Min(255, math.Round(sum[3])))
+			j := dst.PixOffset(x, y)
+			for ch := 0; ch < 3; ch++ {
+				dst.Pix[j+ch] = uint8(math.Max(0, math.Min(a, math.Round(sum[ch]))))
+			}
+			dst.Pix[j+3] = uint8(a)
+		}
+	}
+
+	return dst
+}
+
+// Resizes the frame as set by opts.
+func resizeFrame(img image.Image, opts *resizeOptions) image.Image {
+	size := opts.size(img.Bounds().Size())
+	if size == img.Bounds().Size() {
+		return img
+	}
+	return resampleImage(img, size.X, size.Y, opts.filter)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Returns the size fitting in a maxDim x maxDim square, preserving the aspect
+// ratio of size.
+func fitDimension(size image.Point, maxDim int) image.Point {
+	if size.X >= size.Y {
+		h := size.Y * maxDim / size.X
+		if h < 1 {
+			h = 1
+		}
+		return image.Pt(maxDim, h)
+	}
+
+	w := size.X * maxDim / size.Y
+	if w < 1 {
+		w = 1
+	}
+	return image.Pt(w, maxDim)
+}
+
+// Set by -max-frame-dimension: the larger side of the frames, downscaled
+// above it, 0 for no limit.
+var maxFrameDimension = 0
+
+// Frames are decoded in full before being downscaled: the image files of more
+// than this many times the pixels of a -max-frame-dimension square frame are
+// rejected instead, before decoding them.
+const MAX_DOWNSCALED_AREA = 16
+
+// Checks the size of an image, from its config, against -max-frame-dimension,
+// before decoding it.
+func checkFrameConfig(config image.Config) error {
+	if maxFrameDimension == 0 {
+		return nil
+	}
+	limit := int64(MAX_DOWNSCALED_AREA) * int64(maxFrameDimension) * int64(maxFrameDimension)
+	if int64(config.Width)*int64(config.Height) > limit {
+		return fmt.Errorf("%dx%d image too large to downscale to -max-frame-dimension %d", config.Width, config.Height, maxFrameDimension)
+	}
+	return nil
+}
+
+// Returns a transform that downscales frames whose larger side exceeds maxDim,
+// with the resampling filter. The image files are checked before decoding, by
+// checkFrameConfig, but the other frames, e.g. generated ones, only here.
+func limitFrameDimension(maxDim int, filter *resampleFilter) transform {
+	return func(img image.Image, frame *frameInfo) image.Image {
+		size := img.Bounds().Size()
+		if size.X <= maxDim && size.Y <= maxDim {
+			return img
+		}
+
+		fit := fitDimension(size, maxDim)
+		logrus.WithFields(logrus.Fields{
+			"from": fmt.Sprintf("%dx%d", size.X, size.Y),
+			"to":   fmt.Sprintf("%dx%d", fit.X, fit.Y),
+		}).Warn("auto-downscaling oversized frame")
+
+		return resampleImage(img, fit.X, fit.Y, filter)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Suffix of the state file of a run, next to its output.
+const STATE_SUFFIX = ".giffer-state"
+
+// Interval between the updates of the state file.
+const STATE_INTERVAL = time.Second
+
+// Set with -cache-dir: the state of the run, kept next to the output until it
+// is written, for -resume to continue it. Nil if disabled.
+var resumeState *runState
+
+// The state file of a run: what it is, and how far it went. The processed
+// frames themselves are in the -cache-dir cache.
+type runState struct {
+	Options string `json:"options"` // hash of the options and inputs
+	Frames  int    `json:"frames"`
+	Done    int64  `json:"done"` // frames processed
+
+	path  string
+	mutex sync.Mutex
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Returns the hash of the options and inputs of the run, which tells whether
+// a state file is that of the same command.
+func runOptions() string {
+	h := sha256.New()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "resume" {
+			fmt.Fprintf(h, "-%s=%q\n", f.Name, f.Value.String())
+		}
+	})
+	for _, arg := range flag.Args() {
+		fmt.Fprintf(h, "%q\n", arg)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Reads the state file of the run of path.
+func readRunState(path string) (error, *runState) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err, nil
+	}
+	state := &runState{path: path}
+	if err := json.Unmarshal(data, state); err != nil {
+		return err, nil
+	}
+	return nil, state
+}
+
+// Creates the state file of the run at path.
+func newRunState(path string) (error, *runState) {
+	state := &runState{Options: runOptions(), path: path}
+	return state.write(), state
+}
+
+// Replaces the state file, at once, as the run may be interrupted anytime.
+func (s *runState) write() error {
+	s.mutex.Lock()
+	data, err := json.Marshal(s)
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+"-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// Updates the state file with the number of frames processed, as done
+// returns it, until stopped.
+func (s *runState) track(numFrames int, done func() int64) {
+	s.mutex.Lock()
+	s.Frames = numFrames
+	s.mutex.Unlock()
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(STATE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			s.mutex.Lock()
+			changed := done() != s.Done
+			s.Done = done()
+			s.mutex.Unlock()
+			if !changed {
+				continue
+			}
+			if err := s.write(); err != nil {
+				logrus.WithFields(logrus.Fields{"error": err, "file": s.path}).Warn("cannot update the state file")
+			}
+		}
+	}()
+}
+
+func (s *runState) finish() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Deletes the state file, once the run is complete.
+func (s *runState) remove() {
+	os.Remove(s.path)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// Returns the orientation frames are rotated to, landscape or portrait.
+func parseOrientation(s string) (error, string) {
+	switch s = strings.ToLower(s); s {
+	case "landscape", "portrait":
+		return nil, s
+	}
+	return fmt.Errorf("invalid orientation %q, expected landscape or portrait", s), ""
+}
+
+// The EXIF orientations undone by turning the image clockwise, by degrees,
+// and by flipping it horizontally or vertically.
+var (
+	rotationOrientations = map[int]int{90: 6, 180: 3, 270: 8}
+	flipOrientations     = map[string]int{"h": 2, "v": 4}
+)
+
+// Returns the clockwise rotation of -rotate, in degrees.
+func parseRotation(degrees int) (error, int) {
+	if _, ok := rotationOrientations[degrees]; !ok && degrees != 0 {
+		return fmt.Errorf("invalid rotation %d, expected 90, 180 or 270", degrees), 0
+	}
+	return nil, degrees
+}
+
+// Returns the flip of -flip, h for horizontal (mirror) or v for vertical.
+func parseFlip(s string) (error, string) {
+	switch s = strings.ToLower(s); s {
+	case "", "h", "v":
+		return nil, s
+	}
+	return fmt.Errorf("invalid flip %q, expected h or v", s), ""
+}
+
+// Rotates the image clockwise by degrees, then flips it, for cameras mounted
+// sideways or shooting through a mirror.
+func turnImage(img image.Image, degrees int, flip string) image.Image {
+	if degrees != 0 {
+		img = applyExifOrientation(img, rotationOrientations[degrees])
+	}
+	if flip != "" {
+		img = applyExifOrientation(img, flipOrientations[flip])
+	}
+	return img
+}
+
+// Rotates the image by 90 degrees clockwise.
+func rotateImage(img image.Image) *image.RGBA {
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, h, w))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := src.PixOffset(x, y)
+			j := dst.PixOffset(h-1-y, x)
+			copy(dst.Pix[j:j+4], src.Pix[i:i+4])
+		}
+	}
+
+	return dst
+}
+
+// Rotates the frame if it does not have the target orientation, so that all
+// the frames of mixed portrait and landscape sets share the same one. Square
+// frames are left unchanged.
+func orientImage(img image.Image, orientation string) image.Image {
+	size := img.Bounds().Size()
+	portrait := size.Y > size.X
+	landscape := size.X > size.Y
+
+	if (orientation == "landscape" && portrait) || (orientation == "portrait" && landscape) {
+		return rotateImage(img)
+	}
+	return img
+}
+
+// Rotates and flips the image as the EXIF orientation tells, so that it is
+// upright: 2 mirrored, 3 upside down, 4 flipped, 5 transposed, 6 rotated
+// counterclockwise, 7 transversed and 8 rotated clockwise.
+func applyExifOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = w - 1 - x
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sy = h - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			i := src.PixOffset(sx, sy)
+			j := dst.PixOffset(x, y)
+			copy(dst.Pix[j:j+4], src.Pix[i:i+4])
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+type scrollOptions struct {
+	vertical  bool
+	viewport  image.Point // zero value means auto
+	numFrames int
+}
+
+// Parses a WxH size string.
+func parseSize(s string) (error, image.Point) {
+	parts := strings.Split(strings.ToLower(s), "x")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid size %q, expected WxH", s), image.Point{}
+	}
+
+	w, err := strconv.Atoi(parts[0])
+	if err != nil || w <= 0 {
+		return fmt.Errorf("invalid width in size %q", s), image.Point{}
+	}
+
+	h, err := strconv.Atoi(parts[1])
+	if err != nil || h <= 0 {
+		return fmt.Errorf("invalid height in size %q", s), image.Point{}
+	}
+
+	return nil, image.Pt(w, h)
+}
+
+func parseScrollOptions(direction, size string, numFrames uint) (error, *scrollOptions) {
+	opts := &scrollOptions{numFrames: int(numFrames)}
+
+	switch strings.ToLower(direction) {
+	case "v", "vertical":
+		opts.vertical = true
+	case "h", "horizontal":
+		opts.vertical = false
+	default:
+		return fmt.Errorf("invalid scroll direction %q", direction), nil
+	}
+
+	if size != "" {
+		err, viewport := parseSize(size)
+		if err != nil {
+			return err, nil
+		}
+		opts.viewport = viewport
+	}
+
+	if opts.numFrames < 1 {
+		return fmt.Errorf("need at least one scroll frame"), nil
+	}
+
+	return nil, opts
+}
+
+// Copies the r rectangle of img to a new image with origin at (0, 0).
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// Returns a source of frames panning a viewport across the image at path,
+// from the top (or left) edge to the bottom (or right) edge.
+func scrollSource(path string, opts *scrollOptions) (error, frameSource) {
+	err, img := decodeImage(path)
+	if err != nil {
+		return err, nil
+	}
+
+	b := img.Bounds()
+	viewport := opts.viewport
+	if viewport == (image.Point{}) {
+		side := b.Dx()
+		if b.Dy() < side {
+			side = b.Dy()
+		}
+		viewport = image.Pt(side, side)
+	}
+
+	if viewport.X > b.Dx() || viewport.Y > b.Dy() {
+		err := fmt.Errorf("viewport %dx%d is larger than the %dx%d image",
+			viewport.X, viewport.Y, b.Dx(), b.Dy())
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while scrolling image")
+		return err, nil
+	}
+
+	travel := b.Dx() - viewport.X
+	if opts.vertical {
+		travel = b.Dy() - viewport.Y
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"viewport": fmt.Sprintf("%dx%d", viewport.X, viewport.Y),
+		"travel":   travel,
+		"frames":   opts.numFrames,
+	}).Debug("scrolling image")
+
+	return nil, func(i int) (error, image.Image) {
+		offset := 0
+		if opts.numFrames > 1 {
+			offset = travel * i / (opts.numFrames - 1)
+		}
+
+		min := b.Min.Add(image.Pt(offset, 0))
+		if opts.vertical {
+			min = b.Min.Add(image.Pt(0, offset))
+		}
+
+		r := image.Rectangle{Min: min, Max: min.Add(viewport)}
+		return nil, cropImage(img, r)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How -max-frames drops the excess frames.
+const (
+	MAX_FRAMES_SAMPLE   = "sample"   // evenly across the whole range
+	MAX_FRAMES_TRUNCATE = "truncate" // at the end
+)
+
+// Options selecting a subset of the discovered frames, before any timing
+// option.
+type frameSelection struct {
+	start     string // first frame, as 1-based index or file name, "" for the first
+	end       string // last frame, as 1-based index or file name, "" for the last
+	every     int    // keep one frame every n, 0 or 1 for all
+	maxFrames int    // 0 for no limit
+	truncate  bool   // drop the frames beyond maxFrames, instead of sampling
+}
+
+func parseMaxFramesMode(mode string) (error, bool) {
+	switch mode {
+	case MAX_FRAMES_SAMPLE:
+		return nil, false
+	case MAX_FRAMES_TRUNCATE:
+		return nil, true
+	}
+	return fmt.Errorf("unknown max frames mode %q, expected %s or %s",
+		mode, MAX_FRAMES_SAMPLE, MAX_FRAMES_TRUNCATE), false
+}
+
+// Returns whether the selection keeps all the frames.
+func (s *frameSelection) all() bool {
+	return s.start == "" && s.end == "" && s.every <= 1 && s.maxFrames == 0
+}
+
+// Returns the 0-based index of the frame given as a 1-based index, or as the
+// path or name of its file.
+func findFrame(frame string, numFrames int, names []string) (error, int) {
+	if n, err := strconv.Atoi(frame); err == nil {
+		if n < 1 || n > numFrames {
+			return fmt.Errorf("frame %d is out of range, there are %d frames", n, numFrames), 0
+		}
+		return nil, n - 1
+	}
+
+	for i, name := range names {
+		if name == frame || filepath.Base(name) == frame {
+			return nil, i
+		}
+	}
+	if names == nil {
+		return fmt.Errorf("frame %q is not an index", frame), 0
+	}
+	return fmt.Errorf("frame %q not found", frame), 0
+}
+
+// Returns the indices of the selected frames among numFrames, whose file
+// names are names, or nil when they have none.
+func (s *frameSelection) indices(numFrames int, names []string) (error, []int) {
+	first, last := 0, numFrames-1
+	if s.start != "" {
+		var err error
+		if err, first = findFrame(s.start, numFrames, names); err != nil {
+			return fmt.Errorf("invalid -start: %v", err), nil
+		}
+	}
+	if s.end != "" {
+		var err error
+		if err, last = findFrame(s.end, numFrames, names); err != nil {
+			return fmt.Errorf("invalid -end: %v", err), nil
+		}
+	}
+	if first > last {
+		return fmt.Errorf("-start frame %d is after the -end frame %d", first+1, last+1), nil
+	}
+
+	every := s.every
+	if every < 1 {
+		every = 1
+	}
+
+	var indices []int
+	for i := first; i <= last; i += every {
+		indices = append(indices, i)
+	}
+
+	if s.maxFrames > 0 && len(indices) > s.maxFrames {
+		logrus.WithFields(logrus.Fields{
+			"frames":  len(indices),
+			"dropped": len(indices) - s.maxFrames,
+		}).Info("too many frames for -max-frames")
+
+		if s.truncate {
+			indices = indices[:s.maxFrames]
+		} else {
+			var kept []int
+			for _, i := range evenlySample(len(indices), s.maxFrames) {
+				kept = append(kept, indices[i])
+			}
+			indices = kept
+		}
+	}
+	return nil, indices
+}
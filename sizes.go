@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Default naming of the outputs of -sizes, next to the -o one.
+const DEFAULT_SIZES_TEMPLATE = "{base}-{width}.{ext}"
+
+// Parses the comma separated widths of -sizes.
+func parseWidths(spec string) (error, []int) {
+	var widths []int
+	seen := make(map[int]bool)
+	for _, s := range strings.Split(spec, ",") {
+		w, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || w <= 0 {
+			return fmt.Errorf("invalid width %q", s), nil
+		}
+		if seen[w] {
+			return fmt.Errorf("duplicate width %d", w), nil
+		}
+		seen[w] = true
+		widths = append(widths, w)
+	}
+	return nil, widths
+}
+
+// The pipelines of -sizes: the stages before resize, shared by all the sizes,
+// then those of each size, from resize on.
+type sizedPipeline struct {
+	shared pipeline
+	sizes  []pipeline
+}
+
+// Returns the pipelines resizing the frames to each of the widths, with
+// the resize stage at index of p.
+func newSizedPipeline(p pipeline, index int, widths []int, filter *resampleFilter) *sizedPipeline {
+	sp := &sizedPipeline{shared: p[:index]}
+	for _, width := range widths {
+		resize := &resizeOptions{width: width, filter: filter}
+		stages := append(pipeline{func(img image.Image, frame *frameInfo) image.Image {
+			// The frame is shared by all the sizes, and the next stages
+			// may draw on it.
+			if resize.size(img.Bounds().Size()) == img.Bounds().Size() {
+				return cropImage(img, img.Bounds())
+			}
+			return resizeFrame(img, resize)
+		}}, p[index+1:]...)
+		sp.sizes = append(sp.sizes, stages)
+	}
+	return sp
+}
+
+// Runs the numFrames frames of source through the pipelines of all the sizes,
+// decoding each frame and running the shared stages once. Returns the frames of
+// each size, before quantize if fullColor, or quantized.
+func processSizedFrames(numFrames int, source frameSource, sp *sizedPipeline, fullColor bool) ([][]image.Image, [][]*image.Paletted) {
+	fullColorFrames := make([][]image.Image, len(sp.sizes))
+	frames := make([][]*image.Paletted, len(sp.sizes))
+	for k := range sp.sizes {
+		if fullColor {
+			fullColorFrames[k] = make([]image.Image, numFrames)
+		} else {
+			frames[k] = make([]*image.Paletted, numFrames)
+		}
+	}
+
+	runFrameJobs(numFrames, "processing frames", func(i int) {
+		err, img := source(i)
+		if err != nil {
+			return
+		}
+		frame := &frameInfo{index: i, total: numFrames}
+		for _, t := range sp.shared {
+			img = t(img, frame)
+		}
+
+		for k, stages := range sp.sizes {
+			if fullColor {
+				stages = stages[:len(stages)-1]
+			}
+			sized := img
+			for _, t := range stages {
+				sized = t(sized, frame)
+			}
+			if fullColor {
+				fullColorFrames[k][i] = sized
+			} else {
+				frames[k][i] = sized.(*image.Paletted)
+			}
+		}
+	})
+
+	return fullColorFrames, frames
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of frames, evenly spread, analyzed to place the smart crop.
+	SMART_CROP_SAMPLES = 8
+	// Larger side of the analyzed frames, downscaled for speed.
+	SMART_CROP_ANALYSIS_SIDE = 256
+)
+
+// Returns the edge energy of each pixel of img, the sum of its horizontal and
+// vertical luma gradients: high in detailed areas, low in flat ones (sky,
+// walls, blurred background).
+func edgeEnergy(img *image.RGBA) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	luma := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(x, y)
+			luma[y*w+x] = 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+		}
+	}
+
+	energy := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := 0.0, 0.0
+			if x+1 < w {
+				dx = math.Abs(luma[y*w+x+1] - luma[y*w+x])
+			}
+			if y+1 < h {
+				dy = math.Abs(luma[(y+1)*w+x] - luma[y*w+x])
+			}
+			energy[y*w+x] = dx + dy
+		}
+	}
+	return energy
+}
+
+// Returns the w x h window of the energy map, of size mapSize, with the
+// highest energy. Ties go to the window closest to the center.
+func bestWindow(energy []float64, mapSize image.Point, w, h int) image.Point {
+	mw, mh := mapSize.X, mapSize.Y
+
+	// Summed area table, with a zero first row and column.
+	sat := make([]float64, (mw+1)*(mh+1))
+	for y := 0; y < mh; y++ {
+		row := 0.0
+		for x := 0; x < mw; x++ {
+			row += energy[y*mw+x]
+			sat[(y+1)*(mw+1)+x+1] = sat[y*(mw+1)+x+1] + row
+		}
+	}
+
+	best, bestSum, bestDist := image.Point{}, -1.0, 0
+	cx, cy := (mw-w)/2, (mh-h)/2
+	for y := 0; y+h <= mh; y++ {
+		for x := 0; x+w <= mw; x++ {
+			sum := sat[(y+h)*(mw+1)+x+w] - sat[y*(mw+1)+x+w] - sat[(y+h)*(mw+1)+x] + sat[y*(mw+1)+x]
+			dist := (x-cx)*(x-cx) + (y-cy)*(y-cy)
+			if sum > bestSum || (sum == bestSum && dist < bestDist) {
+				best, bestSum, bestDist = image.Pt(x, y), sum, dist
+			}
+		}
+	}
+	return best
+}
+
+// Returns the crop area of the given size keeping the most detailed region
+// across the numFrames frames of source, after they went through the stages
+// before the crop one. The area is the same for the whole sequence, so that
+// the frames stay aligned. The frames of another size than the first one are
+// not analyzed.
+func computeSmartCrop(numFrames int, source frameSource, stages pipeline, size image.Point) (error, image.Rectangle) {
+	samples := evenlySample(numFrames, SMART_CROP_SAMPLES)
+	analyzed := make([]*image.RGBA, len(samples))
+	var frameSize image.Point
+
+	runFrameJobs(len(samples), "analyzing frames for the smart crop", func(i int) {
+		err, img := source(samples[i])
+		if err != nil {
+			return
+		}
+
+		frame := &frameInfo{index: samples[i], total: numFrames}
+		for _, t := range stages {
+			img = t(img, frame)
+		}
+		analyzed[i] = toRGBA(img)
+	})
+
+	var energy []float64
+	var mapSize image.Point
+	scale := 1.0
+	for i, img := range analyzed {
+		if img == nil {
+			continue
+		}
+		if energy == nil {
+			frameSize = img.Rect.Size()
+			scale = math.Max(1, float64(maxInt(frameSize.X, frameSize.Y))/SMART_CROP_ANALYSIS_SIDE)
+			mapSize = image.Pt(int(float64(frameSize.X)/scale), int(float64(frameSize.Y)/scale))
+			energy = make([]float64, mapSize.X*mapSize.Y)
+		}
+		if img.Rect.Size() != frameSize {
+			logrus.WithField("frame", samples[i]+1).Debug("frame size differs from the first one, not analyzed")
+			continue
+		}
+
+		small := img
+		if scale > 1 {
+			small = resampleImage(img, mapSize.X, mapSize.Y, resampleFilters["bilinear"])
+		}
+		for j, e := range edgeEnergy(small) {
+			energy[j] += e
+		}
+	}
+	if energy == nil {
+		return errNoImages, image.Rectangle{}
+	}
+
+	// The window, clamped to the frame, in the downscaled map.
+	w, h := minInt(size.X, frameSize.X), minInt(size.Y, frameSize.Y)
+	mw, mh := minInt(mapSize.X, int(math.Round(float64(w)/scale))), minInt(mapSize.Y, int(math.Round(float64(h)/scale)))
+	pos := bestWindow(energy, mapSize, maxInt(mw, 1), maxInt(mh, 1))
+
+	x := minInt(int(math.Round(float64(pos.X)*scale)), frameSize.X-w)
+	y := minInt(int(math.Round(float64(pos.Y)*scale)), frameSize.Y-h)
+	// Rounding must not move a window against an edge away from it.
+	if pos.X+mw >= mapSize.X {
+		x = frameSize.X - w
+	}
+	if pos.Y+mh >= mapSize.Y {
+		y = frameSize.Y - h
+	}
+	crop := image.Rect(x, y, x+w, y+h)
+	logrus.WithField("crop", crop).Info("smart crop area")
+	return nil, crop
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/marcov/giffer/pkg/giffer"
+	"github.com/sirupsen/logrus"
+)
+
+// Processed frames kept in a temporary file instead of memory: only their
+// pixels, as their palettes are, most often, the global one.
+type frameSpill struct {
+	file   *os.File
+	mutex  sync.Mutex
+	size   int64
+	frames []*spilledFrame // nil for those not stored
+}
+
+type spilledFrame struct {
+	offset      int64
+	rect        image.Rectangle
+	palette     color.Palette
+	transparent bool // some pixels are
+}
+
+// Creates the spill file of numFrames frames in dir.
+func newFrameSpill(dir string, numFrames int) (error, *frameSpill) {
+	file, err := ioutil.TempFile(dir, "giffer-frames-")
+	if err != nil {
+		return err, nil
+	}
+	return nil, &frameSpill{file: file, frames: make([]*spilledFrame, numFrames)}
+}
+
+// Stores the i-th frame, from any goroutine.
+func (s *frameSpill) put(i int, pm *image.Paletted) error {
+	w, h := pm.Rect.Dx(), pm.Rect.Dy()
+	s.mutex.Lock()
+	offset := s.size
+	s.size += int64(w * h)
+	s.mutex.Unlock()
+
+	for y := 0; y < h; y++ {
+		row := pm.Pix[y*pm.Stride : y*pm.Stride+w]
+		if _, err := s.file.WriteAt(row, offset+int64(y*w)); err != nil {
+			return err
+		}
+	}
+
+	frame := &spilledFrame{offset: offset, rect: pm.Rect, palette: pm.Palette, transparent: giffer.UsesTransparency(pm)}
+	s.mutex.Lock()
+	s.frames[i] = frame
+	s.mutex.Unlock()
+	return nil
+}
+
+// Reads back the i-th frame.
+func (s *frameSpill) get(i int) (error, *image.Paletted) {
+	frame := s.frames[i]
+	pm := &image.Paletted{
+		Pix:     make([]uint8, frame.rect.Dx()*frame.rect.Dy()),
+		Stride:  frame.rect.Dx(),
+		Rect:    frame.rect,
+		Palette: frame.palette,
+	}
+	if _, err := s.file.ReadAt(pm.Pix, frame.offset); err != nil {
+		return err, nil
+	}
+	return nil, pm
+}
+
+// Deletes the spill file.
+func (s *frameSpill) remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// Runs the numFrames frames of source through the pipeline into a spill file
+// in dir, then writes them from it in order, with only one frame in memory,
+// delta encoded with -delta. Unlike streamGif, the frames are all known before
+// writing the first one, as delta encoding needs.
+func spillGif(w *frameWriter, dir string, numFrames int, source frameSource, p pipeline, delays []int, delta bool) error {
+	err, spill := newFrameSpill(dir, numFrames)
+	if err != nil {
+		return err
+	}
+	defer spill.remove()
+
+	var spillErr error
+	var errOnce sync.Once
+	runFrameJobs(numFrames, "processing frames to the spill file", func(i int) {
+		err, img := source(i)
+		if err != nil {
+			return
+		}
+		if err := spill.put(i, p.apply(img, &frameInfo{index: i, total: numFrames})); err != nil {
+			errOnce.Do(func() { spillErr = err })
+		}
+	})
+	if spillErr != nil {
+		return spillErr
+	}
+
+	var screen image.Rectangle
+	failed, transparent := 0, false
+	for _, frame := range spill.frames {
+		if frame == nil {
+			failed++
+			continue
+		}
+		screen = screen.Union(frame.rect)
+		transparent = transparent || frame.transparent
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d frames could not be read", failed, numFrames)
+	}
+
+	if delta && transparent {
+		logrus.Warn("frames with transparent pixels cannot be delta encoded, -delta ignored")
+	} else if delta {
+		w.delta = giffer.NewDeltaEncoder(screen.Max.X, screen.Max.Y, w.enc.Palette)
+		if w.delta.Palette != nil {
+			w.enc.Palette = w.delta.Palette
+		}
+		w.enc.Disposal = gif.DisposalNone
+	}
+
+	logrus.WithField("num of frames", numFrames).Info("Encoding frames from the spill file")
+	progress := startProgress(numFrames, progressEvery)
+	defer progress.finish()
+	for i := 0; i < numFrames; i++ {
+		err, frame := spill.get(i)
+		if err != nil {
+			return err
+		}
+		if err := w.write(frame, nil, delays[i]); err != nil {
+			return err
+		}
+		progress.increment()
+	}
+	return w.close()
+}
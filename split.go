@@ -0,0 +1,128 @@
+package main
+
+import (
+	"image"
+	"image/gif"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default naming of the parts of a split output, next to the -o one.
+const DEFAULT_SPLIT_TEMPLATE = "{base}-{index:03d}.{ext}"
+
+// Options of -split-size and -split-frames. Each part of the output is as long
+// as both limits allow.
+type splitOptions struct {
+	size   int64 // bytes, 0 for no limit
+	frames int   // 0 for no limit
+	names  *outputTemplate
+	finish func(*gif.GIF) // sets the disposal of the frames of each part
+}
+
+func (a *animation) numFrames() int {
+	return len(a.Delay)
+}
+
+// Returns the animation of the frames i to j, excluded, not finished.
+func (a *animation) slice(i, j int) *animation {
+	g := *a.GIF
+	if g.Image != nil {
+		g.Image = append([]*image.Paletted(nil), g.Image[i:j]...)
+	}
+	g.Delay = append([]int(nil), g.Delay[i:j]...)
+	g.Disposal = nil
+	part := &animation{GIF: &g}
+	if a.fullColor != nil {
+		part.fullColor = a.fullColor[i:j]
+	}
+	return part
+}
+
+// Returns the part of the frames i to j of the animation, finished, and its
+// size once encoded in format.
+func (opts *splitOptions) part(anim *animation, i, j int, format *outputFormat) (error, *animation, int64) {
+	part := anim.slice(i, j)
+	if part.Image != nil {
+		opts.finish(part.GIF)
+	}
+	if opts.size == 0 {
+		return nil, part, 0
+	}
+	var size byteCounter
+	err := format.encode(&size, part)
+	return err, part, int64(size)
+}
+
+// Splits the animation, not finished, in consecutive parts within the limits,
+// once encoded in format. Each part starts with a whole frame, and plays
+// alone.
+func splitAnimation(anim *animation, opts *splitOptions, format *outputFormat) (error, []*animation) {
+	var parts []*animation
+	n := anim.numFrames()
+	for start := 0; start < n; {
+		end := n
+		if opts.frames > 0 {
+			end = minInt(n, start+opts.frames)
+		}
+
+		// The largest part fitting the size, as it grows with the frames.
+		var searchErr error
+		if opts.size > 0 {
+			end = start + 1 + sort.Search(end-start-1, func(k int) bool {
+				err, _, size := opts.part(anim, start, start+k+2, format)
+				if err != nil {
+					searchErr = err
+					return true
+				}
+				return size > opts.size
+			})
+		}
+		if searchErr != nil {
+			return searchErr, nil
+		}
+
+		err, part, size := opts.part(anim, start, end, format)
+		if err != nil {
+			return err, nil
+		}
+		if opts.size > 0 && size > opts.size {
+			logrus.WithFields(logrus.Fields{
+				"frame": start,
+				"size":  size,
+			}).Warn("a single frame exceeds the split size")
+		}
+		parts = append(parts, part)
+		start = end
+	}
+	return nil, parts
+}
+
+// Returns the paths of the numParts parts of the outfile output in format,
+// after checking that they are new files, or removing them if replace.
+func (opts *splitOptions) partPaths(outfile string, format *outputFormat, numParts int, replace bool) (error, []string) {
+	base := strings.TrimSuffix(filepath.Base(outfile), filepath.Ext(outfile))
+	paths := make([]string, numParts)
+	for i := range paths {
+		paths[i] = opts.names.render(&outputNameVars{base: base, index: i + 1, ext: format.ext()})
+	}
+	if err := checkOutputConflicts(paths); err != nil {
+		logrus.WithField("error", err).Error("conflicting output file names")
+		return err, nil
+	}
+	return checkNewOutputs(paths, replace), paths
+}
+
+// Checks, before the build, that the first parts of the outfiles outputs in
+// each of the formats, always written, are new files, or removes them if
+// replace. The next parts are checked once their number is known.
+func (opts *splitOptions) checkFirstParts(outfiles []string, formats []*outputFormat, replace bool) error {
+	for i, f := range formats {
+		if err, _ := opts.partPaths(outfiles[i], f, 1, replace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/marcov/giffer/pkg/giffer"
+)
+
+// Set by -sprite-columns: the number of columns of the sprite sheet grid, 0
+// for a square-ish one.
+var spriteColumns = 0
+
+// The descriptor of a sprite sheet, written next to it as JSON.
+type spriteSheet struct {
+	Image       string        `json:"image"` // file name, in the same directory
+	Width       int           `json:"width"`
+	Height      int           `json:"height"`
+	FrameWidth  int           `json:"frameWidth"`
+	FrameHeight int           `json:"frameHeight"`
+	Columns     int           `json:"columns"`
+	Rows        int           `json:"rows"`
+	Plays       int           `json:"plays"` // 0 for forever
+	Frames      []spriteFrame `json:"frames"`
+}
+
+// A frame of the sprite sheet: its cell, in playback order.
+type spriteFrame struct {
+	X       int `json:"x"`
+	Y       int `json:"y"`
+	DelayMs int `json:"delay"`
+}
+
+// Returns the layout of the frames of the animation in the grid of the sprite
+// sheet image, each one in a cell of the size of the screen.
+func spriteSheetLayout(anim *animation, file string) *spriteSheet {
+	n := len(anim.fullColor)
+	columns := spriteColumns
+	if columns <= 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(n))))
+	}
+	columns = minInt(columns, n)
+	rows := (n + columns - 1) / columns
+
+	sheet := &spriteSheet{
+		Image:       file,
+		FrameWidth:  anim.Config.Width,
+		FrameHeight: anim.Config.Height,
+		Columns:     columns,
+		Rows:        rows,
+		Plays:       playCount(anim.LoopCount),
+	}
+	sheet.Width, sheet.Height = columns*sheet.FrameWidth, rows*sheet.FrameHeight
+	for i := 0; i < n; i++ {
+		sheet.Frames = append(sheet.Frames, spriteFrame{
+			X:       i % columns * sheet.FrameWidth,
+			Y:       i / columns * sheet.FrameHeight,
+			DelayMs: anim.Delay[i] * 10,
+		})
+	}
+	return sheet
+}
+
+// Encodes the frames of the animation, before quantization, tiled in a single
+// PNG image.
+func encodeSpriteSheet(w io.Writer, anim *animation) error {
+	if len(anim.fullColor) == 0 {
+		return giffer.ErrNoFrames
+	}
+
+	sheet := spriteSheetLayout(anim, "")
+	img := image.NewNRGBA(image.Rect(0, 0, sheet.Width, sheet.Height))
+	for i, frame := range anim.fullColor {
+		b := frame.Bounds()
+		cell := image.Pt(sheet.Frames[i].X, sheet.Frames[i].Y)
+		draw.Draw(img, b.Add(cell), frame, b.Min, draw.Src)
+	}
+	return png.Encode(w, img)
+}
+
+var notCssIdent = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Returns the CSS class name of the sprite sheet of base name, which must not
+// start with a digit.
+func spriteSheetClass(base string) string {
+	name := notCssIdent.ReplaceAllString(base, "-")
+	if name == "" || name[0] >= '0' && name[0] <= '9' || name[0] == '-' {
+		name = "sprite-" + name
+	}
+	return name
+}
+
+// Writes the JSON and CSS descriptors of the sprite sheet at outfile, next to
+// it, with its base name.
+func writeSpriteSheetDescriptors(outfile string, anim *animation) error {
+	base := strings.TrimSuffix(outfile, filepath.Ext(outfile))
+	sheet := spriteSheetLayout(anim, filepath.Base(outfile))
+
+	data, err := json.MarshalIndent(sheet, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(base+".json", append(data, '\n'), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.Create(base + ".css")
+	if err != nil {
+		return err
+	}
+	writeSpriteSheetCss(f, sheet, spriteSheetClass(filepath.Base(base)))
+	return f.Close()
+}
+
+// Writes the CSS animation of the sprite sheet, on the elements of the class
+// name: each keyframe shows a cell until the next one.
+func writeSpriteSheetCss(w io.Writer, sheet *spriteSheet, name string) {
+	total := 0
+	for _, frame := range sheet.Frames {
+		total += frame.DelayMs
+	}
+	iterations := "infinite"
+	if sheet.Plays > 0 {
+		iterations = fmt.Sprint(sheet.Plays)
+	}
+
+	fmt.Fprintf(w, ".%s {\n", name)
+	fmt.Fprintf(w, "  width: %dpx;\n  height: %dpx;\n", sheet.FrameWidth, sheet.FrameHeight)
+	fmt.Fprintf(w, "  background: url(%q) no-repeat;\n", sheet.Image)
+	fmt.Fprintf(w, "  animation: %s-frames %dms step-end %s;\n}\n\n", name, maxInt(total, 1), iterations)
+
+	fmt.Fprintf(w, "@keyframes %s-frames {\n", name)
+	elapsed := 0
+	for _, frame := range sheet.Frames {
+		percent := 0.0
+		if total > 0 {
+			percent = 100 * float64(elapsed) / float64(total)
+		}
+		fmt.Fprintf(w, "  %.3f%% { background-position: %dpx %dpx; }\n", percent, -frame.X, -frame.Y)
+		elapsed += frame.DelayMs
+	}
+	fmt.Fprintf(w, "}\n")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Larger side of the frames compared to estimate the camera motion,
+	// downscaled for speed.
+	STABILIZE_ANALYSIS_SIDE = 128
+	// Largest motion between two frames, as a fraction of the analyzed side.
+	STABILIZE_MAX_SHIFT = 0.125
+)
+
+// Options of the stabilize stage.
+type stabilizeOptions struct {
+	crops []image.Rectangle // of each frame, in playback order, set for each build
+}
+
+// Returns the luma of the pixels of img, on a map of the given size.
+func lumaMap(img image.Image, size image.Point) []float64 {
+	small := resampleImage(img, size.X, size.Y, resampleFilters["bilinear"])
+	luma := make([]float64, size.X*size.Y)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			i := small.PixOffset(x, y)
+			luma[y*size.X+x] = 0.299*float64(small.Pix[i]) + 0.587*float64(small.Pix[i+1]) + 0.114*float64(small.Pix[i+2])
+		}
+	}
+	return luma
+}
+
+// Returns the shift of the content of cur from prev, luma maps of the given
+// size: cur at p + shift matches prev at p. The shift minimizes the mean
+// absolute difference of the overlapping pixels.
+func estimateShift(prev, cur []float64, size image.Point, maxShift int) image.Point {
+	best, bestDiff := image.Point{}, math.Inf(1)
+	for sy := -maxShift; sy <= maxShift; sy++ {
+		for sx := -maxShift; sx <= maxShift; sx++ {
+			x0, x1 := maxInt(0, -sx), minInt(size.X, size.X-sx)
+			y0, y1 := maxInt(0, -sy), minInt(size.Y, size.Y-sy)
+
+			sum := 0.0
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					sum += math.Abs(cur[(y+sy)*size.X+x+sx] - prev[y*size.X+x])
+				}
+			}
+			diff := sum / float64((x1-x0)*(y1-y0))
+			// Ties go to the smallest motion.
+			if diff < bestDiff || (diff == bestDiff && sx*sx+sy*sy < best.X*best.X+best.Y*best.Y) {
+				best, bestDiff = image.Pt(sx, sy), diff
+			}
+		}
+	}
+	return best
+}
+
+// Sets the crop areas aligning the numFrames frames of source, after they
+// went through the stages before the stabilize one, on the first frame. The
+// motion between consecutive frames is a translation: camera rotation is not
+// corrected. All the areas have the size of the part of the scene seen by all
+// the frames, so the frames shrink by the amplitude of the motion. The frames
+// of another size than the first one are cropped without being moved.
+func (opts *stabilizeOptions) compute(numFrames int, source frameSource, stages pipeline) {
+	lumas := make([][]float64, numFrames)
+	sizes := make([]image.Point, numFrames)
+
+	runFrameJobs(numFrames, "analyzing frames motion for the stabilization", func(i int) {
+		err, img := source(i)
+		if err != nil {
+			return
+		}
+
+		frame := &frameInfo{index: i, total: numFrames}
+		for _, t := range stages {
+			img = t(img, frame)
+		}
+		sizes[i] = img.Bounds().Size()
+		lumas[i] = lumaMap(img, analysisSize(sizes[i], STABILIZE_ANALYSIS_SIDE))
+	})
+
+	opts.crops = nil
+	if numFrames == 0 || lumas[0] == nil {
+		return
+	}
+	frameSize := sizes[0]
+	mapSize := analysisSize(frameSize, STABILIZE_ANALYSIS_SIDE)
+	scaleX := float64(frameSize.X) / float64(mapSize.X)
+	scaleY := float64(frameSize.Y) / float64(mapSize.Y)
+	maxShift := maxInt(1, int(STABILIZE_MAX_SHIFT*float64(maxInt(mapSize.X, mapSize.Y))))
+
+	// Position of each frame content relative to the first frame, in pixels.
+	offsets := make([]image.Point, numFrames)
+	var motion image.Point
+	prev := lumas[0]
+	for i := 1; i < numFrames; i++ {
+		if lumas[i] == nil {
+			continue
+		}
+		if sizes[i] != frameSize {
+			logrus.WithField("frame", i+1).Debug("frame size differs from the first one, not stabilized")
+			continue
+		}
+		motion = motion.Add(estimateShift(prev, lumas[i], mapSize, maxShift))
+		offsets[i] = image.Pt(int(math.Round(float64(motion.X)*scaleX)), int(math.Round(float64(motion.Y)*scaleY)))
+		prev = lumas[i]
+	}
+
+	var min, max image.Point
+	for _, o := range offsets {
+		min = image.Pt(minInt(min.X, o.X), minInt(min.Y, o.Y))
+		max = image.Pt(maxInt(max.X, o.X), maxInt(max.Y, o.Y))
+	}
+	common := image.Rect(-min.X, -min.Y, frameSize.X-max.X, frameSize.Y-max.Y)
+	if common.Empty() {
+		logrus.Warn("the camera moves across the whole frame, cannot stabilize")
+		return
+	}
+	logrus.WithField("size", common.Size()).Info("stabilized frame size")
+
+	opts.crops = make([]image.Rectangle, numFrames)
+	for i, o := range offsets {
+		opts.crops[i] = common.Add(o)
+	}
+}
+
+// Returns the size of the luma maps of frames of the given size, downscaled
+// to side on their larger side.
+func analysisSize(size image.Point, side int) image.Point {
+	scale := math.Max(1, float64(maxInt(size.X, size.Y))/float64(side))
+	return image.Pt(maxInt(1, int(float64(size.X)/scale)), maxInt(1, int(float64(size.Y)/scale)))
+}
+
+// Crops the frame to its area aligned on the first frame.
+func stabilizeFrame(img image.Image, frame *frameInfo, opts *stabilizeOptions) image.Image {
+	if frame.index >= len(opts.crops) {
+		return img
+	}
+	return cropFrame(img, opts.crops[frame.index])
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"github.com/marcov/giffer/pkg/giffer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+)
+
+// Number of frames per job processed ahead of the frame being encoded.
+const STREAM_WINDOW = 2
+
+// Encodes the frames given in order, folding those that same (nil to keep
+// them all) finds the same as the previous frame into it, and delta encoding
+// them with delta, if not nil.
+type frameWriter struct {
+	enc   *giffer.StreamEncoder
+	same  func(a, b *image.Paletted) bool
+	delta *giffer.DeltaEncoder
+
+	pending *image.Paletted // the last frame, its delay growing with the folded ones
+	encoded *giffer.EncodedFrame
+	delay   int
+	frames  int
+	folded  int
+}
+
+func (w *frameWriter) flush() error {
+	if w.pending == nil {
+		return nil
+	}
+	frame, encoded := w.pending, w.encoded
+	w.pending, w.encoded = nil, nil
+	if w.delta != nil {
+		return w.enc.Encode(w.delta.Frame(frame), w.delay)
+	}
+	if encoded == nil {
+		return w.enc.Encode(frame, w.delay)
+	}
+	return w.enc.WriteFrame(encoded, w.delay)
+}
+
+// Writes the frame, already compressed as encoded, unless nil. Frames that
+// are delta encoded are compressed once delta encoded.
+func (w *frameWriter) write(frame *image.Paletted, encoded *giffer.EncodedFrame, delay int) error {
+	w.frames++
+	if w.pending != nil && w.same != nil && w.same(w.pending, frame) {
+		w.delay += delay
+		w.folded++
+		return nil
+	}
+	err := w.flush()
+	w.pending, w.encoded, w.delay = frame, encoded, delay
+	return err
+}
+
+// Encodes the last frame, and completes the gif.
+func (w *frameWriter) close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.enc.Close(); err != nil {
+		return err
+	}
+	if w.folded > 0 {
+		logrus.WithFields(logrus.Fields{
+			"dropped": w.folded,
+			"frames":  w.frames - w.folded,
+		}).Info("folded duplicate frames")
+	}
+	return nil
+}
+
+// Runs the numFrames frames of source through the pipeline, and writes them
+// as they complete, in order: only the frames being processed, and those
+// waiting for the frames before them, are held, instead of all of them. The
+// frames are compressed in parallel too.
+func streamGif(w *frameWriter, numFrames int, source frameSource, p pipeline, delays []int) error {
+	sem := semaphore.NewWeighted(int64(frameJobs))
+	window := semaphore.NewWeighted(int64(frameJobs * STREAM_WINDOW))
+
+	logrus.WithFields(logrus.Fields{
+		"// jobs":       frameJobs,
+		"num of frames": numFrames,
+	}).Info("Parallel processing and encoding frames")
+
+	progress := startProgress(numFrames, progressEvery)
+
+	type processed struct {
+		frame   *image.Paletted // nil if it could not be read
+		encoded *giffer.EncodedFrame
+		err     error
+	}
+	done := make([]chan processed, numFrames)
+	for i := range done {
+		done[i] = make(chan processed, 1)
+	}
+	go func() {
+		for i := 0; i < numFrames; i++ {
+			// Frames are started in order, the window slots being freed as
+			// they are encoded.
+			_ = window.Acquire(context.Background(), 1)
+			go func(i int) {
+				_ = sem.Acquire(context.Background(), 1)
+				defer sem.Release(1)
+
+				var result processed
+				if err, img := source(i); err == nil {
+					result.frame = p.apply(img, &frameInfo{index: i, total: numFrames})
+					result.err, result.encoded = w.enc.EncodeFrame(result.frame)
+				}
+				done[i] <- result
+			}(i)
+		}
+	}()
+
+	failed := 0
+	var err error
+	for i := range done {
+		result := <-done[i]
+		window.Release(1)
+		progress.increment()
+
+		switch {
+		case result.frame == nil:
+			failed++
+		case failed > 0 || err != nil:
+			// Nothing more is written, the remaining frames are waited for.
+		case result.err != nil:
+			err = result.err
+		default:
+			err = w.write(result.frame, result.encoded, delays[i])
+		}
+	}
+	progress.finish()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d frames could not be read", failed, numFrames)
+	}
+	if err != nil {
+		return err
+	}
+	return w.close()
+}
+
+// Creates the outfile path for build to stream the gif to, and returns the
+// hex encoded SHA-256 of the written file. The partial file is removed if
+// build fails.
+func writeStreamedOutput(outfile string, build func(*os.File) error) (error, string) {
+	outFile, err := os.OpenFile(outfile, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "format": "gif"}).Error("While creating output file")
+		return err, ""
+	}
+
+	defer outFile.Close()
+	if err := build(outFile); err != nil {
+		outFile.Close()
+		os.Remove(outfile)
+		return err, ""
+	}
+
+	hash := sha256.New()
+	if _, err := outFile.Seek(0, io.SeekStart); err != nil {
+		return err, ""
+	}
+	if _, err := io.Copy(hash, outFile); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": outfile}).Error("While reading the output file checksum")
+		return err, ""
+	}
+	return nil, hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A subtitle of a SRT file.
+type subtitle struct {
+	start, end time.Duration
+	lines      []string
+}
+
+// Options of the subtitles overlay.
+type subtitleOptions struct {
+	subtitles []subtitle
+	position  string // "tc" or "bc", top or bottom center
+	color     color.Color
+	lines     [][]string // of each frame, in playback order, set for each build
+}
+
+var (
+	srtTiming = regexp.MustCompile(`^(\d+):(\d\d):(\d\d)[,.](\d{1,3})\s*-->\s*(\d+):(\d\d):(\d\d)[,.](\d{1,3})`)
+	// Formatting tags, like <i> or {\an8}, not rendered by the font.
+	srtTag = regexp.MustCompile(`<[^>]*>|\{\\[^}]*\}`)
+)
+
+func parseSrtTime(parts []string) time.Duration {
+	h, _ := strconv.Atoi(parts[0])
+	m, _ := strconv.Atoi(parts[1])
+	s, _ := strconv.Atoi(parts[2])
+	ms, _ := strconv.Atoi((parts[3] + "00")[:3])
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second + time.Duration(ms)*time.Millisecond
+}
+
+// Reads the subtitles of a SRT file: blocks of an index line, a timing line,
+// like "00:00:01,500 --> 00:00:04,000", and text lines, ending with an empty
+// line.
+func readSrt(r io.Reader) (error, []subtitle) {
+	var subtitles []subtitle
+	var current *subtitle
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		switch {
+		case text == "":
+			current = nil
+		case current == nil:
+			m := srtTiming.FindStringSubmatch(text)
+			if m == nil {
+				if _, err := strconv.Atoi(text); err == nil {
+					continue // index
+				}
+				return fmt.Errorf("line %d: expected a subtitle timing, got %q", line, text), nil
+			}
+			subtitles = append(subtitles, subtitle{start: parseSrtTime(m[1:5]), end: parseSrtTime(m[5:9])})
+			current = &subtitles[len(subtitles)-1]
+		default:
+			if text = strings.TrimSpace(srtTag.ReplaceAllString(text, "")); text != "" {
+				current.lines = append(current.lines, text)
+			}
+		}
+	}
+	return scanner.Err(), subtitles
+}
+
+func parseSubtitleOptions(path, position, textColor string) (error, *subtitleOptions) {
+	switch position = strings.ToLower(position); position {
+	case "top":
+		position = "tc"
+	case "bottom":
+		position = "bc"
+	default:
+		return fmt.Errorf("invalid subtitles position %q, expected top or bottom", position), nil
+	}
+
+	err, c := parseColor(textColor)
+	if err != nil {
+		return err, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err, nil
+	}
+	defer f.Close()
+
+	err, subtitles := readSrt(f)
+	if err != nil {
+		return err, nil
+	}
+	if len(subtitles) == 0 {
+		return fmt.Errorf("no subtitles in %s", path), nil
+	}
+	return nil, &subtitleOptions{subtitles: subtitles, position: position, color: c}
+}
+
+// Places the subtitles on the frames, shown for the given delays: a frame
+// shows the subtitles overlapping its play time.
+func (opts *subtitleOptions) place(delays []int) {
+	opts.lines = make([][]string, len(delays))
+	used := make([]bool, len(opts.subtitles))
+
+	var start time.Duration
+	for i, delay := range delays {
+		end := start + time.Duration(delay)*10*time.Millisecond
+		for k, sub := range opts.subtitles {
+			if sub.start < end && sub.end > start {
+				opts.lines[i] = append(opts.lines[i], sub.lines...)
+				used[k] = true
+			}
+		}
+		start = end
+	}
+
+	for k, sub := range opts.subtitles {
+		if !used[k] {
+			logrus.WithFields(logrus.Fields{"start": sub.start, "end": sub.end}).Warn("subtitle after the end of the gif, not shown")
+		}
+	}
+}
+
+// Draws the subtitles of the frame, centered.
+func drawSubtitles(img image.Image, frame *frameInfo, opts *subtitleOptions) image.Image {
+	if frame.index >= len(opts.lines) || len(opts.lines[frame.index]) == 0 {
+		return img
+	}
+	return drawTextMask(img, linesMask(opts.lines[frame.index]), opts.position, opts.color, 0)
+}
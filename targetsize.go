@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/marcov/giffer/pkg/giffer"
+	"github.com/sirupsen/logrus"
+)
+
+// Units of -target-size. MB are decimal: smaller than MiB, they stay within
+// the limits stated either way.
+var byteSizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1000,
+	"KIB": 1 << 10,
+	"MB":  1000 * 1000,
+	"MIB": 1 << 20,
+	"GB":  1000 * 1000 * 1000,
+	"GIB": 1 << 30,
+}
+
+// Parses a size in bytes, like "8MB", "500KiB" or "1048576".
+func parseByteSize(s string) (error, int64) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+
+	v, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := byteSizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if err != nil || !ok || v <= 0 {
+		return fmt.Errorf("invalid size %q, expected a number of bytes, KB, MB or GB", s), 0
+	}
+	return nil, int64(v * float64(unit))
+}
+
+// Settings shrinking the gif, from the built one.
+type sizeReduction struct {
+	scale  float64 // of the frames
+	colors int     // largest number of colors of the palettes
+	lossy  int     // smallest -lossy
+	every  int     // keep one frame every n, adding up the delays of the others
+}
+
+// The reductions tried in turn, as little as possible of each first: colors
+// and lossiness first, as they show the least, then the frame size, then the
+// frame rate.
+var sizeReductions = []sizeReduction{
+	{1, 256, 0, 1},
+	{1, 128, 20, 1},
+	{1, 64, 40, 1},
+	{0.8, 64, 40, 1},
+	{0.8, 64, 60, 2},
+	{0.65, 64, 60, 2},
+	{0.5, 32, 60, 2},
+	{0.4, 32, 80, 3},
+	{0.3, 32, 80, 4},
+	{0.25, 16, 100, 4},
+}
+
+// Options of -target-size.
+type targetSizeOptions struct {
+	size    int64 // bytes
+	palette *paletteOptions
+	filter  *resampleFilter // resizing the frames
+	format  *outputFormat
+	finish  func(*gif.GIF) // sets the disposal of the frames
+}
+
+// Counts the bytes written.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// Returns the gif, as built before its disposal is set, with the reduction
+// applied. The frames are resized and quantized again, unless only some are
+// dropped.
+func reduceGif(g *gif.GIF, r sizeReduction, opts *targetSizeOptions) *gif.GIF {
+	reduced := &gif.GIF{LoopCount: g.LoopCount, Config: g.Config}
+	var frames []image.Image
+	for i, frame := range g.Image {
+		if i%r.every == 0 {
+			// Setting the disposal may replace the palette of the frames,
+			// which are kept for the next reductions.
+			clone := *frame
+			reduced.Image = append(reduced.Image, &clone)
+			reduced.Delay = append(reduced.Delay, 0)
+			frames = append(frames, frame)
+		}
+		reduced.Delay[len(reduced.Delay)-1] += g.Delay[i]
+	}
+
+	palette := *opts.palette
+	palette.quantize.NumColors = minInt(palette.quantize.NumColors, r.colors)
+	palette.quantize.Lossy = maxInt(palette.quantize.Lossy, r.lossy)
+	if r.scale == 1 && palette.quantize.NumColors == opts.palette.quantize.NumColors && palette.quantize.Lossy == opts.palette.quantize.Lossy {
+		return reduced
+	}
+
+	if r.scale < 1 {
+		runFrameJobs(len(frames), "resizing frames for the target size", func(i int) {
+			b := frames[i].Bounds()
+			w := maxInt(1, int(math.Round(float64(b.Dx())*r.scale)))
+			h := maxInt(1, int(math.Round(float64(b.Dy())*r.scale)))
+			frames[i] = resampleImage(frames[i], w, h, opts.filter)
+		})
+	}
+
+	// The quantization error was checked on the built gif.
+	palette.maxError, palette.fatal = 0, false
+	palette.reset()
+	if palette.global {
+		palette.palette = palette.fixed
+		if palette.palette == nil {
+			source := func(i int) (error, image.Image) {
+				return nil, frames[i]
+			}
+			palette.palette = computeGlobalPalette(len(frames), source, nil, &palette)
+		}
+	}
+	runFrameJobs(len(frames), "quantizing frames for the target size", func(i int) {
+		reduced.Image[i] = quantizeFrame(frames[i], &frameInfo{index: i, total: len(frames)}, &palette).(*image.Paletted)
+	})
+
+	if palette.global {
+		reduced.Config = globalPaletteConfig(reduced.Image, palette.palette)
+	} else {
+		screen := giffer.ScreenRect(reduced.Image)
+		reduced.Config = image.Config{Width: screen.Max.X, Height: screen.Max.Y}
+	}
+	return reduced
+}
+
+// Returns the gif, shrunk by the first of the reductions making it encode to
+// at most opts.size bytes, with its disposal set.
+func fitTargetSize(g *gif.GIF, opts *targetSizeOptions) (error, *gif.GIF) {
+	smallest := int64(math.MaxInt64)
+	var previous sizeReduction
+	for i, r := range sizeReductions {
+		r.colors = minInt(r.colors, opts.palette.quantize.NumColors)
+		r.lossy = maxInt(r.lossy, opts.palette.quantize.Lossy)
+		if i > 0 && r == previous {
+			continue
+		}
+		previous = r
+
+		reduced := reduceGif(g, r, opts)
+		opts.finish(reduced)
+		var size byteCounter
+		if err := opts.format.encode(&size, &animation{GIF: reduced}); err != nil {
+			return err, nil
+		}
+
+		entry := logrus.WithFields(logrus.Fields{
+			"size":   int64(size),
+			"scale":  r.scale,
+			"colors": r.colors,
+			"lossy":  r.lossy,
+			"frames": len(reduced.Image),
+		})
+		if int64(size) <= opts.size {
+			entry.Info("output fits the target size")
+			return nil, reduced
+		}
+		entry.Debug("output above the target size")
+		smallest = minInt64(smallest, int64(size))
+	}
+	return fmt.Errorf("the smallest output is %d bytes, above the %d bytes target", smallest, opts.size), nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tokens available in output templates.
+var templateTokens = map[string]bool{
+	"base":   true, // -o file name, without extension
+	"index":  true, // 1-based output number
+	"subdir": true, // source subdirectory name
+	"ext":    true, // output format extension, without dot
+	"width":  true, // -sizes frame width
+}
+
+type templatePart struct {
+	literal string
+	token   string
+	width   int // minimum width of the index
+	zero    bool
+}
+
+// An output file naming scheme, like "{base}_part{index:03d}.{ext}".
+type outputTemplate struct {
+	parts []templatePart
+}
+
+// The values of the output template tokens.
+type outputNameVars struct {
+	base   string
+	index  int
+	subdir string
+	ext    string
+	width  int
+}
+
+// Parses an output template. Tokens are written as {name}, and the index
+// accepts a printf like width: {index:3d} or zero padded {index:03d}.
+func parseOutputTemplate(s string) (error, *outputTemplate) {
+	t := &outputTemplate{}
+	rest := s
+
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return fmt.Errorf("unbalanced '}' in output template %q", s), nil
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return fmt.Errorf("unterminated token in output template %q", s), nil
+		}
+		token := rest[open+1 : open+end]
+		rest = rest[open+end+1:]
+
+		part := templatePart{token: token}
+		if i := strings.IndexByte(token, ':'); i >= 0 {
+			part.token = token[:i]
+			spec := token[i+1:]
+			if part.token != "index" {
+				return fmt.Errorf("only {index} accepts a format in output template %q", s), nil
+			}
+			if !strings.HasSuffix(spec, "d") {
+				return fmt.Errorf("invalid index format %q in output template %q", spec, s), nil
+			}
+			spec = strings.TrimSuffix(spec, "d")
+			part.zero = strings.HasPrefix(spec, "0")
+			if spec != "" {
+				width, err := strconv.Atoi(spec)
+				if err != nil || width < 0 {
+					return fmt.Errorf("invalid index format %q in output template %q", token[i+1:], s), nil
+				}
+				part.width = width
+			}
+		}
+
+		if !templateTokens[part.token] {
+			return fmt.Errorf("unknown token {%s} in output template %q", part.token, s), nil
+		}
+		t.parts = append(t.parts, part)
+	}
+
+	return nil, t
+}
+
+// Returns the output path for the given token values.
+func (t *outputTemplate) render(vars *outputNameVars) string {
+	var b strings.Builder
+	for _, part := range t.parts {
+		switch part.token {
+		case "":
+			b.WriteString(part.literal)
+		case "base":
+			b.WriteString(vars.base)
+		case "subdir":
+			b.WriteString(vars.subdir)
+		case "ext":
+			b.WriteString(vars.ext)
+		case "width":
+			b.WriteString(strconv.Itoa(vars.width))
+		case "index":
+			format := "%" + strconv.Itoa(part.width) + "d"
+			if part.zero {
+				format = "%0" + strconv.Itoa(part.width) + "d"
+			}
+			fmt.Fprintf(&b, format, vars.index)
+		}
+	}
+	return b.String()
+}
+
+// Returns an error if two outputs resolve to the same path.
+func checkOutputConflicts(paths []string) error {
+	seen := make(map[string]int, len(paths))
+	for i, path := range paths {
+		if j, ok := seen[path]; ok {
+			return fmt.Errorf("outputs %d and %d both resolve to %q", j+1, i+1, path)
+		}
+		seen[path] = i
+	}
+	return nil
+}
+
+// Checks that the outputs are new files, or removes them if replace.
+func checkNewOutputs(paths []string, replace bool) error {
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if !replace {
+			logrus.WithFields(logrus.Fields{"file": path}).Error("output file already exists")
+			return errors.New("output file already exists")
+		}
+		if err := os.Remove(path); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("cannot remove the partial output")
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Shortest inter-frame delay (in centiseconds) played back as such by most
+// viewers: browsers clamp shorter delays to 10cs.
+const MIN_DELAY_CS = 2
+
+// Converts a duration to GIF centiseconds.
+func durationToCs(d time.Duration) int {
+	return int(d / (10 * time.Millisecond))
+}
+
+// Spreads totalCs centiseconds over numFrames frames, so that the sum of the
+// returned delays is exactly totalCs.
+func spreadDelay(numFrames, totalCs int) []int {
+	delays := make([]int, numFrames)
+	for i := range delays {
+		delays[i] = (i+1)*totalCs/numFrames - i*totalCs/numFrames
+	}
+	return delays
+}
+
+// Returns the delays of numFrames frames played at fps frames per second. The
+// delays are rounded to centiseconds so that each frame starts at the closest
+// centisecond of its exact time, e.g. 3, 4, 3 for 30 fps, instead of drifting
+// by always rounding the same way.
+func fpsDelays(numFrames int, fps float64) []int {
+	delays := make([]int, numFrames)
+	for i := range delays {
+		delays[i] = int(math.Round(float64(i+1)*100/fps)) - int(math.Round(float64(i)*100/fps))
+	}
+	return delays
+}
+
+// Longest delay of a gif frame, in centiseconds.
+const MAX_DELAY_CS = 0xffff
+
+// Returns the delays of frames captured at times, the gaps between their
+// capture times multiplied by scale, within the playable delays. A frame
+// without capture time, or followed by one without, or by an earlier one,
+// gets its fallback delay, as the last frame does.
+func realTimeDelays(times []time.Time, found []bool, scale float64, fallback []int) []int {
+	delays := append([]int(nil), fallback...)
+	for i := 0; i+1 < len(times); i++ {
+		if !found[i] || !found[i+1] {
+			continue
+		}
+		gap := times[i+1].Sub(times[i])
+		if gap < 0 {
+			continue
+		}
+		delays[i] = int(math.Round(gap.Seconds() * 100 * scale))
+		if delays[i] < MIN_DELAY_CS {
+			delays[i] = MIN_DELAY_CS
+		}
+		if delays[i] > MAX_DELAY_CS {
+			delays[i] = MAX_DELAY_CS
+		}
+	}
+	return delays
+}
+
+// Returns the number of frames, up to numFrames, that can be played within
+// totalCs centiseconds without going below MIN_DELAY_CS per frame.
+func framesFittingDuration(numFrames, totalCs int) int {
+	fit := totalCs / MIN_DELAY_CS
+	if fit < 1 {
+		fit = 1
+	}
+	if fit > numFrames {
+		fit = numFrames
+	}
+	return fit
+}
+
+// Returns keep indices evenly spread in [0, numFrames), always including the
+// first frame.
+func evenlySample(numFrames, keep int) []int {
+	if keep > numFrames {
+		keep = numFrames
+	}
+
+	indices := make([]int, keep)
+	for i := range indices {
+		indices[i] = i * numFrames / keep
+	}
+	return indices
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Spreads the luma histogram of the frame over the full range, boosting the
+// contrast of low contrast (e.g. foggy) frames. Chroma is left untouched.
+// Note that this also amplifies the noise of flat areas.
+func equalizeImage(img image.Image) *image.RGBA {
+	dst := copyRGBA(img)
+
+	var hist [256]int
+	total := 0
+	for i := 0; i < len(dst.Pix); i += 4 {
+		if dst.Pix[i+3] == 0 {
+			continue // transparent
+		}
+		y, _, _ := color.RGBToYCbCr(dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2])
+		hist[y]++
+		total++
+	}
+
+	// Map each luma level to its position in the cumulative distribution,
+	// ignoring the unused levels below the darkest pixel.
+	var lut [256]uint8
+	cdf, cdfMin := 0, 0
+	for level, count := range hist {
+		cdf += count
+		if cdfMin == 0 {
+			cdfMin = cdf
+		}
+		if total > cdfMin {
+			lut[level] = uint8((cdf - cdfMin) * 255 / (total - cdfMin))
+		} else {
+			lut[level] = uint8(level)
+		}
+	}
+
+	for i := 0; i < len(dst.Pix); i += 4 {
+		if dst.Pix[i+3] == 0 {
+			continue
+		}
+		y, cb, cr := color.RGBToYCbCr(dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2])
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = color.YCbCrToRGB(lut[y], cb, cr)
+	}
+
+	return dst
+}
+
+// Levels per channel of the posterize effect, unless set as posterize:N.
+const DEFAULT_POSTERIZE_LEVELS = 4
+
+// A color effect, mapping each straight (not alpha premultiplied) color.
+type effect func(r, g, b uint8) (uint8, uint8, uint8)
+
+var effectNames = []string{"grayscale", "sepia", "invert", "posterize[:N]"}
+
+func grayscale(r, g, b uint8) (uint8, uint8, uint8) {
+	y, _, _ := color.RGBToYCbCr(r, g, b)
+	return y, y, y
+}
+
+func sepia(r, g, b uint8) (uint8, uint8, uint8) {
+	rf, gf, bf := float64(r), float64(g), float64(b)
+	return clampUint8(0.393*rf + 0.769*gf + 0.189*bf),
+		clampUint8(0.349*rf + 0.686*gf + 0.168*bf),
+		clampUint8(0.272*rf + 0.534*gf + 0.131*bf)
+}
+
+func invert(r, g, b uint8) (uint8, uint8, uint8) {
+	return 255 - r, 255 - g, 255 - b
+}
+
+// Returns the effect reducing each channel to the given number of levels,
+// evenly spread from black to full intensity.
+func posterize(levels int) effect {
+	var lut [256]uint8
+	for v := range lut {
+		step := int(math.Round(float64(v) * float64(levels-1) / 255))
+		lut[v] = uint8(step * 255 / (levels - 1))
+	}
+	return func(r, g, b uint8) (uint8, uint8, uint8) {
+		return lut[r], lut[g], lut[b]
+	}
+}
+
+func clampUint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// Parses a comma separated list of effects, applied in order.
+func parseEffects(spec string) (error, []effect) {
+	var effects []effect
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "grayscale":
+			effects = append(effects, grayscale)
+		case name == "sepia":
+			effects = append(effects, sepia)
+		case name == "invert":
+			effects = append(effects, invert)
+		case name == "posterize" || strings.HasPrefix(name, "posterize:"):
+			levels := DEFAULT_POSTERIZE_LEVELS
+			if arg := strings.TrimPrefix(name, "posterize"); arg != "" {
+				n, err := strconv.Atoi(arg[1:])
+				if err != nil || n < 2 || n > 256 {
+					return fmt.Errorf("invalid posterize levels %q, expected 2 to 256", arg[1:]), nil
+				}
+				levels = n
+			}
+			effects = append(effects, posterize(levels))
+		default:
+			return fmt.Errorf("unknown effect %q, expected one of: %s", name, strings.Join(effectNames, ", ")), nil
+		}
+	}
+	return nil, effects
+}
+
+// Applies the effects, in order, to the colors of the frame. Transparency is
+// left untouched.
+func applyEffects(img image.Image, effects []effect) *image.RGBA {
+	dst := copyRGBA(img)
+
+	for i := 0; i < len(dst.Pix); i += 4 {
+		a := uint32(dst.Pix[i+3])
+		if a == 0 {
+			continue // transparent
+		}
+
+		r, g, b := dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2]
+		if a < 255 {
+			r, g, b = uint8(uint32(r)*255/a), uint8(uint32(g)*255/a), uint8(uint32(b)*255/a)
+		}
+		for _, e := range effects {
+			r, g, b = e(r, g, b)
+		}
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = uint8(uint32(r)*a/255), uint8(uint32(g)*a/255), uint8(uint32(b)*a/255)
+	}
+
+	return dst
+}
+
+// Options of the adjust stage, the neutral values leave the frames unchanged.
+type adjustOptions struct {
+	brightness float64 // added, from -1 (black) to 1 (white), 0 neutral
+	contrast   float64 // scale around mid gray, 1 neutral
+	gamma      float64 // above 1 brightens the midtones, 1 neutral
+	saturation float64 // 0 for grayscale, 1 neutral
+}
+
+func parseAdjustOptions(brightness, contrast, gamma, saturation float64) (error, *adjustOptions) {
+	if brightness < -1 || brightness > 1 {
+		return fmt.Errorf("brightness %v out of range, expected -1 to 1", brightness), nil
+	}
+	if contrast < 0 || saturation < 0 {
+		return fmt.Errorf("negative contrast or saturation"), nil
+	}
+	if gamma <= 0 {
+		return fmt.Errorf("gamma %v must be positive", gamma), nil
+	}
+	return nil, &adjustOptions{brightness: brightness, contrast: contrast, gamma: gamma, saturation: saturation}
+}
+
+// Returns the effect applying the adjustments: brightness, then contrast and
+// gamma to each channel, then saturation.
+func (opts *adjustOptions) effect() effect {
+	var lut [256]uint8
+	for v := range lut {
+		f := float64(v)/255 + opts.brightness
+		f = (f-0.5)*opts.contrast + 0.5
+		f = math.Pow(math.Max(0, math.Min(1, f)), 1/opts.gamma)
+		lut[v] = clampUint8(f * 255)
+	}
+
+	return func(r, g, b uint8) (uint8, uint8, uint8) {
+		r, g, b = lut[r], lut[g], lut[b]
+		if opts.saturation == 1 {
+			return r, g, b
+		}
+		y, _, _ := color.RGBToYCbCr(r, g, b)
+		gray := float64(y)
+		return clampUint8(gray + (float64(r)-gray)*opts.saturation),
+			clampUint8(gray + (float64(g)-gray)*opts.saturation),
+			clampUint8(gray + (float64(b)-gray)*opts.saturation)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/marcov/giffer/pkg/giffer"
+	"github.com/sirupsen/logrus"
+)
+
+// Extracts frames of the video file at path to png files, sampling fps frames
+// per second of video, using ffmpeg. Returns the frames files, in playback
+// order, and a function removing them.
+func extractVideoFrames(path string, fps float64) (error, []string, func()) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		err = errors.New("video input requires ffmpeg")
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("cannot extract video frames")
+		return err, nil, nil
+	}
+
+	tmpdir, err := ioutil.TempDir("", MYNAME+"-video")
+	if err != nil {
+		logrus.WithField("error", err).Error("While creating temporary directory")
+		return err, nil, nil
+	}
+	cleanup := func() { os.RemoveAll(tmpdir) }
+
+	logrus.WithFields(logrus.Fields{"file": path, "fps": fps}).Info("Extracting video frames")
+
+	cmd := exec.Command(ffmpeg, "-loglevel", "error", "-nostdin", "-i", path,
+		"-vf", "fps="+strconv.FormatFloat(fps, 'f', -1, 64), filepath.Join(tmpdir, "frame-%08d.png"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "file": path, "output": string(out)}).Error("while extracting video frames")
+		cleanup()
+		return err, nil, nil
+	}
+
+	// Frame numbers are zero padded, so that the names sort in playback order.
+	frames, err := filepath.Glob(filepath.Join(tmpdir, "frame-*.png"))
+	if err != nil || len(frames) == 0 {
+		err = fmt.Errorf("no frames extracted")
+		logrus.WithFields(logrus.Fields{"error": err, "file": path}).Error("while extracting video frames")
+		cleanup()
+		return err, nil, nil
+	}
+	sort.Strings(frames)
+
+	return nil, frames, cleanup
+}
+
+// The ffmpeg encoding of a video format.
+type videoCodec struct {
+	args  []string // output options
+	alpha bool     // whether the video keeps the transparency
+	loop  string   // option of the number of plays, "" if left to the player
+}
+
+// The video formats, by name.
+var videoCodecs = map[string]*videoCodec{
+	// Most players, browsers included, only decode 4:2:0 h264, and play it
+	// before it has fully downloaded with the index first.
+	"mp4": {args: []string{"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart"}},
+	// -b:v 0 makes -crf a constant quality.
+	"webm": {args: []string{"-c:v", "libvpx-vp9", "-pix_fmt", "yuva420p", "-b:v", "0", "-crf", "31"}, alpha: true},
+	// Animated AVIF, muxed by ffmpeg 6 and later, using the AV1 video codec.
+	"avif": {args: []string{"-c:v", "libaom-av1", "-pix_fmt", "yuv420p", "-b:v", "0", "-crf", "30", "-cpu-used", "6"}, loop: "-loop"},
+}
+
+// Returns whether ffmpeg, which encodes the video formats, is installed.
+func hasFfmpeg() bool {
+	_, err := exec.LookPath("ffmpeg")
+	return err == nil
+}
+
+// Returns the encoder of the frames of the animation, before quantization,
+// to a video in the given format, using ffmpeg. Each frame lasts its delay.
+// Most videos have no loop count: looping is up to the player.
+func videoEncoder(name string) func(io.Writer, *animation) error {
+	return func(w io.Writer, anim *animation) error {
+		return encodeVideo(w, anim, name)
+	}
+}
+
+func encodeVideo(w io.Writer, anim *animation, name string) error {
+	frames := anim.fullColor
+	if len(frames) == 0 {
+		return giffer.ErrNoFrames
+	}
+	codec := videoCodecs[name]
+
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return errors.New("video output requires ffmpeg")
+	}
+
+	tmpdir, err := ioutil.TempDir("", MYNAME+"-video")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// The frames are drawn on the screen, whose dimensions the 4:2:0 chroma
+	// subsampling requires to be even, transparent or black.
+	screen := image.Rect(0, 0, anim.Config.Width+anim.Config.Width%2, anim.Config.Height+anim.Config.Height%2)
+	errs := make([]error, len(frames))
+	runFrameJobs(len(frames), "writing video frames", func(i int) {
+		img := image.NewNRGBA(screen)
+		op := draw.Src
+		if !codec.alpha {
+			draw.Draw(img, screen, image.Black, image.ZP, draw.Src)
+			op = draw.Over
+		}
+		draw.Draw(img, frames[i].Bounds(), frames[i], frames[i].Bounds().Min, op)
+		buf := &bytes.Buffer{}
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		if errs[i] = enc.Encode(buf, img); errs[i] == nil {
+			errs[i] = ioutil.WriteFile(filepath.Join(tmpdir, fmt.Sprintf("frame-%08d.png", i)), buf.Bytes(), 0644)
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	// The concat demuxer ignores the duration of the last file, unless it is
+	// listed again.
+	list := &bytes.Buffer{}
+	fmt.Fprintln(list, "ffconcat version 1.0")
+	for i := range frames {
+		fmt.Fprintf(list, "file frame-%08d.png\nduration %.2f\n", i, float64(maxInt(anim.Delay[i], 1))/100)
+	}
+	fmt.Fprintf(list, "file frame-%08d.png\n", len(frames)-1)
+	listPath := filepath.Join(tmpdir, "frames.txt")
+	if err := ioutil.WriteFile(listPath, list.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	videoPath := filepath.Join(tmpdir, "video."+name)
+	args := []string{"-loglevel", "error", "-nostdin", "-f", "concat", "-i", listPath, "-vsync", "vfr"}
+	args = append(args, codec.args...)
+	if codec.loop != "" {
+		args = append(args, codec.loop, strconv.Itoa(playCount(anim.LoopCount)))
+	}
+	args = append(args, videoPath)
+	logrus.WithFields(logrus.Fields{"format": name, "frames": len(frames)}).Info("Encoding video")
+	if out, err := exec.Command(ffmpeg, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	video, err := os.Open(videoPath)
+	if err != nil {
+		return err
+	}
+	defer video.Close()
+	_, err = io.Copy(w, video)
+	return err
+}
@@ -0,0 +1,297 @@
+//go:build !libwebp || !cgo
+// +build !libwebp !cgo
+
+package main
+
+import (
+	"container/heap"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Pure Go encoder of the WebP lossless (VP8L) bitstream. It only uses the
+// literal pixel coding: no transforms, no color cache and no backward
+// references, so the output is bigger than what libwebp produces.
+
+const (
+	VP8L_SIGNATURE      = 0x2f
+	VP8L_MAX_CODE_LEN   = 15
+	VP8L_MAX_CLCODE_LEN = 7
+	VP8L_GREEN_SYMBOLS  = 256 + 24
+	VP8L_OTHER_SYMBOLS  = 256
+)
+
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// LSB first bit writer.
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) writeBits(value uint32, n uint) {
+	b.acc |= uint64(value) << b.nbits
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nbits -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.nbits > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nbits = 0, 0
+	}
+	return b.buf
+}
+
+// A canonical prefix code.
+type prefixCode struct {
+	lengths []int
+	codes   []uint32 // bit reversed, ready to be written LSB first
+}
+
+type huffNode struct {
+	freq   int
+	symbol int // -1 for internal nodes
+	left   *huffNode
+	right  *huffNode
+}
+
+type huffHeap []*huffNode
+
+func (h huffHeap) Len() int { return len(h) }
+func (h huffHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h huffHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffHeap) Push(x interface{}) { *h = append(*h, x.(*huffNode)) }
+func (h *huffHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// Computes the huffman code lengths of the symbols, limited to maxLen bits.
+// At least two symbols must have a non zero frequency.
+func huffmanLengths(freqs []int, maxLen int) []int {
+	freqs = append([]int(nil), freqs...)
+	for {
+		h := &huffHeap{}
+		for s, f := range freqs {
+			if f > 0 {
+				*h = append(*h, &huffNode{freq: f, symbol: s})
+			}
+		}
+		heap.Init(h)
+
+		for h.Len() > 1 {
+			a := heap.Pop(h).(*huffNode)
+			b := heap.Pop(h).(*huffNode)
+			heap.Push(h, &huffNode{freq: a.freq + b.freq, symbol: -1, left: a, right: b})
+		}
+
+		lengths := make([]int, len(freqs))
+		tooLong := false
+		var walk func(n *huffNode, depth int)
+		walk = func(n *huffNode, depth int) {
+			if n.symbol >= 0 {
+				lengths[n.symbol] = depth
+				tooLong = tooLong || depth > maxLen
+				return
+			}
+			walk(n.left, depth+1)
+			walk(n.right, depth+1)
+		}
+		walk((*h)[0], 0)
+
+		if !tooLong {
+			return lengths
+		}
+
+		// Flatten the distribution until the tree is shallow enough.
+		for s, f := range freqs {
+			if f > 0 {
+				freqs[s] = f/2 + 1
+			}
+		}
+	}
+}
+
+// Assigns the canonical codes to the code lengths.
+func newPrefixCode(lengths []int) *prefixCode {
+	pc := &prefixCode{lengths: lengths, codes: make([]uint32, len(lengths))}
+
+	var count [VP8L_MAX_CODE_LEN + 1]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+
+	var next [VP8L_MAX_CODE_LEN + 2]uint32
+	code := uint32(0)
+	for l := 1; l <= VP8L_MAX_CODE_LEN; l++ {
+		code = (code + uint32(count[l-1])) << 1
+		next[l] = code
+	}
+
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+
+		rev := uint32(0)
+		for i := 0; i < l; i++ {
+			rev = rev<<1 | (c>>uint(i))&1
+		}
+		pc.codes[s] = rev
+	}
+
+	return pc
+}
+
+func (pc *prefixCode) write(b *bitWriter, symbol int) {
+	b.writeBits(pc.codes[symbol], uint(pc.lengths[symbol]))
+}
+
+// Writes the prefix code for the symbol frequencies, and returns it.
+func writePrefixCode(b *bitWriter, freqs []int) *prefixCode {
+	var used []int
+	for s, f := range freqs {
+		if f > 0 {
+			used = append(used, s)
+		}
+	}
+
+	// Simple code: up to two 8 bit symbols, decoded with 0 or 1 bit.
+	if len(used) <= 2 {
+		if len(used) == 0 {
+			used = []int{0}
+		}
+
+		lengths := make([]int, len(freqs))
+		b.writeBits(1, 1)
+		b.writeBits(uint32(len(used)-1), 1)
+		b.writeBits(1, 1)
+		b.writeBits(uint32(used[0]), 8)
+		if len(used) == 2 {
+			b.writeBits(uint32(used[1]), 8)
+			lengths[used[0]], lengths[used[1]] = 1, 1
+		}
+
+		return newPrefixCode(lengths)
+	}
+
+	lengths := huffmanLengths(freqs, VP8L_MAX_CODE_LEN)
+
+	// The code lengths are themselves prefix coded, literally (no repeat
+	// codes).
+	clFreqs := make([]int, len(vp8lCodeLengthOrder))
+	for _, l := range lengths {
+		clFreqs[l]++
+	}
+	numUsed := 0
+	for _, f := range clFreqs {
+		if f > 0 {
+			numUsed++
+		}
+	}
+	if numUsed == 1 {
+		// A prefix code needs at least two symbols.
+		if clFreqs[0] == 0 {
+			clFreqs[0] = 1
+		} else {
+			clFreqs[1] = 1
+		}
+	}
+	clLengths := huffmanLengths(clFreqs, VP8L_MAX_CLCODE_LEN)
+	clCode := newPrefixCode(clLengths)
+
+	numCodes := len(vp8lCodeLengthOrder)
+	for numCodes > 4 && clLengths[vp8lCodeLengthOrder[numCodes-1]] == 0 {
+		numCodes--
+	}
+
+	b.writeBits(0, 1)
+	b.writeBits(uint32(numCodes-4), 4)
+	for i := 0; i < numCodes; i++ {
+		b.writeBits(uint32(clLengths[vp8lCodeLengthOrder[i]]), 3)
+	}
+
+	// All the symbols are coded, no max_symbol.
+	b.writeBits(0, 1)
+	for _, l := range lengths {
+		clCode.write(b, l)
+	}
+
+	return newPrefixCode(lengths)
+}
+
+// Encodes img as a VP8L bitstream, without the chunk header.
+func encodeVP8L(w io.Writer, img image.Image) error {
+	r := img.Bounds()
+	width, height := r.Dx(), r.Dy()
+
+	argb := make([][4]int, 0, width*height)
+	hasAlpha := false
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			argb = append(argb, [4]int{int(c.G), int(c.R), int(c.B), int(c.A)})
+			hasAlpha = hasAlpha || c.A != 0xff
+		}
+	}
+
+	b := &bitWriter{}
+	b.writeBits(VP8L_SIGNATURE, 8)
+	b.writeBits(uint32(width-1), 14)
+	b.writeBits(uint32(height-1), 14)
+	if hasAlpha {
+		b.writeBits(1, 1)
+	} else {
+		b.writeBits(0, 1)
+	}
+	b.writeBits(0, 3) // version
+
+	b.writeBits(0, 1) // no transform
+	b.writeBits(0, 1) // no color cache
+	b.writeBits(0, 1) // single prefix code group
+
+	freqs := [4][]int{
+		make([]int, VP8L_GREEN_SYMBOLS),
+		make([]int, VP8L_OTHER_SYMBOLS),
+		make([]int, VP8L_OTHER_SYMBOLS),
+		make([]int, VP8L_OTHER_SYMBOLS),
+	}
+	for _, px := range argb {
+		for c := range px {
+			freqs[c][px[c]]++
+		}
+	}
+
+	var codes [4]*prefixCode
+	for c := range freqs {
+		codes[c] = writePrefixCode(b, freqs[c])
+	}
+	// Unused distance code.
+	writePrefixCode(b, make([]int, 40))
+
+	for _, px := range argb {
+		for c := range px {
+			codes[c].write(b, px[c])
+		}
+	}
+
+	_, err := w.Write(b.bytes())
+	return err
+}
@@ -0,0 +1,113 @@
+//go:build libwebp && cgo
+// +build libwebp,cgo
+
+package main
+
+// #cgo pkg-config: libwebpmux libwebp
+// #include <stdlib.h>
+// #include <webp/encode.h>
+// #include <webp/mux.h>
+//
+// static WebPAnimEncoder* newAnimEncoder(int width, int height, int loops) {
+// 	WebPAnimEncoderOptions options;
+// 	if (!WebPAnimEncoderOptionsInit(&options)) {
+// 		return NULL;
+// 	}
+// 	options.anim_params.loop_count = loops;
+// 	return WebPAnimEncoderNew(width, height, &options);
+// }
+//
+// static int addFrame(WebPAnimEncoder* enc, uint8_t* rgba, int width, int height, int timestamp, float quality) {
+// 	WebPConfig config;
+// 	WebPPicture pic;
+// 	int ok;
+//
+// 	if (!WebPConfigInit(&config) || !WebPPictureInit(&pic)) {
+// 		return 0;
+// 	}
+// 	config.quality = quality;
+// 	pic.use_argb = 1;
+// 	pic.width = width;
+// 	pic.height = height;
+// 	if (!WebPPictureImportRGBA(&pic, rgba, width * 4)) {
+// 		return 0;
+// 	}
+// 	ok = WebPAnimEncoderAdd(enc, &pic, timestamp, &config);
+// 	WebPPictureFree(&pic);
+// 	return ok;
+// }
+//
+// static int assemble(WebPAnimEncoder* enc, int timestamp, uint8_t** out, size_t* size) {
+// 	WebPData data;
+//
+// 	WebPDataInit(&data);
+// 	if (!WebPAnimEncoderAdd(enc, NULL, timestamp, NULL) || !WebPAnimEncoderAssemble(enc, &data)) {
+// 		return 0;
+// 	}
+// 	*out = (uint8_t*)data.bytes;
+// 	*size = data.size;
+// 	return 1;
+// }
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"unsafe"
+)
+
+const WEBP_ENCODER = "libwebp encoder, lossy"
+
+// Quality of the lossy WebP compression, from 0 to 100.
+const WEBP_QUALITY = 80
+
+// Encodes the gif frames as an animated WebP, using libwebp.
+func encodeWebp(w io.Writer, gifInfo *gif.GIF) error {
+	var canvas image.Rectangle
+	for _, frame := range gifInfo.Image {
+		canvas = canvas.Union(frame.Rect)
+	}
+
+	// WebP loop count is the total number of plays, with 0 meaning forever.
+	loops := webpPlayCount(gifInfo.LoopCount)
+
+	enc := C.newAnimEncoder(C.int(canvas.Dx()), C.int(canvas.Dy()), C.int(loops))
+	if enc == nil {
+		return errors.New("could not create the libwebp encoder")
+	}
+	defer C.WebPAnimEncoderDelete(enc)
+
+	// libwebp works on full canvas frames: compose them as a gif viewer
+	// would, it takes care of cropping the unchanged areas.
+	rgba := image.NewNRGBA(canvas)
+	timestamp := 0
+	for i, frame := range gifInfo.Image {
+		draw.Draw(rgba, frame.Rect, frame, frame.Rect.Min, draw.Over)
+
+		pix := C.CBytes(rgba.Pix)
+		ok := C.addFrame(enc, (*C.uint8_t)(pix), C.int(canvas.Dx()), C.int(canvas.Dy()),
+			C.int(timestamp), C.float(WEBP_QUALITY))
+		C.free(pix)
+		if ok == 0 {
+			return errors.New("libwebp could not encode frame")
+		}
+
+		timestamp += gifInfo.Delay[i] * 10
+		if gifInfo.Disposal != nil && gifInfo.Disposal[i] == gif.DisposalBackground {
+			draw.Draw(rgba, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+
+	var out *C.uint8_t
+	var size C.size_t
+	if C.assemble(enc, C.int(timestamp), &out, &size) == 0 {
+		return errors.New("libwebp could not assemble the animation")
+	}
+	defer C.WebPFree(unsafe.Pointer(out))
+
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out), C.int(size)))
+	return err
+}
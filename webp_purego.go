@@ -0,0 +1,99 @@
+//go:build !libwebp || !cgo
+// +build !libwebp !cgo
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+const WEBP_ENCODER = "pure Go encoder, lossless only"
+
+// Appends a RIFF chunk, padded to an even size.
+func appendChunk(buf *bytes.Buffer, fourcc string, payload []byte) {
+	buf.WriteString(fourcc)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	if len(payload)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func appendUint24(b []byte, v int) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
+
+// Encodes the gif frames as an animated WebP, each frame being losslessly
+// coded.
+func encodeWebp(w io.Writer, gifInfo *gif.GIF) error {
+	var width, height int
+	for _, frame := range gifInfo.Image {
+		if frame.Rect.Max.X > width {
+			width = frame.Rect.Max.X
+		}
+		if frame.Rect.Max.Y > height {
+			height = frame.Rect.Max.Y
+		}
+	}
+
+	body := &bytes.Buffer{}
+	body.WriteString("WEBP")
+
+	// Animation and alpha flags.
+	vp8x := []byte{0x02 | 0x10, 0, 0, 0}
+	vp8x = appendUint24(vp8x, width-1)
+	vp8x = appendUint24(vp8x, height-1)
+	appendChunk(body, "VP8X", vp8x)
+
+	// WebP loop count is the total number of plays, with 0 meaning forever.
+	loops := webpPlayCount(gifInfo.LoopCount)
+	anim := []byte{0, 0, 0, 0}
+	anim = append(anim, byte(loops), byte(loops>>8))
+	appendChunk(body, "ANIM", anim)
+
+	for i, frame := range gifInfo.Image {
+		// Frame offsets are stored halved: odd offsets are extended with
+		// transparent pixels.
+		var img image.Image = frame
+		r := frame.Rect
+		r.Min.X &^= 1
+		r.Min.Y &^= 1
+		if r != frame.Rect {
+			extended := image.NewNRGBA(r)
+			draw.Draw(extended, frame.Rect, frame, frame.Rect.Min, draw.Src)
+			img = extended
+		}
+
+		bitstream := &bytes.Buffer{}
+		if err := encodeVP8L(bitstream, img); err != nil {
+			return err
+		}
+
+		anmf := appendUint24(nil, r.Min.X/2)
+		anmf = appendUint24(anmf, r.Min.Y/2)
+		anmf = appendUint24(anmf, r.Dx()-1)
+		anmf = appendUint24(anmf, r.Dy()-1)
+		anmf = appendUint24(anmf, gifInfo.Delay[i]*10)
+		// Frames are alpha blended on the previous ones, as gif frames are.
+		// WebP has no equivalent of the gif "restore to previous" disposal.
+		flags := byte(0)
+		if gifInfo.Disposal != nil && gifInfo.Disposal[i] == gif.DisposalBackground {
+			flags |= 0x01
+		}
+		anmf = append(anmf, flags)
+
+		frameData := &bytes.Buffer{}
+		appendChunk(frameData, "VP8L", bitstream.Bytes())
+		appendChunk(body, "ANMF", append(anmf, frameData.Bytes()...))
+	}
+
+	riff := &bytes.Buffer{}
+	appendChunk(riff, "RIFF", body.Bytes())
+	_, err := w.Write(riff.Bytes())
+	return err
+}